@@ -0,0 +1,214 @@
+// hil-vpn-hook is run by openvpn when it brings a vpn's tap device up or
+// down, to attach the device to the bridge for the vpn's vlan, or detach it
+// again. The generated openvpn configs run it as:
+//
+//	hil-vpn-hook up [--trunk <nic>] [--bridge-name <template>] <vlan-no>
+//	hil-vpn-hook down [--bridge-name <template>] <vlan-no>
+//	hil-vpn-hook up [--trunk <nic>] --vlan-filtering --bridge <bridge> <vlan-no>
+//	hil-vpn-hook down --vlan-filtering --bridge <bridge> <vlan-no>
+//	hil-vpn-hook up|down --ovs --bridge <bridge> [--ovsdb <socket>] <vlan-no>
+//	hil-vpn-hook up|down --vtep <addr> [--vxlan-group <addr> --vxlan-nic <nic>]
+//		[--vxlan-port <port>] vxlan:<vni>
+//
+// <vlan-no> may also be a comma-separated list of vlans, e.g. "232,233", in
+// which case the device carries them all, tagged; see bridge.Backend. A
+// single vlan is carried tagged too if it is prefixed with "trunk:", e.g.
+// "trunk:232".
+//
+// openvpn appends further arguments, the first of which is the name of the
+// device; it also passes the device's name in the environment variable
+// $dev, which we prefer.
+//
+// By default, the device is attached to the vlan's own bridge, named per
+// the --bridge-name template (see bridge.NameFrom), which defaults to
+// bridge.DefaultNameTemplate. With --vlan-filtering, it is instead attached to the given
+// vlan-filtering bridge, as an untagged port for the vlan; see
+// bridge.AttachAccess.
+//
+// With --ovs, it is instead added to the given Open vSwitch bridge, as an
+// access port for the vlan, via ovsdb-server's socket; see bridge.OVS.
+//
+// If --trunk is given, the bridge is created (and connected to the vlan via
+// the named nic) if need be; see bridge.Ensure and bridge.EnsureFiltering.
+//
+// A vpn on a vxlan network, rather than vlans, is attached to the network's
+// own bridge, which is created if need be, connected to the network via a
+// vxlan device with the local tunnel endpoint given by --vtep; see
+// bridge.Vxlan.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CCI-MOC/hil-vpn/internal/bridge"
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb"
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
+)
+
+// The name under which this program used to be installed, as a shell
+// script which only handled "up". Configs generated before then still run
+// it by that name, so we accept it as shorthand for "hil-vpn-hook up".
+const legacyUpName = "hil-vpn-hook-up"
+
+func usage() {
+	fmt.Fprintln(os.Stderr, strings.Join([]string{
+		`Usage:`,
+		``,
+		`    hil-vpn-hook up [<options>] <network> [<dev> <openvpn-args>...]`,
+		`    hil-vpn-hook down [<options>] <network> [<dev> <openvpn-args>...]`,
+		``,
+		`<network> is a vlan number, a comma-separated list of them (a trunk),`,
+		`trunk:<vlan-no> for a trunk of one vlan, or vxlan:<vni> for a vxlan`,
+		`network.`,
+		``,
+		`Options:`,
+		``,
+		`    --trunk <nic>       create the bridge on <nic> if it is missing`,
+		`    --bridge-name <template>`,
+		`                        the names of the vlans' bridges, with {vlan}`,
+		`                        standing for the vlan number`,
+		`    --vlan-filtering    attach to a single vlan-filtering bridge`,
+		`    --ovs               attach to a single Open vSwitch bridge`,
+		`    --bridge <bridge>   the vlan-filtering or Open vSwitch bridge`,
+		`    --ovsdb <socket>    the path to ovsdb-server's socket`,
+		`    --vtep <addr>       the local vxlan tunnel endpoint`,
+		`    --vxlan-group <addr>`,
+		`                        the multicast group for vxlan traffic`,
+		`    --vxlan-nic <nic>   the nic to send vxlan traffic on`,
+		`    --vxlan-port <port> the UDP port for vxlan traffic`,
+		``,
+		`This is meant to be run by openvpn, via the up and down directives.`,
+	}, "\n"))
+	os.Exit(1)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("hil-vpn-hook: ")
+
+	args := os.Args[1:]
+	if filepath.Base(os.Args[0]) == legacyUpName {
+		args = append([]string{"up"}, args...)
+	}
+	if len(args) < 1 {
+		usage()
+	}
+	action := args[0]
+	flags := flag.NewFlagSet("hil-vpn-hook "+action, flag.ExitOnError)
+	flags.Usage = usage
+	trunk := flags.String("trunk", "", "nic to create the vlan's bridge on")
+	nameTemplate := flags.String("bridge-name", bridge.DefaultNameTemplate,
+		"template for the names of the vlans' bridges")
+	filtering := flags.Bool("vlan-filtering", false, "attach to a vlan-filtering bridge")
+	ovs := flags.Bool("ovs", false, "attach to an Open vSwitch bridge")
+	singleBridge := flags.String("bridge", "", "the vlan-filtering or Open vSwitch bridge")
+	ovsdbSocket := flags.String("ovsdb", ovsdb.DefaultSocket, "ovsdb-server's socket")
+	vtep := flags.String("vtep", "", "the local vxlan tunnel endpoint")
+	vxlanGroup := flags.String("vxlan-group", "", "the multicast group for vxlan traffic")
+	vxlanNic := flags.String("vxlan-nic", "", "the nic to send vxlan traffic on")
+	vxlanPort := flags.Uint("vxlan-port", bridge.DefaultVxlanPort, "the UDP port for vxlan traffic")
+	flags.Parse(args[1:])
+	if flags.NArg() < 1 {
+		usage()
+	}
+	netArg, rest := flags.Arg(0), flags.Args()[1:]
+
+	vlans, tagged, vni, err := validate.ParseNetwork(netArg)
+	if err != nil {
+		log.Fatalf("Invalid network %q: %v", netArg, err)
+	}
+	dev := os.Getenv("dev")
+	if dev == "" && len(rest) > 0 {
+		dev = rest[0]
+	}
+	if dev == "" {
+		log.Fatal("No device given; expected $dev to be set by openvpn.")
+	}
+	if err = bridge.CheckNameTemplate(*nameTemplate); err != nil {
+		log.Fatal(err)
+	}
+	if (*filtering || *ovs) && *singleBridge == "" {
+		log.Fatal("--vlan-filtering and --ovs require --bridge.")
+	}
+	var backend bridge.Backend
+	switch {
+	case *filtering && *ovs:
+		log.Fatal("--vlan-filtering and --ovs are mutually exclusive.")
+	case *filtering:
+		backend = bridge.VlanFiltering{Bridge: *singleBridge, Trunk: *trunk}
+	case *ovs:
+		backend = bridge.OVS{Bridge: *singleBridge, Socket: *ovsdbSocket}
+	default:
+		backend = bridge.PerVlan{Trunk: *trunk, NameTemplate: *nameTemplate}
+	}
+
+	if vni != 0 {
+		vxlanAction(action, dev, vni, *vtep, *vxlanGroup, *vxlanNic, *vxlanPort)
+		return
+	}
+
+	switch action {
+	case "up":
+		if err = backend.Attach(dev, vlans, tagged); err != nil {
+			log.Fatal(err)
+		}
+		if !tagged {
+			log.Printf("Attached %s to vlan %d.", dev, vlans[0])
+		} else {
+			log.Printf("Attached %s to vlans %s, tagged.", dev,
+				validate.FormatVlans(vlans))
+		}
+	case "down":
+		// openvpn normally runs the down hook after dropping privileges
+		// (see the user and group directives), and after closing the
+		// device, which detaches it from a Linux bridge anyway. So, this
+		// usually has nothing to do; see bridge.Detach. Open vSwitch keeps
+		// the port, but we can't reach ovsdb-server without privileges;
+		// hil-vpn-privop detaches the device when it stops the vpn instead.
+		if *ovs && os.Geteuid() != 0 {
+			return
+		}
+		if err = backend.Detach(dev, vlans, tagged); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
+
+// Carry out `action` for the device `dev` on the vxlan network `vni`, per
+// the vxlan flags.
+func vxlanAction(action, dev string, vni uint32, vtep, group, nic string, port uint) {
+	v := bridge.Vxlan{Dev: nic, Port: uint16(port)}
+	if v.Local = net.ParseIP(vtep); v.Local == nil {
+		log.Fatalf("Invalid or missing --vtep %q; vxlan networks require it.", vtep)
+	}
+	if group != "" {
+		if v.Group = net.ParseIP(group); v.Group == nil {
+			log.Fatalf("Invalid --vxlan-group %q.", group)
+		}
+	}
+	if port == 0 || port > 65535 {
+		log.Fatalf("Invalid --vxlan-port %d.", port)
+	}
+	switch action {
+	case "up":
+		if err := v.Attach(dev, vni); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Attached %s to vxlan network %d.", dev, vni)
+	case "down":
+		// As with vlans, there is usually nothing to do; see main.
+		if err := v.Detach(dev, vni); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
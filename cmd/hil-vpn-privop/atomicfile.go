@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// This file implements crash-safe writing of files. The contents are first
+// written to a temporary file in the same directory and flushed to disk,
+// then moved into place, and finally the directory itself is flushed, so
+// that after a crash the file is either absent or complete, never
+// truncated.
+
+// Prefix for temporary files. This must not match any of the patterns we
+// use to recognize vpn files (keyFileRe etc.), so that a temporary file
+// left behind by a crash is never mistaken for a vpn.
+const tempFilePrefix = ".hil-vpn-tmp-"
+
+// Atomically write `data` to the file at `path`, with permissions `perm`.
+// If `replace` is false and the file already exists, an error satisfying
+// os.IsExist is returned and the existing file is left untouched.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, replace bool) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// If we got as far as moving the file into place, this will fail
+		// harmlessly. Otherwise it cleans up after us.
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if replace {
+		err = os.Rename(tmp.Name(), path)
+	} else {
+		// Unlike rename, link fails if the target exists.
+		err = os.Link(tmp.Name(), path)
+	}
+	if err != nil {
+		if linkErr, ok := err.(*os.LinkError); ok {
+			// Report the error against the file the caller asked about,
+			// so os.IsExist etc. behave as expected.
+			err = &os.PathError{Op: linkErr.Op, Path: path, Err: linkErr.Err}
+		}
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Flush the directory `dir` to disk, so that entries which have been
+// added to or removed from it persist across a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
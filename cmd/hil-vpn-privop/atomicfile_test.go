@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test writeFileAtomic's handling of existing files, and that it doesn't
+// leave temporary files behind.
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	if err = writeFileAtomic(path, []byte("first"), 0600, false); err != nil {
+		t.Fatal("Creating file:", err)
+	}
+	err = writeFileAtomic(path, []byte("second"), 0600, false)
+	if !os.IsExist(err) {
+		t.Fatal("Expected an IsExist error when not replacing, but got:", err)
+	}
+	checkFile(t, path, "first", 0600)
+
+	if err = writeFileAtomic(path, []byte("third"), 0640, true); err != nil {
+		t.Fatal("Replacing file:", err)
+	}
+	checkFile(t, path, "third", 0640)
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("Expected only one file in %s, but found %d.", dir, len(fis))
+	}
+}
+
+// Check that the file at `path` has the given contents and permissions.
+func checkFile(t *testing.T, path, contents string, perm os.FileMode) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != contents {
+		t.Fatalf("Unexpected contents of %s: %q (expected %q)", path, data, contents)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != perm {
+		t.Fatalf("Unexpected permissions on %s: %v (expected %v)", path, fi.Mode().Perm(), perm)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
+)
+
+// This file implements the 'batch' subcommand, which performs a list of
+// create, start, stop and delete requests in a single invocation. The
+// locks for all of the vpns involved are acquired up front and held until
+// the end, so no other invocation can observe or interfere with the batch
+// part way through.
+//
+// Each request is carried out by the same function as the corresponding
+// subcommand. While a batch is running, fatal() panics rather than exiting,
+// which lets us record the failure of one request and move on to the next
+// (or roll back, for an atomic batch).
+
+// Implement the 'batch' subcommand. Read a JSON list of requests from
+// `input` and perform them in order, returning the result of each. If
+// `atomic` is true, stop at the first failure and undo the requests
+// already performed; the returned error is then the failure, and
+// rolledBack is true.
+func batchCmd(input io.Reader, atomic bool) (results []privproto.Response, rolledBack bool, err *privproto.Error) {
+	var reqs []privproto.Request
+	if err := json.NewDecoder(input).Decode(&reqs); err != nil {
+		fatal(privproto.ErrInvalidArgument, "Invalid batch: "+err.Error())
+	}
+
+	// Check the requests before doing anything, so that an atomic batch
+	// with a bad request fails without having to roll anything back.
+	checkErrs := make([]*privproto.Error, len(reqs))
+	for i, req := range reqs {
+		checkErrs[i] = checkBatchRequest(req)
+		if checkErrs[i] != nil && atomic {
+			return nil, false, batchError(i, checkErrs[i])
+		}
+	}
+
+	for _, name := range batchVpnNames(reqs) {
+		defer lockVpn(name, unix.LOCK_EX).release()
+	}
+
+	fatalPanics = true
+	defer func() { fatalPanics = false }()
+
+	var undo []func()
+	results = make([]privproto.Response, 0, len(reqs))
+	for i, req := range reqs {
+		resp := privproto.Response{Error: checkErrs[i]}
+		if resp.Error == nil {
+			var undoReq func()
+			resp, undoReq = runBatchRequest(req)
+			if undoReq != nil {
+				undo = append(undo, undoReq)
+			}
+		}
+		results = append(results, resp)
+		if resp.Error != nil && atomic {
+			err = batchError(i, resp.Error)
+			if failed := rollback(undo); failed != 0 {
+				err.Message += fmt.Sprintf("; additionally, %d of the "+
+					"completed requests could not be rolled back", failed)
+			}
+			return results, true, err
+		}
+	}
+	return results, false, nil
+}
+
+// Check that `req` is a valid request for a batch, returning an
+// invalid_argument error if not.
+func checkBatchRequest(req privproto.Request) *privproto.Error {
+	var err error
+	switch req.Op {
+	case privproto.OpCreate:
+		if err = validate.CheckVpnName(req.Name); err != nil {
+			break
+		}
+		if req.Vni != 0 && (req.Vlan != 0 || len(req.Vlans) != 0) {
+			err = fmt.Errorf("A vpn may be on a vxlan network or vlans, not both")
+			break
+		}
+		if req.ServerAddr != nil || req.ClientAddr != nil {
+			if req.Vni != 0 || req.Vlan != 0 || len(req.Vlans) != 0 {
+				err = fmt.Errorf("A routed vpn may not be on a network")
+				break
+			}
+			err = validate.CheckP2PAddrs(req.ServerAddr, req.ClientAddr)
+		} else {
+			_, _, _, err = validate.ParseNetwork(req.Network())
+		}
+		if err != nil {
+			break
+		}
+		if req.Port < 1024 {
+			err = fmt.Errorf("Unacceptable port number: %d; only "+
+				"non-privileged ports (>= 1024) may be used.", req.Port)
+		}
+	case privproto.OpStart, privproto.OpStop, privproto.OpDelete:
+		err = validate.CheckVpnName(req.Name)
+	default:
+		err = fmt.Errorf("Operation %q may not be used in a batch", req.Op)
+	}
+	if err != nil {
+		return &privproto.Error{Code: privproto.ErrInvalidArgument, Message: err.Error()}
+	}
+	return nil
+}
+
+// Return the names of the vpns involved in `reqs`, without duplicates and
+// in sorted order, which is the order we lock them in.
+func batchVpnNames(reqs []privproto.Request) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, req := range reqs {
+		if validate.CheckVpnName(req.Name) == nil && !seen[req.Name] {
+			seen[req.Name] = true
+			names = append(names, req.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Wrap the error which caused request `i` of a batch to fail.
+func batchError(i int, err *privproto.Error) *privproto.Error {
+	return &privproto.Error{
+		Code:    err.Code,
+		Message: fmt.Sprintf("request %d of batch: %s", i, err.Message),
+	}
+}
+
+// Perform a single request in a batch. If it succeeds, also return a
+// function which undoes it.
+func runBatchRequest(req privproto.Request) (resp privproto.Response, undo func()) {
+	defer func() {
+		if e := recover(); e != nil {
+			err, ok := e.(*privproto.Error)
+			if !ok {
+				panic(e)
+			}
+			resp, undo = privproto.Response{Error: err}, nil
+		}
+	}()
+	switch req.Op {
+	case privproto.OpCreate:
+		if req.ServerAddr != nil {
+			resp.Key = createRoutedCmd(req.Name, req.ServerAddr, req.ClientAddr, req.Port)
+		} else {
+			resp.Key = createCmd(req.Name, req.VlanSet(), req.Tagged(), req.Vni, req.Port)
+		}
+		return resp, func() { deleteCmd(req.Name) }
+	case privproto.OpStart:
+		startCmd(req.Name)
+		return resp, func() { stopCmd(req.Name) }
+	case privproto.OpStop:
+		stopCmd(req.Name)
+		return resp, func() { startCmd(req.Name) }
+	case privproto.OpDelete:
+		// Deleting throws away the vpn's files, so hang on to them in
+		// case we need to put them back.
+		saved := saveVpnFiles(req.Name)
+		deleteCmd(req.Name)
+		return resp, func() { restoreVpnFiles(req.Name, saved) }
+	}
+	panic("BUG: unchecked request in batch: " + req.Op)
+}
+
+// Run the functions in `undo` in reverse order, returning the number which
+// failed.
+func rollback(undo []func()) (failed int) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if !runUndo(undo[i]) {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Run a single function from rollback(), reporting whether it succeeded.
+// Failures will already have been reported on stderr by fatal().
+func runUndo(f func()) (ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if _, isErr := e.(*privproto.Error); !isErr {
+				panic(e)
+			}
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+// Return the paths of the named vpn's files. The key comes last, since
+// its presence is what marks the vpn as existing (see OpenVpnCfg.Save).
+func vpnFilePaths(vpnName string) []string {
+	return []string{
+		getCfgPath(vpnName),
+		getMetaPath(vpnName),
+		getEnabledPath(vpnName),
+		getKeyPath(vpnName),
+	}
+}
+
+// Read the files of the named vpn into memory, by path. Files which don't
+// exist (e.g. metadata, for vpns which predate it) are skipped.
+func saveVpnFiles(vpnName string) map[string][]byte {
+	saved := map[string][]byte{}
+	for _, path := range vpnFilePaths(vpnName) {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		chkfatal("Reading "+path, err)
+		saved[path] = data
+	}
+	return saved
+}
+
+// Write back the files of the named vpn, as saved by saveVpnFiles.
+func restoreVpnFiles(vpnName string, saved map[string][]byte) {
+	defer lockConfigDir(unix.LOCK_EX).release()
+	for _, path := range vpnFilePaths(vpnName) {
+		data, ok := saved[path]
+		if !ok {
+			continue
+		}
+		chkfatal("Restoring "+path, writeFileAtomic(path, data, 0600, false))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Test that only well-formed create, start, stop and delete requests are
+// accepted in a batch.
+func TestCheckBatchRequest(t *testing.T) {
+	cases := []struct {
+		req privproto.Request
+		ok  bool
+	}{
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 100, Port: 5000}, true},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 0, Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 100, Port: 80}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "../etc", Vlan: 100, Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vni: 5000, Port: 5000}, true},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vni: 1 << 24, Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 100, Vni: 5000, Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a",
+			ServerAddr: net.ParseIP("10.0.0.1"), ClientAddr: net.ParseIP("10.0.0.2"), Port: 5000}, true},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a",
+			ServerAddr: net.ParseIP("10.0.0.1"), ClientAddr: net.ParseIP("10.0.0.5"), Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a",
+			ServerAddr: net.ParseIP("10.0.0.1"), Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 100,
+			ServerAddr: net.ParseIP("10.0.0.1"), ClientAddr: net.ParseIP("10.0.0.2"), Port: 5000}, false},
+		{privproto.Request{Op: privproto.OpStart, Name: "vpn-a"}, true},
+		{privproto.Request{Op: privproto.OpStop, Name: ""}, false},
+		{privproto.Request{Op: privproto.OpDelete, Name: "vpn-a"}, true},
+		{privproto.Request{Op: privproto.OpList}, false},
+		{privproto.Request{Op: privproto.OpBatch}, false},
+	}
+	for _, c := range cases {
+		err := checkBatchRequest(c.req)
+		if c.ok && err != nil {
+			t.Errorf("Rejected valid request %v: %v", c.req, err)
+		} else if !c.ok && (err == nil || err.Code != privproto.ErrInvalidArgument) {
+			t.Errorf("Expected an %s error for %v, but got %v",
+				privproto.ErrInvalidArgument, c.req, err)
+		}
+	}
+}
+
+// Test that the vpns in a batch are locked once each, in sorted order.
+func TestBatchVpnNames(t *testing.T) {
+	names := batchVpnNames([]privproto.Request{
+		{Op: privproto.OpCreate, Name: "vpn-b"},
+		{Op: privproto.OpStart, Name: "vpn-b"},
+		{Op: privproto.OpDelete, Name: "vpn-a"},
+		{Op: privproto.OpStop, Name: "../bad"},
+	})
+	if !reflect.DeepEqual(names, []string{"vpn-a", "vpn-b"}) {
+		t.Fatalf("Unexpected vpn names: %v", names)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// This file implements on-demand management of the vlans' bridges, via the
+// bridge.Backend for the bridge_mode in the config file (see
+// privopConfig.backend). If the config file names a trunk nic, we create the
+// bridge for a vlan (and the subinterface of the trunk nic which connects it
+// to the network) when a vpn on that vlan is started, and remove them when
+// the last vpn on the vlan is deleted. Otherwise, the admin is expected to
+// have created the bridges ahead of time, e.g. with create-bridges.sh, and we
+// leave them alone.
+//
+// In BridgeVlanFiltering mode, there is only one bridge, which we create if
+// need be but never remove; instead, we add and remove the vlans carried by
+// the trunk nic's port on it. In BridgeOVS mode, the Open vSwitch bridge is
+// always set up ahead of time, and we just check that it exists.
+//
+// Vpns on vxlan networks work like per-vlan bridges with a trunk nic: we
+// create each network's bridge, and the vxlan device connecting it to the
+// network, on demand, and remove them once no vpn uses the network; see
+// bridge.Vxlan.
+//
+// The hook also creates the bridge if it is missing (the config passes it
+// the trunk nic; see openVpnCfgTpl), since openvpn may be started without
+// us, e.g. by systemd at boot.
+
+// Acquire the lock for vlan number `vlan`, which guards its bridge. This is
+// acquired after the lock for any vpn, and before the lock on the openvpn
+// config directory. Exits with an error if the lock cannot be acquired.
+func lockVlan(vlan uint16) *fileLock {
+	lock, err := acquireLock("vlan-"+strconv.Itoa(int(vlan))+".lock", unix.LOCK_EX)
+	chkfatal(fmt.Sprintf("Locking vlan %d", vlan), err)
+	return lock
+}
+
+// Acquire the lock for the vxlan network `vni`, which guards its bridge, as
+// lockVlan does for vlans.
+func lockVni(vni uint32) *fileLock {
+	lock, err := acquireLock("vni-"+strconv.FormatUint(uint64(vni), 10)+".lock", unix.LOCK_EX)
+	chkfatal(fmt.Sprintf("Locking vxlan network %d", vni), err)
+	return lock
+}
+
+// Check that this host can carry vlan number `vlan`, i.e. that its bridge
+// exists, or that we can create it; see bridge.Backend.CheckVlan. This is
+// checked when a vpn is created, so that a vpn on a vlan which isn't
+// available here fails up front, rather than when it is started.
+func checkVlanBridge(vlan uint16) {
+	cfg, err := loadConfig()
+	chkfatal("Loading config", err)
+	if err = cfg.backend().CheckVlan(vlan); err != nil {
+		fatal(privproto.ErrInvalidArgument,
+			fmt.Sprintf("vlan %d is not available on this host: %v", vlan, err))
+	}
+}
+
+// Prepare the bridge for vlan number `vlan`, e.g. by creating it if we
+// manage bridges and it doesn't already exist.
+func ensureBridge(vlan uint16) {
+	cfg, err := loadConfig()
+	chkfatal("Loading config", err)
+	defer lockVlan(vlan).release()
+	chkfatal(fmt.Sprintf("Preparing bridge for vlan %d", vlan),
+		cfg.backend().Ensure(vlan))
+}
+
+// Release the bridge for vlan number `vlan`, e.g. by removing it if we
+// manage bridges and no vpn uses it any more. The caller must not hold the
+// lock on the openvpn config directory.
+//
+// This is called once a vpn has been deleted, so failing would be
+// misleading; problems are reported on stderr instead.
+func releaseBridge(vlan uint16) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return
+	}
+	defer lockVlan(vlan).release()
+	for _, name := range listVpns() {
+		vpnCfg, err := LoadOpenVpnConfig(name)
+		if err != nil || vpnCfg.HasVlan(vlan) {
+			// If we can't tell, err on the side of keeping the bridge.
+			return
+		}
+	}
+	if err = cfg.backend().Release(vlan); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: releasing bridge for vlan %d: %v\n",
+			vlan, err)
+	}
+}
+
+// Check that this host can carry the vxlan network `vni`, as checkVlanBridge
+// does for vlans.
+func checkVxlanBridge(vni uint32) {
+	cfg, err := loadConfig()
+	chkfatal("Loading config", err)
+	if err = cfg.vxlan().Check(); err != nil {
+		fatal(privproto.ErrInvalidArgument,
+			fmt.Sprintf("vxlan network %d is not available on this host: %v", vni, err))
+	}
+}
+
+// Prepare the bridge for the vxlan network `vni`, creating it if need be.
+func ensureVxlanBridge(vni uint32) {
+	cfg, err := loadConfig()
+	chkfatal("Loading config", err)
+	defer lockVni(vni).release()
+	chkfatal(fmt.Sprintf("Preparing bridge for vxlan network %d", vni),
+		cfg.vxlan().Ensure(vni))
+}
+
+// Remove the bridge for the vxlan network `vni` if no vpn uses it any more,
+// as releaseBridge does for vlans.
+func releaseVxlanBridge(vni uint32) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return
+	}
+	defer lockVni(vni).release()
+	for _, name := range listVpns() {
+		vpnCfg, err := LoadOpenVpnConfig(name)
+		if err != nil || vpnCfg.Vni == vni {
+			return
+		}
+	}
+	if err = cfg.vxlan().Release(vni); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: releasing bridge for vxlan network %d: %v\n",
+			vni, err)
+	}
+}
+
+// Detach the vpn described by `vpnCfg` from its network, once its openvpn
+// instance has stopped. The hook normally does this, but it runs without
+// privileges by then, which is not enough for some backends (see
+// bridge.OVS). As with releaseBridge, problems are reported on stderr.
+func detachVpn(vpnCfg *OpenVpnCfg) {
+	cfg, err := loadConfig()
+	if err != nil || vpnCfg.Routed() {
+		return
+	}
+	dev := "tap" + vpnCfg.InterfaceName
+	if vpnCfg.Vni != 0 {
+		err = cfg.vxlan().Detach(dev, vpnCfg.Vni)
+	} else {
+		err = cfg.backend().Detach(dev, vpnCfg.AllVlans(), vpnCfg.Tagged())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: detaching %s from %s: %v\n",
+			dev, vpnCfg.Network(), err)
+	}
+}
@@ -1,13 +1,105 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
 )
 
+// Whether to write results as JSON (see the privproto package), rather than
+// in the plain text format. Set by the --json flag.
+var jsonOutput bool
+
+// Set while running the requests in a batch, or in catchFatal; see fatal().
+var fatalPanics bool
+
 func chkfatal(ctx string, err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", ctx, err)
-		os.Exit(1)
+		fatal(errorCode(err), fmt.Sprintf("%s: %v", ctx, err))
+	}
+}
+
+// Report an error with the given code (one of the privproto.Err*
+// constants) and message, then exit with a failing status. While running a
+// batch, or in catchFatal, panic with a *privproto.Error instead.
+func fatal(code, msg string) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+	if fatalPanics {
+		// Let the batch record the failure; see runBatchRequest.
+		panic(&privproto.Error{Code: code, Message: msg})
+	}
+	if jsonOutput {
+		// There's not much we can do if this fails, so we ignore the
+		// error.
+		json.NewEncoder(os.Stdout).Encode(privproto.Response{
+			Error: &privproto.Error{Code: code, Message: msg},
+		})
+	}
+	os.Exit(1)
+}
+
+// Run `f`, returning the error it fails with, if any, rather than exiting.
+// This is for commands which carry on with the rest of their work when one
+// part of it fails.
+func catchFatal(f func()) (err *privproto.Error) {
+	old := fatalPanics
+	fatalPanics = true
+	defer func() {
+		fatalPanics = old
+		if e := recover(); e != nil {
+			var ok bool
+			if err, ok = e.(*privproto.Error); !ok {
+				panic(e)
+			}
+		}
+	}()
+	f()
+	return nil
+}
+
+// Choose an error code for `err`.
+func errorCode(err error) string {
+	switch e := err.(type) {
+	case *privproto.Error:
+		return e.Code
+	case *os.PathError:
+		// Errors from failed file operations on a vpn's config or key
+		// generally mean the vpn does or does not exist. Any other file
+		// going missing (the lock directory, say) is our problem, not
+		// the caller's.
+		if !isVpnFile(e.Path) {
+			break
+		}
+		if os.IsExist(e) {
+			return privproto.ErrAlreadyExists
+		} else if os.IsNotExist(e) {
+			return privproto.ErrNotFound
+		}
+	}
+	return privproto.ErrInternal
+}
+
+// Report whether `path` is the config or key file of a vpn (see getCfgPath
+// and getKeyPath).
+func isVpnFile(path string) bool {
+	dir, base := filepath.Split(path)
+	if filepath.Clean(dir) != filepath.Clean(configDir) {
+		return false
+	}
+	return strings.HasSuffix(base, ".conf") || keyFileRe.MatchString(base)
+}
+
+// Write the result of a successful command to stdout; as JSON if
+// requested, otherwise by calling `text`, which may be nil if the command
+// has no output.
+func emit(resp privproto.Response, text func()) {
+	if jsonOutput {
+		chkfatal("Writing output", json.NewEncoder(os.Stdout).Encode(resp))
+	} else if text != nil {
+		text()
 	}
 }
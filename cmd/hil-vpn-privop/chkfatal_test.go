@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Only a vpn's own files going missing (or already existing) means the vpn
+// doesn't (or does) exist; anything else is an internal error.
+func TestErrorCode(t *testing.T) {
+	cases := []struct {
+		path string
+		err  error
+		code string
+	}{
+		{getCfgPath("foo"), os.ErrNotExist, privproto.ErrNotFound},
+		{getKeyPath("foo"), os.ErrNotExist, privproto.ErrNotFound},
+		{getKeyPath("foo"), os.ErrExist, privproto.ErrAlreadyExists},
+		{getCfgPath("foo"), os.ErrPermission, privproto.ErrInternal},
+		{templatePath, os.ErrNotExist, privproto.ErrInternal},
+		{lockDir + "/vpn-foo.lock", os.ErrNotExist, privproto.ErrInternal},
+		{lockDir + "/vpn-foo.lock", os.ErrExist, privproto.ErrInternal},
+	}
+	for _, c := range cases {
+		err := &os.PathError{Op: "open", Path: c.path, Err: c.err}
+		if code := errorCode(err); code != c.code {
+			t.Errorf("errorCode(%v) = %s, but expected %s", err, code, c.code)
+		}
+	}
+}
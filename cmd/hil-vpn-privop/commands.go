@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"regexp"
+	"strings"
+	"text/template"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
 )
 
 // The actual functionality of each of the commands; the function
@@ -14,56 +24,299 @@ import (
 
 var keyFileRe = regexp.MustCompile("^hil-vpn-([-_a-zA-Z0-9]+).key$")
 
-// Implement the 'create' subcommand.
-func createCmd(vpnName string, vlanNo, portNo uint16) string {
-	cfg, err := NewOpenVpnConfig(vpnName, vlanNo, portNo)
+// Implement the 'create' subcommand. The vpn carries the vlans in `vlans`,
+// tagged if `tagged` is set, or, if `vni` is non-zero, is on that vxlan
+// network.
+func createCmd(vpnName string, vlans []uint16, tagged bool, vni uint32, portNo uint16) string {
+	defer lockVpn(vpnName, unix.LOCK_EX).release()
+	tpl, err := loadTemplate()
+	chkfatal("Loading openvpn config template", err)
+	if vni != 0 {
+		checkVxlanBridge(vni)
+	}
+	for _, vlan := range vlans {
+		checkVlanBridge(vlan)
+	}
+	cfg, err := NewOpenVpnConfig(vpnName, portNo)
 	chkfatal("Generating openvpn config:", err)
-	chkfatal("Saving openvpn config:", cfg.Save())
+	cfg.setNetwork(vlans, tagged, vni)
+	settings, err := loadConfig()
+	chkfatal("Loading config", err)
+	defer lockConfigDir(unix.LOCK_EX).release()
+	chkfatal("Saving openvpn config:", cfg.Save(tpl, settings))
+	return cfg.Key
+}
+
+// Implement the 'create' subcommand for a routed vpn, whose point-to-point
+// link has the addresses `server` and `client`. Unlike a bridged vpn, it
+// needs no bridges; routing its traffic beyond the link is up to the host.
+func createRoutedCmd(vpnName string, server, client net.IP, portNo uint16) string {
+	defer lockVpn(vpnName, unix.LOCK_EX).release()
+	tpl, err := loadTemplate()
+	chkfatal("Loading openvpn config template", err)
+	cfg, err := NewOpenVpnConfig(vpnName, portNo)
+	chkfatal("Generating openvpn config:", err)
+	cfg.setRouted(server, client)
+	settings, err := loadConfig()
+	chkfatal("Loading config", err)
+	defer lockConfigDir(unix.LOCK_EX).release()
+	chkfatal("Saving openvpn config:", cfg.Save(tpl, settings))
 	return cfg.Key
 }
 
 // Implement the 'start' subcommand.
 func startCmd(vpnName string) {
-	err := exec.Command("systemctl", "enable", "--now", getServiceName(vpnName)).Run()
+	defer lockVpn(vpnName, unix.LOCK_EX).release()
+	requireVpn(vpnName)
+	cfg, err := LoadOpenVpnConfig(vpnName)
+	chkfatal("Loading config for vpn "+vpnName, err)
+	if cfg.Vni != 0 {
+		ensureVxlanBridge(cfg.Vni)
+	}
+	for _, vlan := range cfg.AllVlans() {
+		ensureBridge(vlan)
+	}
+	services, err := connectServices()
 	chkfatal("Starting & enabling vpn", err)
+	defer services.Close()
+	chkfatal("Starting & enabling vpn", services.start(vpnName))
 }
 
 // Implement the 'stop' subcommand.
 func stopCmd(vpnName string) {
-	err := exec.Command("systemctl", "disable", "--now", getServiceName(vpnName)).Run()
+	defer lockVpn(vpnName, unix.LOCK_EX).release()
+	requireVpn(vpnName)
+	services, err := connectServices()
 	chkfatal("Stopping & disabling vpn", err)
+	defer services.Close()
+	chkfatal("Stopping & disabling vpn", services.stop(vpnName))
+	if cfg, err := LoadOpenVpnConfig(vpnName); err == nil {
+		detachVpn(cfg)
+	}
 }
 
 // Implement the 'delete' subcommand.
 func deleteCmd(vpnName string) {
-	err := exec.Command("systemctl", "status", getServiceName(vpnName)).Run()
-	if err == nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Error: cannot delete vpn: %v; it is still running.",
-			vpnName,
-		)
-		os.Exit(1)
-	}
-	if _, ok := err.(*exec.ExitError); !ok {
-		chkfatal("Checking vpn status:", err)
+	defer lockVpn(vpnName, unix.LOCK_EX).release()
+	requireVpn(vpnName)
+	services, err := connectServices()
+	chkfatal("Checking vpn status", err)
+	running, state, err := services.running(vpnName)
+	services.Close()
+	chkfatal("Checking vpn status", err)
+	if running {
+		fatal(privproto.ErrStillRunning,
+			fmt.Sprintf("cannot delete vpn: %v; it is still running (%s).",
+				vpnName, state))
 	}
 
-	// A failing exit status indicates that the service was not running; go
-	// ahead and delete the config & key:
+	// The service is not running; go ahead and delete the vpn's files,
+	// noting its network first, so we can clean up its bridges afterwards.
+	// We don't let a damaged config stop us from deleting the vpn, though.
+	cfg, cfgErr := LoadOpenVpnConfig(vpnName)
+	deleteVpnFiles(vpnName)
+	if cfgErr == nil {
+		for _, vlan := range cfg.AllVlans() {
+			releaseBridge(vlan)
+		}
+		if cfg.Vni != 0 {
+			releaseVxlanBridge(cfg.Vni)
+		}
+	}
+}
 
+// Helper for deleteCmd, which deletes the named vpn's files.
+func deleteVpnFiles(vpnName string) {
+	// The key goes first, since its presence is what marks the vpn as
+	// existing (see OpenVpnCfg.Save):
+	defer lockConfigDir(unix.LOCK_EX).release()
 	chkfatal("Deleting vpn key file", os.Remove(getKeyPath(vpnName)))
+	chkfatal("Syncing openvpn config directory", syncDir(configDir))
 	chkfatal("Deleting vpn config file", os.Remove(getCfgPath(vpnName)))
+	err := os.Remove(getMetaPath(vpnName))
+	if !os.IsNotExist(err) {
+		// vpns created by older versions of hil-vpn-privop don't have
+		// metadata, so it's fine if it's missing.
+		chkfatal("Deleting vpn metadata file", err)
+	}
+	// A vpn which failed to start may still be enabled; see
+	// supervisorServices.start.
+	err = os.Remove(getEnabledPath(vpnName))
+	if !os.IsNotExist(err) {
+		chkfatal("Disabling vpn", err)
+	}
+	chkfatal("Syncing openvpn config directory", syncDir(configDir))
 }
 
 // Implement the 'list' subcommand.
-func listCmd() {
-	f, err := os.Open(configDir)
-	chkfatal("Opening openvpn config directory", err)
-	defer f.Close()
-	fis, err := f.Readdir(0)
-	chkfatal("Scanning openvpn config directory", err)
-	for _, fi := range fis {
+func listCmd() []string {
+	return listVpns()
+}
+
+// Implement the 'regen' subcommand. Re-render the configs for the named
+// vpns with the current template, keeping their keys and interface names.
+// If dryRun is true, return a diff of the changes instead of making them;
+// otherwise return the names of the vpns whose configs changed.
+//
+// A vpn which can't be regenerated doesn't stop us from going on to the
+// rest; if any fail, the returned error describes all of the failures.
+func regenCmd(vpnNames []string, dryRun bool) ([]string, string, *privproto.Error) {
+	tpl, err := loadTemplate()
+	chkfatal("Loading openvpn config template", err)
+	settings, err := loadConfig()
+	chkfatal("Loading config", err)
+	lockMode := unix.LOCK_EX
+	if dryRun {
+		lockMode = unix.LOCK_SH
+	}
+	changed := []string{}
+	diffs := &bytes.Buffer{}
+	var failures []*privproto.Error
+	for _, name := range vpnNames {
+		var vpnDiff []byte
+		var vpnChanged bool
+		vpnErr := catchFatal(func() {
+			vpnDiff, vpnChanged = regenVpn(name, tpl, settings, dryRun, lockMode)
+		})
+		if vpnErr != nil {
+			failures = append(failures, vpnErr)
+			continue
+		}
+		diffs.Write(vpnDiff)
+		if vpnChanged {
+			changed = append(changed, name)
+		}
+	}
+	return changed, diffs.String(), vpnsError("regenerate", failures, len(vpnNames))
+}
+
+// Implement the 'boot' subcommand, which is run when the host boots. Start
+// the vpns which were enabled (see enabledVpns), returning their names.
+// This is only needed with the supervisor service manager; systemd starts
+// enabled vpns itself.
+//
+// Like regen, a vpn which fails to start doesn't stop us from starting the
+// rest.
+func bootCmd() ([]string, *privproto.Error) {
+	names := enabledVpns()
+	started := []string{}
+	var failures []*privproto.Error
+	for _, name := range names {
+		if err := catchFatal(func() { startCmd(name) }); err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		started = append(started, name)
+	}
+	err := vpnsError("start", failures, len(names))
+	if err != nil && len(names) > 1 {
+		// Each failure has been reported by fatal(); sum them up too.
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Message)
+	}
+	return started, err
+}
+
+// Helper for regenCmd and bootCmd, which combines the failures of `total`
+// vpns into a single error, or returns nil if there are none. `action`
+// says what we failed to do to them.
+func vpnsError(action string, failures []*privproto.Error, total int) *privproto.Error {
+	switch len(failures) {
+	case 0:
+		return nil
+	case 1:
+		if total == 1 {
+			return failures[0]
+		}
+	}
+	msgs := make([]string, len(failures))
+	for i, f := range failures {
+		msgs[i] = f.Message
+	}
+	return &privproto.Error{
+		Code: privproto.ErrInternal,
+		Message: fmt.Sprintf("failed to %s %d of %d vpns: %s",
+			action, len(failures), total, strings.Join(msgs, "; ")),
+	}
+}
+
+// Helper for regenCmd, which handles a single vpn.
+func regenVpn(name string, tpl *template.Template, settings *privopConfig, dryRun bool, lockMode int) (diff []byte, changed bool) {
+	defer lockVpn(name, lockMode).release()
+	requireVpn(name)
+	cfg, err := LoadOpenVpnConfig(name)
+	chkfatal("Loading config for vpn "+name, err)
+	buf := &bytes.Buffer{}
+	chkfatal("Rendering config for vpn "+name, cfg.Render(buf, tpl, settings))
+	if dryRun {
+		diff, err = diffFile(getCfgPath(name), buf.Bytes())
+		chkfatal("Comparing config for vpn "+name, err)
+		return diff, len(diff) != 0
+	}
+	old, err := ioutil.ReadFile(getCfgPath(name))
+	chkfatal("Reading config for vpn "+name, err)
+	changed = !bytes.Equal(old, buf.Bytes())
+	if changed {
+		// Note that openvpn only reads its config at startup, so running
+		// vpns won't see the change until they are restarted.
+		chkfatal("Saving config for vpn "+name,
+			writeFileAtomic(getCfgPath(name), buf.Bytes(), 0600, true))
+	}
+	if _, err := os.Stat(getMetaPath(name)); changed || os.IsNotExist(err) {
+		// Record the new config's hash, or store metadata for the
+		// first time if this vpn predates it.
+		meta, err := cfg.metadata(buf.Bytes()).encode()
+		chkfatal("Encoding metadata for vpn "+name, err)
+		chkfatal("Saving metadata for vpn "+name,
+			writeFileAtomic(getMetaPath(name), meta, 0600, true))
+	}
+	return nil, changed
+}
+
+// Implement the 'verify' subcommand. Check the files of every vpn against
+// the hashes recorded when they were written, and report any problems.
+func verifyCmd() []privproto.Problem {
+	return verifyVpns()
+}
+
+// Implement the 'version' subcommand.
+func versionCmd() privproto.Version {
+	return privproto.Version{
+		Protocol:    privproto.ProtocolVersion,
+		Features:    privproto.Features,
+		NamePattern: validate.VpnNamePattern,
+	}
+}
+
+// Return a unified diff between the file at `path` and `newContents`.
+func diffFile(path string, newContents []byte) ([]byte, error) {
+	cmd := exec.Command("diff", "-u", "--label", path, "--label", path+" (regenerated)",
+		path, "-")
+	cmd.Stdin = bytes.NewReader(newContents)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// Exit status 1 just means the files differ.
+		return out, nil
+	}
+	return out, err
+}
+
+// Exit with a not_found error if the named vpn does not exist.
+func requireVpn(vpnName string) {
+	_, err := os.Stat(getKeyPath(vpnName))
+	if os.IsNotExist(err) {
+		fatal(privproto.ErrNotFound, fmt.Sprintf("no such vpn: %v", vpnName))
+	}
+	chkfatal("Checking for vpn "+vpnName, err)
+}
+
+// Return the names of all of the vpns in the openvpn config directory.
+//
+// A vpn exists if and only if its key file does; the key is written last
+// when creating a vpn and removed first when deleting it.
+func listVpns() []string {
+	names := []string{}
+	for _, fi := range scanConfigDir() {
 		matches := keyFileRe.FindStringSubmatch(fi.Name())
 		if matches == nil {
 			continue
@@ -71,6 +324,20 @@ func listCmd() {
 			panic("BUG: keyFileRe should always return a slice " +
 				"of length 2: the full match and the submatch.")
 		}
-		fmt.Println(matches[1])
+		names = append(names, matches[1])
 	}
+	return names
+}
+
+// Return the entries in the openvpn config directory. The directory lock
+// is held while scanning, so the result reflects no partially completed
+// creates or deletes.
+func scanConfigDir() []os.FileInfo {
+	defer lockConfigDir(unix.LOCK_SH).release()
+	f, err := os.Open(configDir)
+	chkfatal("Opening openvpn config directory", err)
+	defer f.Close()
+	fis, err := f.Readdir(0)
+	chkfatal("Scanning openvpn config directory", err)
+	return fis
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Point configDir and lockDir at a fresh temporary directory for the
+// duration of the test.
+func setupConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfigDir, oldLockDir := configDir, lockDir
+	configDir, lockDir = dir, dir+"/locks"
+	t.Cleanup(func() {
+		configDir, lockDir = oldConfigDir, oldLockDir
+		os.RemoveAll(dir)
+	})
+}
+
+// A vpn which can't be regenerated shouldn't stop the others from being
+// regenerated, and each failure should be reported.
+func TestRegenCarriesOn(t *testing.T) {
+	setupRender(t)
+	setupConfigDir(t)
+
+	names := []string{"broken-a", "good", "broken-b"}
+	good := goldenCfg
+	good.Name = "good"
+	good.Key = "key"
+	if err := good.Save(openVpnCfgTpl, &defaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	// Make the good vpn's config stale, so regen has something to do:
+	if err := ioutil.WriteFile(getCfgPath("good"), []byte("stale\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"broken-a", "broken-b"} {
+		// A config we can't recover the vpn's parameters from:
+		if err := ioutil.WriteFile(getCfgPath(name), []byte("garbage\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(getKeyPath(name), []byte("key"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changed, _, err := regenCmd(names, false)
+	if err == nil {
+		t.Fatal("Regenerating broken vpns succeeded.")
+	}
+	if !strings.Contains(err.Message, "broken-a") || !strings.Contains(err.Message, "broken-b") {
+		t.Fatalf("Error does not mention both broken vpns: %s", err.Message)
+	}
+	if len(changed) != 1 || changed[0] != "good" {
+		t.Fatalf("Expected only good to change, but got %v", changed)
+	}
+	data, readErr := ioutil.ReadFile(getCfgPath("good"))
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if string(data) == "stale\n" {
+		t.Fatal("The good vpn's config was not regenerated.")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/CCI-MOC/hil-vpn/internal/bridge"
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// This file implements loading of hil-vpn-privop's config file. Since the
+// settings it holds determine what we run as root, we only read it from a
+// fixed path, and it must be owned by root (see readTrustedFile); we never
+// take settings from the environment or the command line.
+
+// Path at which an admin may install a config file. If it does not exist,
+// the defaults in defaultConfig are used.
+var configPath = staticconfig.Sysconfdir + "/hil-vpn/privop.json"
+
+// Ways of attaching vpns to their vlans; see privopConfig.BridgeMode.
+const (
+	// A bridge for each vlan, named per privopConfig.BridgeName.
+	BridgePerVlan = "per-vlan"
+	// A single vlan-filtering bridge, named by privopConfig.VlanBridge.
+	BridgeVlanFiltering = "vlan-filtering"
+	// A single Open vSwitch bridge, named by privopConfig.VlanBridge.
+	BridgeOVS = "ovs"
+)
+
+var (
+	trunkNicRe = regexp.MustCompile(`^[-_a-zA-Z0-9]{1,10}$`)
+	bridgeRe   = regexp.MustCompile(`^[-_a-zA-Z0-9]{1,15}$`)
+	socketRe   = regexp.MustCompile(`^/[-_./a-zA-Z0-9]+$`)
+)
+
+// Settings for hil-vpn-privop.
+type privopConfig struct {
+	// How to run the vpns' openvpn instances; one of the names in
+	// serviceManagers.
+	ServiceManager string `json:"service_manager"`
+
+	// The nic over which the vlans are trunked to this host. If set, we
+	// create each vlan's bridge when it is first needed; see bridges.go.
+	// If empty, the bridges must be created ahead of time.
+	TrunkNic string `json:"trunk_nic,omitempty"`
+
+	// How vpns are attached to their vlans; one of BridgePerVlan,
+	// BridgeVlanFiltering or BridgeOVS. The latter two avoid creating a
+	// bridge for every vlan, which matters with large vlan ranges.
+	BridgeMode string `json:"bridge_mode"`
+
+	// The template for the names of the vlans' bridges in BridgePerVlan
+	// mode, in which "{vlan}" stands for the vlan number; see
+	// bridge.NameFrom. This must match whatever creates the bridges, e.g.
+	// HIL's switch driver.
+	BridgeName string `json:"bridge_name"`
+
+	// The bridge used in BridgeVlanFiltering and BridgeOVS modes.
+	VlanBridge string `json:"vlan_bridge"`
+
+	// The path to ovsdb-server's socket, used in BridgeOVS mode.
+	OvsdbSocket string `json:"ovsdb_socket"`
+
+	// This host's vxlan tunnel endpoint (VTEP) address, for vpns on vxlan
+	// networks rather than vlans; see bridge.Vxlan. If empty, such vpns
+	// can't be created. The networks' bridges are always created on demand.
+	VxlanLocal string `json:"vxlan_local,omitempty"`
+
+	// The multicast group to which the vxlan networks' broadcast traffic is
+	// sent, and the nic to send it on. If vxlan_group is empty, something
+	// else must fill in the vxlan devices' forwarding databases.
+	VxlanGroup string `json:"vxlan_group,omitempty"`
+	VxlanNic   string `json:"vxlan_nic,omitempty"`
+
+	// The UDP port for vxlan traffic.
+	VxlanPort uint16 `json:"vxlan_port"`
+}
+
+// The settings used for anything not specified in the config file.
+var defaultConfig = privopConfig{
+	ServiceManager: "systemd",
+	BridgeMode:     BridgePerVlan,
+	BridgeName:     bridge.DefaultNameTemplate,
+	VlanBridge:     "br-hil",
+	OvsdbSocket:    ovsdb.DefaultSocket,
+	VxlanPort:      bridge.DefaultVxlanPort,
+}
+
+// Load the config file, filling in defaults for missing settings.
+func loadConfig() (*privopConfig, error) {
+	cfg := defaultConfig
+	data, err := readTrustedFile(configPath)
+	if os.IsNotExist(err) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// A misspelled setting would otherwise be silently ignored:
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("Parsing %s: %v", configPath, err)
+	}
+	if err = cfg.check(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %v", configPath, err)
+	}
+	return &cfg, nil
+}
+
+// Verify that the settings in `cfg` are valid.
+func (cfg *privopConfig) check() error {
+	if _, ok := serviceManagers[cfg.ServiceManager]; !ok {
+		return fmt.Errorf("unknown service_manager %q", cfg.ServiceManager)
+	}
+	// The names of devices end up in openvpn configs (see openVpnCfgTpl),
+	// so we are stricter than the kernel about what it may contain. The
+	// length limit leaves room for the vlan number in its subinterfaces'
+	// names; see bridge.VlanNicName.
+	if cfg.TrunkNic != "" && !trunkNicRe.MatchString(cfg.TrunkNic) {
+		return fmt.Errorf("invalid trunk_nic %q; it must be at most 10 "+
+			"characters, which may only be letters, digits, dashes and "+
+			"underscores", cfg.TrunkNic)
+	}
+	switch cfg.BridgeMode {
+	case BridgePerVlan, BridgeVlanFiltering:
+	case BridgeOVS:
+		// We don't manage Open vSwitch's uplinks; see bridge.OVS.
+		if cfg.TrunkNic != "" {
+			return fmt.Errorf("trunk_nic is not supported with bridge_mode %q",
+				BridgeOVS)
+		}
+	default:
+		return fmt.Errorf("bridge_mode must be %q, %q or %q, not %q",
+			BridgePerVlan, BridgeVlanFiltering, BridgeOVS, cfg.BridgeMode)
+	}
+	if err := bridge.CheckNameTemplate(cfg.BridgeName); err != nil {
+		return fmt.Errorf("bridge_name: %v", err)
+	}
+	if !bridgeRe.MatchString(cfg.VlanBridge) {
+		return fmt.Errorf("invalid vlan_bridge %q; it must be at most 15 "+
+			"characters, which may only be letters, digits, dashes and "+
+			"underscores", cfg.VlanBridge)
+	}
+	if !socketRe.MatchString(cfg.OvsdbSocket) {
+		return fmt.Errorf("invalid ovsdb_socket %q; it must be an absolute "+
+			"path, made up of letters, digits, dashes, underscores, dots "+
+			"and slashes", cfg.OvsdbSocket)
+	}
+	return cfg.checkVxlan()
+}
+
+// Helper for check, which verifies the vxlan settings.
+func (cfg *privopConfig) checkVxlan() error {
+	if cfg.VxlanLocal == "" {
+		if cfg.VxlanGroup != "" || cfg.VxlanNic != "" {
+			return fmt.Errorf("vxlan_group and vxlan_nic require vxlan_local")
+		}
+		return nil
+	}
+	local := net.ParseIP(cfg.VxlanLocal)
+	if local == nil {
+		return fmt.Errorf("invalid vxlan_local %q; it must be an IP address",
+			cfg.VxlanLocal)
+	}
+	if cfg.VxlanGroup != "" {
+		group := net.ParseIP(cfg.VxlanGroup)
+		if group == nil || !group.IsMulticast() ||
+			(group.To4() == nil) != (local.To4() == nil) {
+			return fmt.Errorf("invalid vxlan_group %q; it must be a multicast "+
+				"address of the same family as vxlan_local", cfg.VxlanGroup)
+		}
+		if cfg.VxlanNic == "" {
+			return fmt.Errorf("vxlan_group requires vxlan_nic")
+		}
+	}
+	if cfg.VxlanNic != "" && !bridgeRe.MatchString(cfg.VxlanNic) {
+		return fmt.Errorf("invalid vxlan_nic %q; it must be at most 15 "+
+			"characters, which may only be letters, digits, dashes and "+
+			"underscores", cfg.VxlanNic)
+	}
+	if cfg.VxlanPort == 0 {
+		return fmt.Errorf("vxlan_port must not be 0")
+	}
+	return nil
+}
+
+// Return the arguments to pass to hil-vpn-hook (before the network) to have
+// it attach `vpn` as these settings call for.
+func (cfg *privopConfig) hookArgs(vpn OpenVpnCfg) []string {
+	args := []string{}
+	if vpn.Vni != 0 {
+		// The bridge settings only apply to vlans.
+		args = append(args, "--vtep", cfg.VxlanLocal)
+		if cfg.VxlanGroup != "" {
+			args = append(args, "--vxlan-group", cfg.VxlanGroup,
+				"--vxlan-nic", cfg.VxlanNic)
+		}
+		if cfg.VxlanPort != bridge.DefaultVxlanPort {
+			args = append(args, "--vxlan-port", strconv.Itoa(int(cfg.VxlanPort)))
+		}
+		return args
+	}
+	if cfg.TrunkNic != "" {
+		args = append(args, "--trunk", cfg.TrunkNic)
+	}
+	// The hook defaults to the same template, so we leave it out unless it
+	// differs, so as not to change the configs of existing vpns:
+	if cfg.BridgeMode == BridgePerVlan && cfg.BridgeName != bridge.DefaultNameTemplate {
+		args = append(args, "--bridge-name", cfg.BridgeName)
+	}
+	if cfg.BridgeMode == BridgeVlanFiltering {
+		args = append(args, "--vlan-filtering", "--bridge", cfg.VlanBridge)
+	}
+	if cfg.BridgeMode == BridgeOVS {
+		args = append(args, "--ovs", "--bridge", cfg.VlanBridge,
+			"--ovsdb", cfg.OvsdbSocket)
+	}
+	return args
+}
+
+// Return the backend which attaches vpns to their vlans as these settings
+// call for; hil-vpn-hook uses the same one, per hookArgs.
+func (cfg *privopConfig) backend() bridge.Backend {
+	switch cfg.BridgeMode {
+	case BridgeVlanFiltering:
+		return bridge.VlanFiltering{Bridge: cfg.VlanBridge, Trunk: cfg.TrunkNic}
+	case BridgeOVS:
+		return bridge.OVS{Bridge: cfg.VlanBridge, Socket: cfg.OvsdbSocket}
+	default:
+		return bridge.PerVlan{Trunk: cfg.TrunkNic, NameTemplate: cfg.BridgeName}
+	}
+}
+
+// Return the settings for vpns on vxlan networks; hil-vpn-hook uses the
+// same ones, per hookArgs. If vxlan_local is unset, the result's Local is
+// nil, and it refuses to prepare any networks.
+func (cfg *privopConfig) vxlan() bridge.Vxlan {
+	return bridge.Vxlan{
+		Local: net.ParseIP(cfg.VxlanLocal),
+		Group: net.ParseIP(cfg.VxlanGroup),
+		Dev:   cfg.VxlanNic,
+		Port:  cfg.VxlanPort,
+	}
+}
@@ -1,25 +1,183 @@
 package main
 
 import (
-	"golang.org/x/sys/unix"
+	"fmt"
 	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
 )
 
-// This file implements a simple file lock, allowing us to assume that only one instance of
-// hil-vpn-privop is running at a time.
+// This file implements the locking which keeps concurrent invocations of
+// hil-vpn-privop from stepping on each other. There are two kinds of lock:
+//
+// 1. A lock for each vpn. Commands which modify a vpn (create, start, stop,
+//    delete, regen) hold it exclusively while they work; commands which only
+//    read a vpn's files (e.g. verify) hold it shared.
+// 2. A lock on the openvpn config directory as a whole. Commands which add
+//    or remove files hold this exclusively, while scans of the directory
+//    (see scanConfigDir) hold it shared, so that they see a consistent set
+//    of files. It is only ever held briefly.
+//
+// To avoid deadlocks, a vpn's lock must always be acquired before the
+// directory lock, never while holding it. Locks are released automatically
+// when the process exits, including when it exits due to an error.
+//
+// The lock files live in a directory which only root may write to; a lock
+// file in a world-writable directory such as /tmp could be replaced by a
+// symlink, or held open by an unprivileged user to block us indefinitely.
+//
+// Per-vpn lock files are not removed when a vpn is deleted; doing so safely
+// would require further coordination, and they are small and (in a typical
+// setup) cleared at reboot.
+
+// The directory in which we keep our lock files.
+var lockDir = staticconfig.Lockdir
+
+// How long to wait for a lock before giving up.
+var lockTimeout = 30 * time.Second
+
+// How often to retry while waiting for a lock.
+const lockPollInterval = 50 * time.Millisecond
+
+// A held lock.
+type fileLock struct {
+	name string
+	file *os.File
+	how  int
+
+	// The number of outstanding acquisitions; see heldLocks.
+	refs int
+}
 
-const lockFilePath = "/tmp/hil-vpn.lock"
+// Locks currently held by this process, by file name. Locks are reentrant:
+// acquiring a lock we already hold just bumps its reference count. This lets
+// the batch subcommand hold the locks for all of the vpns it touches while
+// running the individual commands, which acquire them again.
+var heldLocks = map[string]*fileLock{}
 
-var lockFileRef *os.File
+// Acquire the lock for the named vpn; `how` is unix.LOCK_EX or
+// unix.LOCK_SH. Exits with an error if the lock cannot be acquired.
+func lockVpn(vpnName string, how int) *fileLock {
+	lock, err := acquireLock("vpn-"+vpnName+".lock", how)
+	chkfatal("Locking vpn "+vpnName, err)
+	return lock
+}
+
+// Acquire the lock on the openvpn config directory; `how` is unix.LOCK_EX
+// or unix.LOCK_SH. Exits with an error if the lock cannot be acquired.
+func lockConfigDir(how int) *fileLock {
+	lock, err := acquireLock("hil-vpn.lock", how)
+	chkfatal("Locking openvpn config directory", err)
+	return lock
+}
+
+// Acquire a lock on the file `name` within lockDir, waiting up to
+// lockTimeout for it to become available.
+func acquireLock(name string, how int) (*fileLock, error) {
+	if lock, ok := heldLocks[name]; ok {
+		if how == unix.LOCK_EX && lock.how != unix.LOCK_EX {
+			return nil, fmt.Errorf("BUG: tried to upgrade shared lock %s "+
+				"to an exclusive one", name)
+		}
+		lock.refs++
+		return lock, nil
+	}
+	if err := ensurePrivateDir(lockDir); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(
+		lockDir+"/"+name,
+		os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,
+		0600,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOwnedRegular(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		err = unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+		if err != unix.EWOULDBLOCK {
+			break
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, &privproto.Error{
+				Code: privproto.ErrLockTimeout,
+				Message: fmt.Sprintf(
+					"timed out after %v waiting for %s; another "+
+						"hil-vpn-privop may be stuck holding it",
+					lockTimeout, file.Name()),
+			}
+		}
+		time.Sleep(lockPollInterval)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	lock := &fileLock{name: name, file: file, how: how, refs: 1}
+	heldLocks[name] = lock
+	return lock, nil
+}
+
+// Release the lock. If it has been acquired more than once, it is only
+// actually unlocked when the last acquisition is released.
+func (l *fileLock) release() {
+	l.refs--
+	if l.refs > 0 {
+		return
+	}
+	delete(heldLocks, l.name)
+	chkfatal("Unlocking file", unix.Flock(int(l.file.Fd()), unix.LOCK_UN))
+	l.file.Close()
+}
+
+// Create the directory `dir` if it does not exist, and verify that it is
+// a real directory (not a symlink), owned by us, and not writable by
+// anyone else.
+func ensurePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s must not be writable by group or other", dir)
+	}
+	return checkOwner(dir, fi)
+}
 
-func lockFile() {
-	file, err := os.Create(lockFilePath)
-	chkfatal("Opening lock file", err)
-	lockFileRef = file
-	chkfatal("Locking file", unix.Flock(int(file.Fd()), unix.LOCK_EX))
+// Verify that the open file `f` is a regular file owned by us.
+func checkOwnedRegular(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", f.Name())
+	}
+	return checkOwner(f.Name(), fi)
 }
 
-func unlockFile() {
-	chkfatal("Unlocking file", unix.Flock(int(lockFileRef.Fd()), unix.LOCK_UN))
-	lockFileRef.Close()
+// Verify that the file at `path`, described by `fi`, is owned by us.
+func checkOwner(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is not owned by uid %d", path, os.Geteuid())
+	}
+	return nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Test that shared locks coexist, that exclusive locks are excluded while
+// the lock is held, and that reentrant acquisitions are counted.
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldLockDir, oldTimeout := lockDir, lockTimeout
+	lockDir, lockTimeout = dir+"/locks", 200*time.Millisecond
+	defer func() {
+		lockDir, lockTimeout = oldLockDir, oldTimeout
+	}()
+
+	first, err := acquireLock("vpn-a.lock", unix.LOCK_SH)
+	if err != nil {
+		t.Fatal("Acquiring first shared lock:", err)
+	}
+	second, err := acquireLock("vpn-a.lock", unix.LOCK_SH)
+	if err != nil {
+		t.Fatal("Acquiring second shared lock:", err)
+	}
+	if _, err = acquireLock("vpn-a.lock", unix.LOCK_EX); err == nil {
+		t.Fatal("Upgraded a shared lock to an exclusive one.")
+	}
+
+	// Locks are reentrant within a process, so to check that another
+	// process would be excluded we take the lock directly:
+	if err = tryFlock(dir+"/locks/vpn-a.lock", unix.LOCK_EX); err == nil {
+		t.Fatal("Acquired an exclusive lock while shared locks were held.")
+	}
+	if err = tryFlock(dir+"/locks/vpn-a.lock", unix.LOCK_SH); err != nil {
+		t.Fatal("Failed to acquire a shared lock alongside others:", err)
+	}
+
+	// Other vpns' locks should be unaffected:
+	other, err := acquireLock("vpn-b.lock", unix.LOCK_EX)
+	if err != nil {
+		t.Fatal("Acquiring lock on another vpn:", err)
+	}
+	other.release()
+
+	first.release()
+	if err = tryFlock(dir+"/locks/vpn-a.lock", unix.LOCK_EX); err == nil {
+		t.Fatal("Lock was released while still held.")
+	}
+	second.release()
+	excl, err := acquireLock("vpn-a.lock", unix.LOCK_EX)
+	if err != nil {
+		t.Fatal("Acquiring exclusive lock after release:", err)
+	}
+	excl.release()
+}
+
+// Try to take a lock on `path` via a new open file description, as another
+// process would, releasing it immediately if successful.
+func tryFlock(path string, how int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
 	"github.com/CCI-MOC/hil-vpn/internal/validate"
 )
 
@@ -13,7 +16,7 @@ func init() {
 	// Set the $PATH environment variable to a known-safe value. If the
 	// caller is able to influence our environment, it could set PATH
 	// to something containing an untrustworthy executable named openvpn
-	// or systemctl. Since hil-vpn-privop runs with elevated privileges,
+	// or diff. Since hil-vpn-privop runs with elevated privileges,
 	// we need to guard against this, so we set PATH to a specific value,
 	// rather than assuming it is sane on startup.
 	err := os.Setenv(
@@ -23,6 +26,11 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	// Likewise, make sure we talk to the real systemd, rather than
+	// whatever is listening on a bus the caller points us at.
+	if err = os.Unsetenv("DBUS_SYSTEM_BUS_ADDRESS"); err != nil {
+		panic(err)
+	}
 }
 
 // Print a help message to stderr and exit with the given status code.
@@ -30,22 +38,50 @@ func usage(exitCode int) {
 	fmt.Fprintln(os.Stderr, strings.Join([]string{
 		`Usage:`,
 		``,
-		`    hil-vpn-privop create <name> <vlan-no> <port-no>`,
+		`    hil-vpn-privop [--json] <subcommand> <args>...`,
+		``,
+		`Subcommands:`,
+		``,
+		`    hil-vpn-privop create <name> [trunk:]<vlan-no>[,<vlan-no>...]|vxlan:<vni> <port-no>`,
+		`    hil-vpn-privop create <name> routed:<server-addr>,<client-addr> <port-no>`,
 		`    hil-vpn-privop start <name>`,
 		`    hil-vpn-privop stop <name>`,
 		`    hil-vpn-privop delete <name>`,
 		`    hil-vpn-privop list`,
+		`    hil-vpn-privop regen [--dry-run] <name>|--all`,
+		`    hil-vpn-privop verify`,
+		`    hil-vpn-privop batch [--atomic] < requests.json`,
+		`    hil-vpn-privop boot`,
+		`    hil-vpn-privop serve [--socket <path>] <allowed-user>`,
+		`    hil-vpn-privop version`,
+		`    hil-vpn-privop preflight`,
+		`    hil-vpn-privop watch`,
 	}, "\n",
 	))
 	os.Exit(exitCode)
 }
 
+// Report a problem with the command line arguments, then print a help
+// message and exit with a failing status code.
+func usageError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(os.Stderr, "%s\n\n", msg)
+	if jsonOutput {
+		emit(privproto.Response{
+			Error: &privproto.Error{
+				Code:    privproto.ErrInvalidArgument,
+				Message: msg,
+			},
+		}, nil)
+	}
+	usage(1)
+}
+
 // Verify that the number of subcommand-specific arguments is equal to count.
 // If not, prints a help message and exits with a failing status code.
 func checkNumArgs(count int) {
 	if len(os.Args) != count+2 {
-		fmt.Fprintf(os.Stderr, "Wrong number of arguments for subcommand %q\n\n", os.Args[1])
-		usage(1)
+		usageError("Wrong number of arguments for subcommand %q", os.Args[1])
 	}
 }
 
@@ -54,25 +90,32 @@ func checkNumArgs(count int) {
 func checkVpnName(name string) string {
 	err := validate.CheckVpnName(name)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		usage(1)
+		usageError("%v", err)
 	}
 	return name
 }
 
-// Validate that `vlanStr` is a legal vlan id. If not, exit with an error
-// message, otherwise parse the vlan id and return it.
-func checkVlan(vlanStr string) uint16 {
-	vlanNo, err := strconv.ParseInt(os.Args[3], 10, 12)
+// Validate that `netStr` is a legal vlan id, a trunk, or a vxlan network
+// (see validate.ParseNetwork). If not, exit with an error message,
+// otherwise parse and return the vlan ids and whether they are tagged, or
+// the VNI.
+func checkNetwork(netStr string) ([]uint16, bool, uint32) {
+	vlans, tagged, vni, err := validate.ParseNetwork(netStr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing vlan number: %v\n\n", err)
-		usage(1)
+		usageError("%v", err)
 	}
-	if err = validate.CheckVlanNo(uint16(vlanNo)); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		usage(1)
+	return vlans, tagged, vni
+}
+
+// Validate that `addrStr` holds acceptable addresses for a routed vpn (see
+// validate.ParseRouted). If not, exit with an error message, otherwise
+// parse and return the server's and the client's addresses.
+func checkRouted(addrStr string) (net.IP, net.IP) {
+	server, client, err := validate.ParseRouted(addrStr)
+	if err != nil {
+		usageError("%v", err)
 	}
-	return uint16(vlanNo)
+	return server, client
 }
 
 // Validate that `portStr` is an acceptable port number. If not, exit with
@@ -84,53 +127,192 @@ func checkVlan(vlanStr string) uint16 {
 func checkPort(portStr string) uint16 {
 	portNo, err := strconv.ParseInt(os.Args[4], 10, 16)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing port number: %v\n\n", err)
-		usage(1)
+		usageError("Error parsing port number: %v", err)
 	}
 	if portNo < 1024 {
-		fmt.Fprintln(os.Stderr,
-			"Unacceptable port number: ",
-			portNo,
-			"; only non-privileged ports (>= 1024) may be used.")
-		usage(1)
+		usageError("Unacceptable port number: %d; only non-privileged "+
+			"ports (>= 1024) may be used.", portNo)
 	}
 	return uint16(portNo)
 }
 
 func main() {
-	// Make sure only one hil-vpn-privop command is running at a time:
-	lockFile()
-	defer unlockFile()
-
+	if len(os.Args) > 1 && os.Args[1] == "--json" {
+		jsonOutput = true
+		// Drop the flag, so the subcommands' arguments are where we
+		// expect them:
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	if len(os.Args) < 2 {
-		usage(1)
+		usageError("No subcommand given")
 	}
 	switch os.Args[1] {
 	case "create":
 		checkNumArgs(3)
 		vpnName := checkVpnName(os.Args[2])
-		vlanNo := checkVlan(os.Args[3])
-		portNo := checkPort(os.Args[4])
-		fmt.Print(createCmd(vpnName, vlanNo, portNo))
+		var key string
+		if strings.HasPrefix(os.Args[3], validate.RoutedPrefix) {
+			server, client := checkRouted(os.Args[3])
+			portNo := checkPort(os.Args[4])
+			key = createRoutedCmd(vpnName, server, client, portNo)
+		} else {
+			vlans, tagged, vni := checkNetwork(os.Args[3])
+			portNo := checkPort(os.Args[4])
+			key = createCmd(vpnName, vlans, tagged, vni, portNo)
+		}
+		emit(privproto.Response{Key: key}, func() { fmt.Print(key) })
 	case "start":
 		checkNumArgs(1)
 		vpnName := checkVpnName(os.Args[2])
 		startCmd(vpnName)
+		emit(privproto.Response{}, nil)
 	case "stop":
 		checkNumArgs(1)
 		vpnName := checkVpnName(os.Args[2])
 		stopCmd(vpnName)
+		emit(privproto.Response{}, nil)
 	case "delete":
 		checkNumArgs(1)
 		vpnName := checkVpnName(os.Args[2])
 		deleteCmd(vpnName)
+		emit(privproto.Response{}, nil)
 	case "list":
 		checkNumArgs(0)
-		listCmd()
+		names := listCmd()
+		emit(privproto.Response{Vpns: names}, func() {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		})
+	case "regen":
+		args := os.Args[2:]
+		dryRun := len(args) > 0 && args[0] == "--dry-run"
+		if dryRun {
+			args = args[1:]
+		}
+		if len(args) != 1 {
+			usageError("Wrong number of arguments for subcommand %q", os.Args[1])
+		}
+		var vpnNames []string
+		if args[0] == "--all" {
+			vpnNames = listVpns()
+		} else {
+			vpnNames = []string{checkVpnName(args[0])}
+		}
+		changed, diff, err := regenCmd(vpnNames, dryRun)
+		// Report what we managed to do even if some vpns failed, as
+		// well as the failures:
+		if err != nil && len(vpnNames) > 1 {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Message)
+		}
+		emit(privproto.Response{Vpns: changed, Diff: diff, Error: err}, func() {
+			if dryRun {
+				fmt.Print(diff)
+				return
+			}
+			for _, name := range changed {
+				fmt.Println(name)
+			}
+		})
+		if err != nil {
+			os.Exit(1)
+		}
+	case "verify":
+		checkNumArgs(0)
+		problems := verifyCmd()
+		emit(privproto.Response{Problems: problems}, func() {
+			for _, p := range problems {
+				fmt.Printf("%s\t%s\t%s\n", p.Vpn, p.Kind, p.Detail)
+			}
+		})
+	case "batch":
+		atomic := len(os.Args) == 3 && os.Args[2] == "--atomic"
+		if !atomic {
+			checkNumArgs(0)
+		}
+		results, rolledBack, err := batchCmd(os.Stdin, atomic)
+		resp := privproto.Response{
+			Error:      err,
+			Results:    results,
+			RolledBack: rolledBack,
+		}
+		// Unlike the other subcommands, we have results to report even
+		// if the batch as a whole failed, so we can't use fatal():
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Message)
+		}
+		emit(resp, func() {
+			for i, r := range results {
+				status := "ok"
+				if r.Error != nil {
+					status = "error: " + r.Error.Message
+				}
+				fmt.Printf("%d\t%s\n", i, status)
+			}
+		})
+		if err != nil {
+			os.Exit(1)
+		}
+	case "version":
+		checkNumArgs(0)
+		version := versionCmd()
+		emit(privproto.Response{Version: &version}, func() {
+			fmt.Printf("protocol %d\n", version.Protocol)
+			fmt.Printf("features %s\n", strings.Join(version.Features, " "))
+		})
+	case "preflight":
+		checkNumArgs(0)
+		checks := preflightCmd()
+		failed := false
+		for _, c := range checks {
+			failed = failed || !c.OK
+		}
+		emit(privproto.Response{Checks: checks}, func() {
+			for _, c := range checks {
+				status := "ok"
+				if !c.OK {
+					status = "FAIL"
+				}
+				fmt.Printf("%-4s  %-12s  %s\n", status, c.Name, c.Detail)
+				if c.Fix != "" {
+					fmt.Printf("%-4s  %-12s  fix: %s\n", "", "", c.Fix)
+				}
+			}
+		})
+		if failed {
+			os.Exit(1)
+		}
+	case "boot":
+		checkNumArgs(0)
+		started, err := bootCmd()
+		emit(privproto.Response{Vpns: started, Error: err}, func() {
+			for _, name := range started {
+				fmt.Println(name)
+			}
+		})
+		if err != nil {
+			os.Exit(1)
+		}
+	case "watch":
+		checkNumArgs(0)
+		watchCmd()
+	case "serve":
+		flags := flag.NewFlagSet("serve", flag.ExitOnError)
+		flags.Usage = func() { usage(1) }
+		socketPath := flags.String("socket", defaultSocketPath, "")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 1 {
+			usageError("Wrong number of arguments for subcommand %q", os.Args[1])
+		}
+		serveCmd(*socketPath, flags.Arg(0))
+	case "supervise":
+		// Not listed in the usage message, since it is only run by the
+		// start subcommand; see supervisor.go.
+		checkNumArgs(1)
+		superviseCmd(checkVpnName(os.Args[2]))
 	case "-h", "--help", "help":
 		usage(0)
 	default:
-		fmt.Fprintf(os.Stderr, "Unknown subcommand: %q\n\n", os.Args[1])
-		usage(1)
+		usageError("Unknown subcommand: %q", os.Args[1])
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Metadata we store alongside each vpn's config and key. This records the
+// parameters the config was generated from, so that it can be re-rendered
+// (see regenCmd), as well as hashes of the files we wrote, so that we can
+// detect manual modifications (see verifyCmd).
+type vpnMetadata struct {
+	OpenVpnCfg
+
+	// Hex-encoded SHA-256 hashes of the config and key files. These may be
+	// empty for vpns whose metadata was recovered from their config file.
+	ConfSHA256 string `json:",omitempty"`
+	KeySHA256  string `json:",omitempty"`
+}
+
+// Return the metadata for `cfg`, whose rendered config is `conf`.
+func (cfg OpenVpnCfg) metadata(conf []byte) vpnMetadata {
+	return vpnMetadata{
+		OpenVpnCfg: cfg,
+		ConfSHA256: hashOf(conf),
+		KeySHA256:  hashOf([]byte(cfg.Key)),
+	}
+}
+
+// Encode the metadata for storage on disk.
+func (meta vpnMetadata) encode() ([]byte, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Read the metadata for the named vpn.
+func readMetadata(name string) (*vpnMetadata, error) {
+	data, err := ioutil.ReadFile(getMetaPath(name))
+	if err != nil {
+		return nil, err
+	}
+	meta := &vpnMetadata{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Return the hex-encoded SHA-256 hash of `data`.
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
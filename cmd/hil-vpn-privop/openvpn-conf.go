@@ -1,23 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
 	"text/template"
 
 	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
 )
 
-const configDir = "/etc/openvpn/server"
+// The directory in which we store openvpn configs and keys.
+var configDir = staticconfig.Openvpnconfdir
 
-// Template for the open vpn config files we generate.
+// Built-in template for the open vpn config files we generate. Admins may
+// override this by installing their own template; see loadTemplate.
 var openVpnCfgTpl = template.Must(template.New("openvpn-config").Parse(`
 # This file is automatically generated by hil-vpn-privop; do not modify manually.
 
-dev tap{{ .NewInterfaceName }}
+dev {{ .DevType }}{{ .NewInterfaceName }}
 secret hil-vpn-{{ .Name }}.key
 
 # The default cipher is insecure, so we explicitly set the cipher to the openvpn
@@ -25,25 +35,49 @@ secret hil-vpn-{{ .Name }}.key
 cipher AES-256-CBC
 
 lport {{ .Port }}
-
-up "{{ .Libexecdir }}/hil-vpn-hook-up {{ .Vlan }}"
+{{ if .Routed }}
+{{ .Ifconfig }}
+{{ else }}
+up "{{ .Libexecdir }}/hil-vpn-hook up {{ range .HookArgs }}{{ . }} {{ end }}{{ .Network }}"
+down "{{ .Libexecdir }}/hil-vpn-hook down {{ range .HookArgs }}{{ . }} {{ end }}{{ .Network }}"
 # Needed to permit the above to actually run:
 script-security 2
-
+{{ end }}
 user nobody
 group nobody
 `))
 
 type OpenVpnCfg struct {
-	Name string
-	Key  string
-	Port uint16
-	Vlan uint16
+	Name          string
+	Key           string `json:"-"`
+	Port          uint16
+	Vlan          uint16
+	InterfaceName string
+
+	// If the vpn is a trunk, carrying its vlans tagged, all of them, in
+	// ascending order, even if there is just one; Vlan is the first. Empty
+	// if the vpn carries just Vlan, untagged, as all vpns created before
+	// trunks were supported do; see Tagged.
+	Vlans []uint16 `json:",omitempty"`
+
+	// If the vpn is on a vxlan network rather than vlans, the network's
+	// VNI, in which case Vlan is 0.
+	Vni uint32 `json:",omitempty"`
+
+	// If the vpn is routed, rather than bridged to a network, the
+	// addresses of the server's and the client's ends of its
+	// point-to-point link, in which case Vlan is 0; see Routed.
+	ServerAddr net.IP `json:",omitempty"`
+	ClientAddr net.IP `json:",omitempty"`
 }
 
 type templateArg struct {
 	OpenVpnCfg
 	Libexecdir string
+
+	// Arguments for hil-vpn-hook, which tell it how to attach the vpn to
+	// its network, per the config file; see privopConfig.hookArgs.
+	HookArgs []string
 }
 
 // Get the path to the file in which to store the openvpn config for the
@@ -57,84 +91,358 @@ func getKeyPath(name string) string {
 	return configDir + "/hil-vpn-" + name + ".key"
 }
 
+// Get the path to the file in which we store the metadata for the named
+// vpn. This records the parameters the config was generated from, so that
+// we can re-render it later; see regenCmd.
+func getMetaPath(name string) string {
+	return configDir + "/hil-vpn-" + name + ".json"
+}
+
 // Get the name of the systemd service for the named vpn.
 func getServiceName(vpnName string) string {
 	return "openvpn-server@" + vpnName
 }
 
-// Save the openvpn config and its static keys to disk.
-func (cfg OpenVpnCfg) Save() error {
-	cfgPath := getCfgPath(cfg.Name)
-	keyPath := getKeyPath(cfg.Name)
+// Get the full name of the systemd unit for the named vpn, as used when
+// talking to systemd.
+func getUnitName(vpnName string) string {
+	return getServiceName(vpnName) + ".service"
+}
+
+// Report whether the vpn is routed: rather than being bridged to a network
+// via a tap device, it has a tun device, with its own point-to-point link,
+// and the host routes its traffic.
+func (cfg OpenVpnCfg) Routed() bool {
+	return cfg.ServerAddr != nil
+}
+
+// Return the type of the vpn's device: "tun" if it is routed, otherwise
+// "tap".
+func (cfg OpenVpnCfg) DevType() string {
+	if cfg.Routed() {
+		return "tun"
+	}
+	return "tap"
+}
+
+// Return the openvpn directive which configures a routed vpn's end of its
+// point-to-point link.
+func (cfg OpenVpnCfg) Ifconfig() string {
+	if cfg.ServerAddr.To4() == nil {
+		return fmt.Sprintf("ifconfig-ipv6 %s/127 %s", cfg.ServerAddr, cfg.ClientAddr)
+	}
+	return fmt.Sprintf("ifconfig %s %s", cfg.ServerAddr, cfg.ClientAddr)
+}
+
+// Return the vlans the vpn carries; none, if it is on a vxlan network, or
+// is routed.
+func (cfg OpenVpnCfg) AllVlans() []uint16 {
+	if cfg.Vni != 0 || cfg.Routed() {
+		return nil
+	}
+	if len(cfg.Vlans) == 0 {
+		return []uint16{cfg.Vlan}
+	}
+	return cfg.Vlans
+}
+
+// Report whether the vpn is a trunk, carrying its vlans tagged.
+func (cfg OpenVpnCfg) Tagged() bool {
+	return len(cfg.Vlans) > 0
+}
+
+// Return the vlans the vpn carries as a comma-separated list, which is how
+// they are passed to hil-vpn-hook. For a vpn with a single vlan, this is
+// the same as Vlan; templates should use this instead, though.
+func (cfg OpenVpnCfg) VlanList() string {
+	return validate.FormatVlans(cfg.AllVlans())
+}
+
+// Return the vpn's network as it is passed to hil-vpn-hook: its vlans, as
+// for VlanList, but marking a trunk of one vlan as such (see
+// validate.FormatTrunk), or its vxlan network, e.g. "vxlan:5000"; see
+// validate.ParseNetwork. Templates should use this. For a routed vpn, which
+// doesn't use the hook, this is its addresses; see validate.FormatRouted.
+func (cfg OpenVpnCfg) Network() string {
+	if cfg.Routed() {
+		return validate.FormatRouted(cfg.ServerAddr, cfg.ClientAddr)
+	}
+	if cfg.Vni != 0 {
+		return validate.FormatVni(cfg.Vni)
+	}
+	if cfg.Tagged() {
+		return validate.FormatTrunk(cfg.Vlans)
+	}
+	return cfg.VlanList()
+}
 
-	cfgFile, err := os.OpenFile(cfgPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+// Report whether the vpn carries vlan number `vlan`.
+func (cfg OpenVpnCfg) HasVlan(vlan uint16) bool {
+	for _, v := range cfg.AllVlans() {
+		if v == vlan {
+			return true
+		}
+	}
+	return false
+}
+
+// Render the openvpn config using the template `tpl` and the host's
+// settings `settings` (see loadConfig), writing the result to `w`. The
+// result is checked for unsafe directives; see checkDirectives.
+//
+// Templates written before vpns could be trunks, be on vxlan networks, or be
+// routed, pass just .Vlan or .VlanList to the hook, and
+// always use a tap device, so for vpns which need more, we check that the
+// rendered config reflects their network.
+func (cfg OpenVpnCfg) Render(w io.Writer, tpl *template.Template, settings *privopConfig) error {
+	if cfg.Vni != 0 && settings.VxlanLocal == "" {
+		return fmt.Errorf("vxlan networks are not configured on this host; "+
+			"see vxlan_local in %s", configPath)
+	}
+	buf := &bytes.Buffer{}
+	err := tpl.Execute(buf, templateArg{
+		OpenVpnCfg: cfg,
+		Libexecdir: staticconfig.Libexecdir,
+		HookArgs:   settings.hookArgs(cfg),
+	})
 	if err != nil {
 		return err
 	}
-	defer func() {
-		cfgFile.Close()
-		if err != nil {
-			os.Remove(cfgPath)
+	if err = checkDirectives(buf.Bytes()); err != nil {
+		return fmt.Errorf("The openvpn config template rendered an unsafe "+
+			"config for vpn %s: %v", cfg.Name, err)
+	}
+	if cfg.Tagged() || cfg.Vni != 0 || cfg.Routed() {
+		parsed, err := parseOpenVpnConfigData(cfg.Name, buf.Bytes())
+		if cfg.Routed() && (err != nil || parsed.Network() != cfg.Network()) {
+			return fmt.Errorf("The openvpn config template does not " +
+				"support routed vpns; it must use .DevType for the " +
+				"device's type, and .Ifconfig if .Routed is true")
 		}
-	}()
-	keyFile, err := os.OpenFile(keyPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if err != nil || parsed.Network() != cfg.Network() {
+			return fmt.Errorf("The openvpn config template does not pass " +
+				"the vpn's network to hil-vpn-hook; it must use " +
+				".Network rather than .Vlan or .VlanList")
+		}
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Save the openvpn config and its static keys to disk, rendering the config
+// with the template `tpl` and the settings `settings` (see Render).
+//
+// Each file is written atomically (see writeFileAtomic), and the key file
+// is written last: its presence is what marks the vpn as existing (see
+// listVpns), so a create that is interrupted part way through is never
+// visible as a vpn.
+func (cfg OpenVpnCfg) Save(tpl *template.Template, settings *privopConfig) (err error) {
+	conf := &bytes.Buffer{}
+	if err = cfg.Render(conf, tpl, settings); err != nil {
+		return err
+	}
+	meta, err := cfg.metadata(conf.Bytes()).encode()
 	if err != nil {
 		return err
 	}
+
+	written := []string{}
 	defer func() {
-		keyFile.Close()
-		if err != nil {
-			os.Remove(keyPath)
+		if err == nil {
+			return
 		}
+		// Clean up whatever we managed to write:
+		for _, path := range written {
+			os.Remove(path)
+		}
+		syncDir(configDir)
 	}()
-	arg := templateArg{
-		OpenVpnCfg: cfg,
-		Libexecdir: staticconfig.Libexecdir,
+	files := []struct {
+		path string
+		data []byte
+	}{
+		{getCfgPath(cfg.Name), conf.Bytes()},
+		{getMetaPath(cfg.Name), meta},
+		{getKeyPath(cfg.Name), []byte(cfg.Key)},
 	}
-	if err = openVpnCfgTpl.Execute(cfgFile, arg); err != nil {
-		return err
+	for _, file := range files {
+		if err = writeFileAtomic(file.path, file.data, 0600, false); err != nil {
+			return err
+		}
+		written = append(written, file.path)
 	}
-	_, err = keyFile.Write([]byte(cfg.Key))
-	return err
+	return nil
+}
+
+// Return the name of the vpn's device, minus the prefix giving its type (see
+// DevType). The name of this method is historical; templates refer to it,
+// so we keep it.
+func (cfg OpenVpnCfg) NewInterfaceName() string {
+	return cfg.InterfaceName
 }
 
 // Return a cryptographically-random 12-character base64(url) encoded string.
 // This is to do collision avoidance given the 15-character limit on network
 // interface names. See also issue #14. We still prefix interface names with
-// tap for two reasons:
+// the type of the device, tap or tun (see DevType), for two reasons:
 //
-// 1. A modicum of readability.
-// 2. So that openvpn can infer the type of device. We could also deal with
-//    this by setting `dev-type tap` in the config file.
+//  1. A modicum of readability.
+//  2. So that openvpn can infer the type of device. We could also deal with
+//     this by setting `dev-type` in the config file.
 //
 // Note that 12 bytes of base64 (which is about 9 bytes decoded) is not in
 // general a reasonable amount of entropy for cryptographic purposes. We'll
 // settle for it in this case because:
 //
-// 1. The value needn't be secret, just collision avoidant.
-// 2. The failure case is very mild: if a user is already able to invoke
-//    hil-vpn-privop as root, they can cause two networks to try to share
-//    the same interface; the consequence of this is that only one of them
-//    will start. At this point the user already has the authority to destroy
-//    newtorks and grant access to arbitrary vlans, so... whoopdy-do.
-func (cfg OpenVpnCfg) NewInterfaceName() string {
+//  1. The value needn't be secret, just collision avoidant.
+//  2. The failure case is very mild: if a user is already able to invoke
+//     hil-vpn-privop as root, they can cause two networks to try to share
+//     the same interface; the consequence of this is that only one of them
+//     will start. At this point the user already has the authority to destroy
+//     newtorks and grant access to arbitrary vlans, so... whoopdy-do.
+func newInterfaceName() string {
 	var data [16]byte
 	_, err := rand.Read(data[:])
 	chkfatal("Generating interface name", err)
 	return base64.RawURLEncoding.EncodeToString(data[:])[:12]
 }
 
-// Generate a new openvpn config (including a static key).
-func NewOpenVpnConfig(name string, vlan, port uint16) (*OpenVpnCfg, error) {
+// Generate a new openvpn config (including a static key) for a vpn, which
+// is on no network until the caller sets one; see setNetwork and setRouted.
+func NewOpenVpnConfig(name string, port uint16) (*OpenVpnCfg, error) {
 	cmd := exec.Command("openvpn", "--genkey", "--secret", "/dev/fd/1")
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("Error invoking openvpn: %v", err)
 	}
-	return &OpenVpnCfg{
-		Name: name,
-		Port: port,
-		Vlan: vlan,
-		Key:  string(output),
-	}, nil
+	cfg := &OpenVpnCfg{
+		Name:          name,
+		Port:          port,
+		Key:           string(output),
+		InterfaceName: newInterfaceName(),
+	}
+	return cfg, nil
+}
+
+// Set the vpn's network: the vxlan network `vni` if it is non-zero,
+// otherwise the vlans in `vlans`, which must not be empty, tagged if
+// `tagged` is set.
+func (cfg *OpenVpnCfg) setNetwork(vlans []uint16, tagged bool, vni uint32) {
+	cfg.ServerAddr, cfg.ClientAddr = nil, nil
+	if vni != 0 {
+		cfg.Vlan, cfg.Vlans, cfg.Vni = 0, nil, vni
+		return
+	}
+	cfg.Vni = 0
+	cfg.setVlans(vlans, tagged)
+}
+
+// Make the vpn routed, with the addresses `server` and `client` for the ends
+// of its point-to-point link; see Routed.
+func (cfg *OpenVpnCfg) setRouted(server, client net.IP) {
+	cfg.Vlan, cfg.Vlans, cfg.Vni = 0, nil, 0
+	cfg.ServerAddr, cfg.ClientAddr = server, client
+}
+
+// Set the vlans the vpn carries to those in `vlans`, which must not be
+// empty, tagged if `tagged` is set. Several vlans are always tagged.
+func (cfg *OpenVpnCfg) setVlans(vlans []uint16, tagged bool) {
+	sorted := append([]uint16{}, vlans...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	cfg.Vlan = sorted[0]
+	cfg.Vlans = nil
+	if tagged || len(sorted) > 1 {
+		cfg.Vlans = sorted
+	}
+}
+
+// Patterns used by parseOpenVpnConfig to recover parameters from configs
+// generated before we started storing metadata.
+var (
+	cfgDevRe      = regexp.MustCompile(`(?m)^dev (tap|tun)([-_a-zA-Z0-9]+)\s*$`)
+	cfgPortRe     = regexp.MustCompile(`(?m)^lport ([0-9]+)\s*$`)
+	cfgIfconfigRe = regexp.MustCompile(`(?m)^ifconfig(?:-ipv6)? ([0-9a-fA-F.:]+)(?:/127)? ([0-9a-fA-F.:]+)\s*$`)
+	cfgVlanRe     = regexp.MustCompile(`(?m)^up "?\S*/hil-vpn-hook(?:-up| up)(?: \S+)* ((?:vxlan:|trunk:)?[0-9]+(?:,[0-9]+)*)"?\s*$`)
+)
+
+// Load the existing config for the named vpn, including its key. The
+// parameters come from the vpn's metadata file if it has one, otherwise
+// they are recovered from the config file itself.
+func LoadOpenVpnConfig(name string) (*OpenVpnCfg, error) {
+	key, err := ioutil.ReadFile(getKeyPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var cfg *OpenVpnCfg
+	meta, err := readMetadata(name)
+	if os.IsNotExist(err) {
+		cfg, err = parseOpenVpnConfig(name)
+	} else if err == nil {
+		cfg = &meta.OpenVpnCfg
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Name != name {
+		return nil, fmt.Errorf("Metadata for vpn %q names a different vpn (%q)",
+			name, cfg.Name)
+	}
+	cfg.Key = string(key)
+	return cfg, nil
+}
+
+// Recover the parameters for the named vpn from its config file.
+func parseOpenVpnConfig(name string) (*OpenVpnCfg, error) {
+	path := getCfgPath(name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseOpenVpnConfigData(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Helper for parseOpenVpnConfig, which does the actual parsing of the
+// config's contents.
+func parseOpenVpnConfigData(name string, data []byte) (*OpenVpnCfg, error) {
+	dev := cfgDevRe.FindSubmatch(data)
+	port := cfgPortRe.FindSubmatch(data)
+	// A tap device is bridged to the network the hook is passed, while a
+	// tun device is routed, per its ifconfig directive:
+	netRe := cfgVlanRe
+	if dev != nil && string(dev[1]) == "tun" {
+		netRe = cfgIfconfigRe
+	}
+	network := netRe.FindSubmatch(data)
+	if dev == nil || port == nil || network == nil {
+		return nil, fmt.Errorf("Could not recover vpn parameters; " +
+			"the config may have been modified manually")
+	}
+	portNo, err := strconv.ParseUint(string(port[1]), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing port: %v", err)
+	}
+	cfg := &OpenVpnCfg{
+		Name:          name,
+		Port:          uint16(portNo),
+		InterfaceName: string(dev[2]),
+	}
+	if netRe == cfgIfconfigRe {
+		server, client, err := validate.ParseRouted(validate.RoutedPrefix +
+			string(network[1]) + "," + string(network[2]))
+		if err != nil {
+			return nil, fmt.Errorf("Parsing ifconfig: %v", err)
+		}
+		cfg.setRouted(server, client)
+		return cfg, nil
+	}
+	vlans, tagged, vni, err := validate.ParseNetwork(string(network[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Parsing vlan: %v", err)
+	}
+	cfg.setNetwork(vlans, tagged, vni)
+	return cfg, nil
 }
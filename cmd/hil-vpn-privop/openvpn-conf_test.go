@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+var updateGolden = flag.Bool("update", false, "Update golden files in testdata/")
+
+// A config used for the golden tests.
+var goldenCfg = OpenVpnCfg{
+	Name:          "hil_vpn_id_0123456789abcdef0123456789abcdef_port_5000",
+	Port:          5000,
+	Vlan:          232,
+	InterfaceName: "AAAAAAAAAAAA",
+}
+
+// Set up deterministic values for anything that affects rendered configs.
+func setupRender(t *testing.T) {
+	oldLibexecdir := staticconfig.Libexecdir
+	staticconfig.Libexecdir = "/usr/local/libexec"
+	t.Cleanup(func() {
+		staticconfig.Libexecdir = oldLibexecdir
+	})
+}
+
+// Compare `actual` to the contents of testdata/<name>, or overwrite the
+// latter if -update was passed.
+func checkGolden(t *testing.T, name string, actual []byte) {
+	path := "testdata/" + name
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("Output does not match %s; got:\n%s", path, actual)
+	}
+}
+
+// Verify that the built-in template renders the expected config.
+func TestBuiltinTemplateGolden(t *testing.T) {
+	setupRender(t)
+	buf := &bytes.Buffer{}
+	if err := goldenCfg.Render(buf, openVpnCfgTpl, &defaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "openvpn.conf.golden", buf.Bytes())
+}
+
+// Verify that we can recover the parameters from a rendered config, as we
+// must for vpns created before we stored metadata.
+func TestParseOpenVpnConfig(t *testing.T) {
+	setupRender(t)
+	buf := &bytes.Buffer{}
+	if err := goldenCfg.Render(buf, openVpnCfgTpl, &defaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseOpenVpnConfigData(goldenCfg.Name, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, goldenCfg) {
+		t.Fatalf("Parsed config differs from original; got %+v, wanted %+v",
+			*cfg, goldenCfg)
+	}
+}
+
+// Configs generated before hil-vpn-hook replaced the hil-vpn-hook-up script
+// must still parse.
+func TestParseLegacyHookConfig(t *testing.T) {
+	data := []byte("dev tapAAAAAAAAAAAA\nlport 5000\n" +
+		`up "/usr/local/libexec/hil-vpn-hook-up 232"` + "\n")
+	cfg, err := parseOpenVpnConfigData(goldenCfg.Name, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, goldenCfg) {
+		t.Fatalf("Parsed config differs from original; got %+v, wanted %+v",
+			*cfg, goldenCfg)
+	}
+}
+
+// Settings in the config file which affect how vpns are attached to their
+// vlans are passed to the hook, and we can still recover the vlan from
+// configs which include them.
+func TestRenderHookArgs(t *testing.T) {
+	setupRender(t)
+	filtering := defaultConfig
+	filtering.TrunkNic = "eth1"
+	filtering.BridgeMode = BridgeVlanFiltering
+	ovs := defaultConfig
+	ovs.BridgeMode = BridgeOVS
+	named := defaultConfig
+	named.BridgeName = "vlan{vlan}br"
+	cases := []struct {
+		privopCfg privopConfig
+		expected  string
+	}{
+		{filtering, "--trunk eth1 --vlan-filtering --bridge br-hil"},
+		{named, "--bridge-name vlan{vlan}br"},
+		{ovs, "--ovs --bridge br-hil --ovsdb /var/run/openvswitch/db.sock"},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		err := openVpnCfgTpl.Execute(buf, templateArg{
+			OpenVpnCfg: goldenCfg,
+			Libexecdir: staticconfig.Libexecdir,
+			HookArgs:   c.privopCfg.hookArgs(goldenCfg),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `up "/usr/local/libexec/hil-vpn-hook up ` + c.expected + ` 232"`
+		if !strings.Contains(buf.String(), expected+"\n") {
+			t.Fatalf("Config does not contain %s; got:\n%s", expected, buf)
+		}
+		cfg, err := parseOpenVpnConfigData(goldenCfg.Name, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Vlan != goldenCfg.Vlan {
+			t.Fatalf("Parsed vlan %d, wanted %d", cfg.Vlan, goldenCfg.Vlan)
+		}
+	}
+}
+
+// A vpn's vlans are passed to the hook as a list, from which we can recover
+// them.
+func TestRenderVlans(t *testing.T) {
+	setupRender(t)
+	multiCfg := goldenCfg
+	multiCfg.setVlans([]uint16{300, 232, 4094}, false)
+	if multiCfg.Vlan != 232 || !reflect.DeepEqual(multiCfg.Vlans, []uint16{232, 300, 4094}) {
+		t.Fatalf("Unexpected vlans after setVlans: %d, %v", multiCfg.Vlan, multiCfg.Vlans)
+	}
+	buf := &bytes.Buffer{}
+	if err := multiCfg.Render(buf, openVpnCfgTpl, &defaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	expected := `up "/usr/local/libexec/hil-vpn-hook up 232,300,4094"`
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Fatalf("Config does not contain %s; got:\n%s", expected, buf)
+	}
+	cfg, err := parseOpenVpnConfigData(goldenCfg.Name, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, multiCfg) {
+		t.Fatalf("Parsed config differs from original; got %+v, wanted %+v",
+			*cfg, multiCfg)
+	}
+
+	// A template which only passes .Vlan is fine for vpns with a single
+	// vlan, but must be refused for this one:
+	legacy := template.Must(template.New("legacy").Parse(
+		strings.Replace(openVpnCfgTpl.Root.String(), ".Network", ".Vlan", -1)))
+	if err = checkTemplate(legacy); err != nil {
+		t.Fatal("Template using .Vlan was refused:", err)
+	}
+	if err = goldenCfg.Render(&bytes.Buffer{}, legacy, &defaultConfig); err != nil {
+		t.Fatal("Rendering a single-vlan vpn with a template using .Vlan:", err)
+	}
+	if err = multiCfg.Render(&bytes.Buffer{}, legacy, &defaultConfig); err == nil {
+		t.Fatal("Rendering a multi-vlan vpn with a template using .Vlan succeeded.")
+	}
+}
+
+// A trunk of a single vlan is passed to the hook as such, rather than as a
+// plain vlan, which would be carried untagged.
+func TestRenderTrunkOfOne(t *testing.T) {
+	setupRender(t)
+	trunkCfg := goldenCfg
+	trunkCfg.setNetwork([]uint16{232}, true, 0)
+	if !trunkCfg.Tagged() {
+		t.Fatal("A trunk of one vlan is not tagged.")
+	}
+	buf := &bytes.Buffer{}
+	if err := trunkCfg.Render(buf, openVpnCfgTpl, &defaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	expected := `up "/usr/local/libexec/hil-vpn-hook up trunk:232"`
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Fatalf("Config does not contain %s; got:\n%s", expected, buf)
+	}
+	cfg, err := parseOpenVpnConfigData(goldenCfg.Name, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, trunkCfg) {
+		t.Fatalf("Parsed config differs from original; got %+v, wanted %+v",
+			*cfg, trunkCfg)
+	}
+}
+
+// A vpn on a vxlan network passes it, and the vxlan settings, to the hook,
+// and we can recover it from the config.
+func TestRenderVxlan(t *testing.T) {
+	setupRender(t)
+	vxlanCfg := goldenCfg
+	vxlanCfg.setNetwork(nil, false, 5000)
+	if vxlanCfg.Vlan != 0 || len(vxlanCfg.AllVlans()) != 0 {
+		t.Fatalf("vpn on a vxlan network has vlans: %d, %v",
+			vxlanCfg.Vlan, vxlanCfg.AllVlans())
+	}
+	privopCfg := defaultConfig
+	privopCfg.VxlanLocal = "192.0.2.1"
+	privopCfg.VxlanGroup = "239.1.1.1"
+	privopCfg.VxlanNic = "eth2"
+	privopCfg.TrunkNic = "eth1"
+	buf := &bytes.Buffer{}
+	err := openVpnCfgTpl.Execute(buf, templateArg{
+		OpenVpnCfg: vxlanCfg,
+		Libexecdir: staticconfig.Libexecdir,
+		HookArgs:   privopCfg.hookArgs(vxlanCfg),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `up "/usr/local/libexec/hil-vpn-hook up --vtep 192.0.2.1 ` +
+		`--vxlan-group 239.1.1.1 --vxlan-nic eth2 vxlan:5000"`
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Fatalf("Config does not contain %s; got:\n%s", expected, buf)
+	}
+	cfg, err := parseOpenVpnConfigData(goldenCfg.Name, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*cfg, vxlanCfg) {
+		t.Fatalf("Parsed config differs from original; got %+v, wanted %+v",
+			*cfg, vxlanCfg)
+	}
+
+	if err = vxlanCfg.Render(&bytes.Buffer{}, openVpnCfgTpl, &privopCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without vxlan_local, there's no way to attach the vpn:
+	if err = vxlanCfg.Render(&bytes.Buffer{}, openVpnCfgTpl, &defaultConfig); err == nil {
+		t.Fatal("Rendered a vxlan vpn's config without vxlan_local set.")
+	}
+}
+
+// A routed vpn gets a tun device with its point-to-point link's addresses,
+// from which we can recover them, and no hook.
+func TestRenderRouted(t *testing.T) {
+	setupRender(t)
+	cases := []struct {
+		server, client string
+		expected       string
+	}{
+		{"10.0.0.1", "10.0.0.2", "ifconfig 10.0.0.1 10.0.0.2"},
+		{"fd00::", "fd00::1", "ifconfig-ipv6 fd00::/127 fd00::1"},
+	}
+	for _, c := range cases {
+		routedCfg := goldenCfg
+		routedCfg.setRouted(net.ParseIP(c.server), net.ParseIP(c.client))
+		if len(routedCfg.AllVlans()) != 0 {
+			t.Fatalf("Routed vpn has vlans: %v", routedCfg.AllVlans())
+		}
+		buf := &bytes.Buffer{}
+		if err := routedCfg.Render(buf, openVpnCfgTpl, &defaultConfig); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"dev tun" + goldenCfg.InterfaceName, c.expected} {
+			if !strings.Contains(buf.String(), "\n"+line+"\n") {
+				t.Fatalf("Config does not contain %s; got:\n%s", line, buf)
+			}
+		}
+		if strings.Contains(buf.String(), "hil-vpn-hook") {
+			t.Fatalf("Routed vpn's config runs the hook:\n%s", buf)
+		}
+		cfg, err := parseOpenVpnConfigData(goldenCfg.Name, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Network() != routedCfg.Network() || !cfg.Routed() {
+			t.Fatalf("Parsed config differs from original; got %+v, wanted %+v",
+				*cfg, routedCfg)
+		}
+	}
+
+	// A template which always uses a tap device must be refused:
+	routedCfg := goldenCfg
+	routedCfg.setRouted(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"))
+	legacy := template.Must(template.New("legacy").Parse(
+		strings.Replace(openVpnCfgTpl.Root.String(), "{{.DevType}}", "tap", -1)))
+	if err := routedCfg.Render(&bytes.Buffer{}, legacy, &defaultConfig); err == nil {
+		t.Fatal("Rendering a routed vpn with a tap-only template succeeded.")
+	}
+}
+
+// The built-in template must pass the checks we apply to custom ones.
+func TestBuiltinTemplateValid(t *testing.T) {
+	setupRender(t)
+	if err := checkTemplate(openVpnCfgTpl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that checkTemplate accepts reasonable customizations and rejects
+// templates which are incomplete or unsafe.
+func TestCheckTemplate(t *testing.T) {
+	setupRender(t)
+	base := `
+dev tap{{ .NewInterfaceName }}
+secret hil-vpn-{{ .Name }}.key
+lport {{ .Port }}
+up "{{ .Libexecdir }}/hil-vpn-hook up {{ .Network }}"
+script-security 2
+`
+	cases := []struct {
+		name  string
+		extra string
+		ok    bool
+	}{
+		{"site directives", "keepalive 10 60\nmssfix 1400\nverb 4\n", true},
+		{"script-security 3", "script-security 3\n", false},
+		{"foreign up hook", `up "/bin/sh -c id"` + "\n", false},
+		{"foreign down hook", "down /tmp/hil-vpn-hook\n", false},
+		{"plugin", "plugin /usr/lib/openvpn/plugin.so\n", false},
+		{"config include", "config /tmp/other.conf\n", false},
+		{"log file", "log /etc/cron.d/evil\n", false},
+		{"status file", "status /etc/cron.d/evil\n", false},
+		{"management", "management 0.0.0.0 7505\n", false},
+		{"chroot", "chroot /tmp\n", false},
+		{"iproute", "iproute /tmp/ip\n", false},
+	}
+	for _, c := range cases {
+		tpl := template.Must(template.New(c.name).Parse(base + c.extra))
+		err := checkTemplate(tpl)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%s: template was accepted, but should not have been", c.name)
+		}
+	}
+
+	// A template which only renders an unsafe directive for some vpns gets
+	// past checkTemplate, but not Render:
+	sneaky := template.Must(template.New("sneaky").Parse(base +
+		"{{ if eq .Port 5000 }}log-append /etc/cron.d/evil{{ end }}\n"))
+	if err := checkTemplate(sneaky); err != nil {
+		t.Fatal("Unexpected error checking template:", err)
+	}
+	if err := goldenCfg.Render(&bytes.Buffer{}, sneaky, &defaultConfig); err == nil {
+		t.Error("Rendered an unsafe config.")
+	}
+
+	// Drop each required field in turn, and make sure we notice:
+	for _, field := range requiredTemplateFields {
+		text := strings.Replace(base, "."+field, `"x"`, -1)
+		tpl := template.Must(template.New(field).Parse(text))
+		if err := checkTemplate(tpl); err == nil {
+			t.Errorf("Template without .%s was accepted", field)
+		}
+	}
+}
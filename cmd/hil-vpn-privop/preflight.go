@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/CCI-MOC/hil-vpn/internal/bridge"
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// This file implements the 'preflight' subcommand, which checks that the
+// environment has everything the other subcommands need, so that problems
+// are reported (with a suggested fix) before anyone tries to create a vpn,
+// rather than as an opaque failure when they do.
+
+// The oldest version of openvpn we support.
+const minOpenvpnMajor, minOpenvpnMinor = 2, 3
+
+// Path to the hook which openvpn runs to attach vpns to their bridges.
+var hookPath = staticconfig.Libexecdir + "/hil-vpn-hook"
+
+// The directory listing the host's network devices.
+var sysClassNet = "/sys/class/net"
+
+var openvpnVersionRe = regexp.MustCompile(`^OpenVPN (\d+)\.(\d+)\S*`)
+
+// Implement the 'preflight' subcommand.
+func preflightCmd() []privproto.Check {
+	return []privproto.Check{
+		checkRoot(),
+		checkOpenvpn(),
+		checkServiceManager(),
+		checkConfigDir(),
+		checkLockDir(),
+		checkHook(),
+		checkBridging(),
+		checkBridges(),
+		checkVxlan(),
+	}
+}
+
+// Return a passing check.
+func checkOK(name, detail string) privproto.Check {
+	return privproto.Check{Name: name, OK: true, Detail: detail}
+}
+
+// Return a failing check.
+func checkFailed(name, detail, fix string) privproto.Check {
+	return privproto.Check{Name: name, Detail: detail, Fix: fix}
+}
+
+// Check that we are running as root.
+func checkRoot() privproto.Check {
+	if uid := os.Geteuid(); uid != 0 {
+		return checkFailed("root",
+			fmt.Sprintf("running as uid %d", uid),
+			"Run hil-vpn-privop as root, via sudo. Make sure the user "+
+				"hil-vpnd runs as may do so without a password.")
+	}
+	return checkOK("root", "running as root")
+}
+
+// Check that openvpn is installed, and recent enough.
+func checkOpenvpn() privproto.Check {
+	const fix = "Install openvpn (version 2.3 or later)."
+	path, err := exec.LookPath("openvpn")
+	if err != nil {
+		return checkFailed("openvpn", "openvpn not found in "+os.Getenv("PATH"), fix)
+	}
+	// Some versions of openvpn exit with a failing status after printing
+	// their version, so we only look at the output:
+	out, _ := exec.Command(path, "--version").Output()
+	m := openvpnVersionRe.FindSubmatch(out)
+	if m == nil {
+		return checkFailed("openvpn",
+			fmt.Sprintf("could not determine the version of %s", path), fix)
+	}
+	major, _ := strconv.Atoi(string(m[1]))
+	minor, _ := strconv.Atoi(string(m[2]))
+	if major < minOpenvpnMajor || (major == minOpenvpnMajor && minor < minOpenvpnMinor) {
+		return checkFailed("openvpn",
+			fmt.Sprintf("%s is too old (%s)", path, m[0]), fix)
+	}
+	return checkOK("openvpn", fmt.Sprintf("%s (%s)", path, m[0]))
+}
+
+// Check that the config file is valid, and that the service manager it
+// selects is usable.
+func checkServiceManager() privproto.Check {
+	cfg, err := loadConfig()
+	if err != nil {
+		return checkFailed("config", err.Error(), "Fix or remove "+configPath+".")
+	}
+	switch cfg.ServiceManager {
+	case "systemd":
+		return checkServiceUnit()
+	case "supervisor":
+		return checkSupervisorDir()
+	default:
+		panic("BUG: unknown service manager " + cfg.ServiceManager)
+	}
+}
+
+// Check that the systemd template unit we start vpns with is installed.
+func checkServiceUnit() privproto.Check {
+	unit := getUnitName("")
+	sd, err := connectSystemd()
+	if err != nil {
+		return checkFailed("systemd-unit", err.Error(),
+			"Make sure systemd is running, and that its D-Bus API is "+
+				"reachable on the system bus. On hosts without systemd, "+
+				"set service_manager to \"supervisor\" in "+configPath+".")
+	}
+	defer sd.Close()
+	state, err := sd.unitFileState(unit)
+	if err != nil {
+		return checkFailed("systemd-unit", err.Error(),
+			"Install the "+unit+" unit; it is normally shipped with "+
+				"openvpn's distribution package.")
+	}
+	return checkOK("systemd-unit", fmt.Sprintf("%s is installed (%s)", unit, state))
+}
+
+// Check that the supervisor can keep its pidfiles and logs.
+func checkSupervisorDir() privproto.Check {
+	if err := ensurePrivateDir(supervisorDir); err != nil {
+		return checkFailed("supervisor", err.Error(), fmt.Sprintf(
+			"Make sure %s is a directory owned by root, with mode 0700.",
+			supervisorDir))
+	}
+	return checkOK("supervisor", supervisorDir+" is usable")
+}
+
+// Check that the openvpn config directory exists, and that only root may
+// write to it.
+func checkConfigDir() privproto.Check {
+	fix := fmt.Sprintf("Run: mkdir -p %[1]s && chown root:root %[1]s && "+
+		"chmod 0755 %[1]s", configDir)
+	fi, err := os.Stat(configDir)
+	if err != nil {
+		return checkFailed("config-dir", err.Error(), fix)
+	}
+	if !fi.IsDir() {
+		return checkFailed("config-dir", configDir+" is not a directory", fix)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return checkFailed("config-dir",
+			configDir+" is writable by group or other", fix)
+	}
+	if err = checkOwner(configDir, fi); err != nil {
+		return checkFailed("config-dir", err.Error(), fix)
+	}
+	return checkOK("config-dir", configDir+" exists and is private")
+}
+
+// Check that we can create lock files.
+func checkLockDir() privproto.Check {
+	if err := ensurePrivateDir(lockDir); err != nil {
+		return checkFailed("lock-dir", err.Error(), fmt.Sprintf(
+			"Make sure %s is a directory owned by root, with mode 0700.",
+			lockDir))
+	}
+	return checkOK("lock-dir", lockDir+" is usable")
+}
+
+// Check that the hook which attaches vpns to their bridges is installed.
+func checkHook() privproto.Check {
+	fi, err := os.Stat(hookPath)
+	if err == nil && fi.Mode()&0111 == 0 {
+		err = fmt.Errorf("%s is not executable", hookPath)
+	}
+	if err != nil {
+		return checkFailed("hook", err.Error(),
+			"Install hil-vpn-hook, with `make install`.")
+	}
+	return checkOK("hook", hookPath+" is installed")
+}
+
+// Check that we can talk to the kernel over netlink, which the hook uses to
+// attach openvpn's interfaces to bridges, by listing the host's links the
+// same way.
+func checkBridging() privproto.Check {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return checkFailed("bridging",
+			fmt.Sprintf("listing links over netlink: %v", err),
+			"Make sure the kernel supports netlink (CONFIG_NETLINK), and "+
+				"that hil-vpn-privop isn't confined in a way which prevents "+
+				"using it.")
+	}
+	return checkOK("bridging", fmt.Sprintf("netlink is available (%d links)", len(links)))
+}
+
+// Check that there are bridges for vpns to join, or, if we create them on
+// demand, that the trunk nic exists. In BridgeOVS mode, this checks that we
+// can reach ovsdb-server, and that the bridge exists there.
+func checkBridges() privproto.Check {
+	cfg, err := loadConfig()
+	if err != nil {
+		// checkServiceManager reports this.
+		return checkFailed("bridges", "could not load config", "See the config check.")
+	}
+	if cfg.BridgeMode == BridgeOVS {
+		ovs := bridge.OVS{Bridge: cfg.VlanBridge, Socket: cfg.OvsdbSocket}
+		if err = ovs.Check(); err != nil {
+			return checkFailed("bridges", err.Error(),
+				"Make sure Open vSwitch is running, that ovsdb_socket in "+
+					configPath+" is the path to ovsdb-server's socket, and "+
+					"that vlan_bridge names an existing Open vSwitch bridge.")
+		}
+		return checkOK("bridges", "using Open vSwitch bridge "+cfg.VlanBridge)
+	}
+	if cfg.TrunkNic != "" {
+		if _, err = net.InterfaceByName(cfg.TrunkNic); err != nil {
+			return checkFailed("bridges",
+				fmt.Sprintf("trunk nic %s: %v", cfg.TrunkNic, err),
+				"Set trunk_nic in "+configPath+" to the nic which carries the vlans.")
+		}
+		return checkOK("bridges", "bridges are created on demand on "+cfg.TrunkNic)
+	}
+	if cfg.BridgeMode == BridgeVlanFiltering {
+		if _, err = net.InterfaceByName(cfg.VlanBridge); err != nil {
+			return checkFailed("bridges",
+				fmt.Sprintf("vlan-filtering bridge %s: %v", cfg.VlanBridge, err),
+				"Create the bridge, with vlan filtering enabled, or set "+
+					"trunk_nic in "+configPath+" to have it created on demand.")
+		}
+		return checkOK("bridges", "using vlan-filtering bridge "+cfg.VlanBridge)
+	}
+	bridges, err := findBridges(cfg.BridgeName)
+	if err != nil {
+		return checkFailed("bridges", err.Error(),
+			"Make sure "+sysClassNet+" is readable.")
+	}
+	if len(bridges) == 0 {
+		return checkFailed("bridges",
+			fmt.Sprintf("no %s bridges exist",
+				strings.Replace(cfg.BridgeName, bridge.VlanPlaceholder, "<N>", -1)),
+			"Create a bridge for each vlan, e.g. with create-bridges.sh, "+
+				"set bridge_name in "+configPath+" to match the names of "+
+				"existing bridges, or set trunk_nic to have them created "+
+				"on demand.")
+	}
+	detail := fmt.Sprintf("found %d bridges", len(bridges))
+	if len(bridges) <= 3 {
+		detail += " (" + strings.Join(bridges, ", ") + ")"
+	}
+	return checkOK("bridges", detail)
+}
+
+// Return the names of the devices which are named like the vlans' bridges,
+// per the bridge name template `tpl` (see bridge.NameFrom).
+func findBridges(tpl string) ([]string, error) {
+	// The template can't contain any regexp metacharacters; see
+	// bridge.CheckNameTemplate.
+	nameRe := regexp.MustCompile("^" +
+		strings.Replace(tpl, bridge.VlanPlaceholder, "[0-9]{1,4}", -1) + "$")
+	devs, err := ioutil.ReadDir(sysClassNet)
+	if err != nil {
+		return nil, err
+	}
+	bridges := []string{}
+	for _, dev := range devs {
+		if nameRe.MatchString(dev.Name()) {
+			bridges = append(bridges, dev.Name())
+		}
+	}
+	return bridges, nil
+}
+
+// Check that this host can carry vxlan networks, if they are configured;
+// see bridge.Vxlan.Check.
+func checkVxlan() privproto.Check {
+	cfg, err := loadConfig()
+	if err != nil {
+		return checkFailed("vxlan", "could not load config", "See the config check.")
+	}
+	if cfg.VxlanLocal == "" {
+		return checkOK("vxlan", "vxlan networks are not configured")
+	}
+	if err = cfg.vxlan().Check(); err != nil {
+		return checkFailed("vxlan", err.Error(),
+			"Set vxlan_local in "+configPath+" to one of this host's "+
+				"addresses, and vxlan_nic (if set) to an existing nic.")
+	}
+	return checkOK("vxlan", "vxlan tunnel endpoint is "+cfg.VxlanLocal)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Run the test binary as hil-vpn-privop with the arguments `args`, with
+// its config and lock directories in `dir` (see TestMain). Return its
+// output, and its error, e.g. an *exec.ExitError if it exits non-zero.
+func runMain(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "HIL_VPN_PRIVOP_TEST_MAIN=1",
+		"HIL_VPN_PRIVOP_TEST_DIR="+dir)
+	return cmd.Output()
+}
+
+// Failed checks make preflight exit non-zero, in --json mode too, which is
+// how hil-vpnd and the serve socket run it.
+func TestPreflightExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The config dir doesn't exist, so at least that check fails:
+	for _, args := range [][]string{{"preflight"}, {"--json", "preflight"}} {
+		out, err := runMain(dir, args...)
+		if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+			t.Fatalf("%v: expected exit status 1, but got %v", args, err)
+		}
+		if args[0] != "--json" {
+			continue
+		}
+		var resp privproto.Response
+		if err = json.Unmarshal(out, &resp); err != nil {
+			t.Fatalf("Decoding output %q: %v", out, err)
+		}
+		for _, c := range resp.Checks {
+			if c.Name == "config-dir" && c.OK {
+				t.Fatal("The config-dir check passed without a config dir.")
+			}
+		}
+	}
+}
+
+// Test that findBridges finds exactly the devices named per the template.
+func TestFindBridges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSysClassNet := sysClassNet
+	sysClassNet = dir
+	defer func() { sysClassNet = oldSysClassNet }()
+
+	devs := []string{
+		"br-vlan100", "br-vlan4094", "br-vlanfoo", "br-vlan12345", "br-vlan7x",
+		"lo", "eth0", "vlan100-br", "vlan7-br", "vlan-br",
+	}
+	for _, dev := range devs {
+		if err = os.Mkdir(dir+"/"+dev, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := map[string][]string{
+		"br-vlan{vlan}": {"br-vlan100", "br-vlan4094"},
+		"vlan{vlan}-br": {"vlan100-br", "vlan7-br"},
+		"nope{vlan}":    {},
+	}
+	for tpl, expected := range cases {
+		bridges, err := findBridges(tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(bridges)
+		if !reflect.DeepEqual(bridges, expected) {
+			t.Errorf("findBridges(%q) = %v, but expected %v", tpl, bridges, expected)
+		}
+	}
+}
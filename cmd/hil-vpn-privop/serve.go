@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// This file implements the 'serve' subcommand, which runs hil-vpn-privop as
+// a long-lived service listening on a unix socket. This avoids the overhead
+// of invoking sudo for every operation. See the privproto package for the
+// protocol.
+//
+// Each request is carried out by running hil-vpn-privop itself with the
+// corresponding subcommand, exactly as if it had been invoked via sudo; this
+// way, both modes share the same argument validation, locking and error
+// handling.
+
+// Default location of the socket.
+var defaultSocketPath = staticconfig.Runstatedir + "/hil-vpn-privop.sock"
+
+// Bounds on how long to wait before accepting again after Accept fails.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Get the credentials of the peer of a connection; a variable so tests can
+// pretend to be someone else.
+var getPeerCred = peerCred
+
+// Implement the 'serve' subcommand. Listen on the unix socket at
+// `socketPath`, accepting requests only from root and the user `allowUser`
+// (a user name or numeric uid).
+func serveCmd(socketPath, allowUser string) {
+	allowUid, err := lookupUid(allowUser)
+	chkfatal("Looking up user "+allowUser, err)
+	self, err := os.Executable()
+	chkfatal("Finding hil-vpn-privop executable", err)
+
+	// Clean up a socket left behind by a previous instance. We check the
+	// type first, so a misconfiguration can't make us delete something
+	// important.
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			chkfatal("Removing stale socket",
+				fmt.Errorf("%s exists and is not a socket", socketPath))
+		}
+		chkfatal("Removing stale socket", os.Remove(socketPath))
+	}
+
+	// Create the socket with restrictive permissions, then hand it to the
+	// allowed user. This is defense in depth; we check each peer's
+	// credentials regardless.
+	oldMask := unix.Umask(0077)
+	l, err := net.Listen("unix", socketPath)
+	unix.Umask(oldMask)
+	chkfatal("Listening on "+socketPath, err)
+	defer l.Close()
+	chkfatal("Setting socket ownership", os.Chown(socketPath, int(allowUid), -1))
+
+	log.Printf("Listening on %s; accepting requests from uid %d", socketPath, allowUid)
+	go bootVpns(self)
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Most likely we've run out of file descriptors, which
+			// will pass once some connections finish; back off
+			// rather than spinning, or exiting and taking every
+			// in-flight request down with us.
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("Accepting connection: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go handleConn(conn.(*net.UnixConn), self, allowUid)
+	}
+}
+
+// Start the vpns which are enabled, by running the boot subcommand, so that
+// hosts which run us as a service at boot needn't run it separately.
+// Starting a vpn which is already running does nothing, so this is harmless
+// when we are merely restarted.
+func bootVpns(self string) {
+	out, err := exec.Command(self, "boot").CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("Starting enabled vpns:\n%s", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		log.Println("Starting enabled vpns:", err)
+	}
+}
+
+// Handle a single client connection.
+func handleConn(conn *net.UnixConn, self string, allowUid uint32) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+
+	cred, err := getPeerCred(conn)
+	if err != nil {
+		log.Println("Getting peer credentials:", err)
+		return
+	}
+	if cred.Uid != 0 && cred.Uid != allowUid {
+		log.Printf("Rejecting connection from uid %d (pid %d)", cred.Uid, cred.Pid)
+		enc.Encode(errorResponse(privproto.ErrPermissionDenied, "Permission denied"))
+		return
+	}
+
+	var req privproto.Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		enc.Encode(errorResponse(privproto.ErrInvalidArgument, "Invalid request: "+err.Error()))
+		return
+	}
+	if req.Op == privproto.OpWatch {
+		streamRequest(conn, self, req)
+		return
+	}
+	if err := enc.Encode(runRequest(self, req)); err != nil {
+		log.Println("Writing response:", err)
+	}
+}
+
+// Carry out the request by running hil-vpn-privop (whose path is `self`)
+// with the corresponding subcommand, in --json mode.
+func runRequest(self string, req privproto.Request) privproto.Response {
+	args, err := req.Args()
+	if err != nil {
+		return errorResponse(errorCode(err), err.Error())
+	}
+	input, err := req.Input()
+	if err != nil {
+		return errorResponse(privproto.ErrInvalidArgument, err.Error())
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(self, append([]string{"--json"}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	runErr := cmd.Run()
+	var resp privproto.Response
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		// This shouldn't happen, but if it does, the best we can do is
+		// pass along whatever the command said.
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" && runErr != nil {
+			msg = runErr.Error()
+		} else if msg == "" {
+			msg = "Decoding output: " + err.Error()
+		}
+		return errorResponse(privproto.ErrInternal, msg)
+	}
+	return resp
+}
+
+// Carry out a request which streams its results (i.e. watch), by running
+// hil-vpn-privop with its output going straight to the client, until
+// either it exits or the client hangs up.
+func streamRequest(conn *net.UnixConn, self string, req privproto.Request) {
+	args, err := req.Args()
+	if err != nil {
+		json.NewEncoder(conn).Encode(errorResponse(errorCode(err), err.Error()))
+		return
+	}
+	cmd := exec.Command(self, append([]string{"--json"}, args...)...)
+	cmd.Stdout = conn
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		json.NewEncoder(conn).Encode(errorResponse(privproto.ErrInternal, err.Error()))
+		return
+	}
+	// The client doesn't send anything more, so a read only returns when
+	// it hangs up. The command would notice that itself the next time it
+	// wrote something, but that could be a long time coming.
+	go func() {
+		conn.Read(make([]byte, 1))
+		cmd.Process.Kill()
+	}()
+	cmd.Wait()
+}
+
+// Return a Response reporting an error with the given code and message.
+func errorResponse(code, msg string) privproto.Response {
+	return privproto.Response{
+		Error: &privproto.Error{Code: code, Message: msg},
+	}
+}
+
+// Get the credentials of the process on the other end of `conn`.
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// Look up the uid of `name`, which may be a user name or a numeric uid.
+func lookupUid(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
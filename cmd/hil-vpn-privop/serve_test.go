@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Connect to a fresh server connection, handled by handleConn, as if from a
+// peer with the uid `peerUid`, with only `allowUid` (and root) allowed in.
+// Send `request`, and return the server's response.
+func serveOnce(t *testing.T, peerUid, allowUid uint32, request string) privproto.Response {
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-serve-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldGetPeerCred := getPeerCred
+	getPeerCred = func(*net.UnixConn) (*unix.Ucred, error) {
+		return &unix.Ucred{Pid: 1, Uid: peerUid, Gid: peerUid}, nil
+	}
+	defer func() { getPeerCred = oldGetPeerCred }()
+
+	l, err := net.Listen("unix", dir+"/sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handleConn(conn.(*net.UnixConn), "/nonexistent", allowUid)
+	}()
+
+	conn, err := net.Dial("unix", dir+"/sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A peer which is turned away may find the connection closed before
+	// it has finished writing, so a failed write is fine; the response is
+	// what matters:
+	conn.Write([]byte(request))
+	var resp privproto.Response
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return resp
+}
+
+// Peers other than root and the allowed user are turned away before their
+// requests are even read.
+func TestServeRejectsPeer(t *testing.T) {
+	resp := serveOnce(t, 1234, 1000, "garbage")
+	if resp.Error == nil || resp.Error.Code != privproto.ErrPermissionDenied {
+		t.Fatalf("Expected %s, but got %+v", privproto.ErrPermissionDenied, resp.Error)
+	}
+
+	// ...whereas the allowed user and root get as far as having their
+	// (here invalid) requests parsed:
+	for _, uid := range []uint32{1000, 0} {
+		resp = serveOnce(t, uid, 1000, "garbage")
+		if resp.Error == nil || resp.Error.Code != privproto.ErrInvalidArgument {
+			t.Fatalf("Expected %s for uid %d, but got %+v",
+				privproto.ErrInvalidArgument, uid, resp.Error)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// This file defines the interface through which the start, stop and delete
+// subcommands manage the vpns' openvpn instances, and its implementation
+// in terms of systemd. The service manager is chosen in the config file;
+// see also supervisor.go, for hosts without systemd.
+
+// A serviceManager runs the openvpn instance for each vpn.
+type serviceManager interface {
+	// Start the named vpn, and arrange for it to be restarted if it
+	// fails, and (where supported) started at boot. Waits until openvpn
+	// has started. Starting a vpn which is already running is not an
+	// error.
+	start(vpnName string) error
+
+	// Stop the named vpn, undoing the effects of start. Waits until
+	// openvpn has exited. Stopping a vpn which isn't running is not an
+	// error.
+	stop(vpnName string) error
+
+	// Report whether the named vpn may be running. `state` describes its
+	// state, for use in error messages.
+	running(vpnName string) (running bool, state string, err error)
+
+	// Send an event to `events` with the current state of each vpn, and
+	// then another whenever a vpn's state changes, until something goes
+	// wrong.
+	watch(events chan<- privproto.Event) error
+
+	// Release any resources held by the manager.
+	Close()
+}
+
+// The available service managers, by the name used in the config file.
+var serviceManagers = map[string]func() (serviceManager, error){
+	"systemd": func() (serviceManager, error) {
+		sd, err := connectSystemd()
+		if err != nil {
+			return nil, err
+		}
+		return systemdServices{sd}, nil
+	},
+	"supervisor": func() (serviceManager, error) {
+		return supervisorServices{}, nil
+	},
+}
+
+// Return the service manager selected in the config file.
+func connectServices() (serviceManager, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	connect, ok := serviceManagers[cfg.ServiceManager]
+	if !ok {
+		panic(fmt.Sprintf("BUG: unknown service manager %q", cfg.ServiceManager))
+	}
+	return connect()
+}
+
+// A serviceManager which runs each vpn as an instance of openvpn's systemd
+// template unit.
+type systemdServices struct {
+	sd *systemdConn
+}
+
+func (s systemdServices) start(vpnName string) error {
+	unit := getUnitName(vpnName)
+	if err := s.sd.enableUnit(unit); err != nil {
+		return err
+	}
+	return s.sd.startUnit(unit)
+}
+
+func (s systemdServices) stop(vpnName string) error {
+	unit := getUnitName(vpnName)
+	if err := s.sd.disableUnit(unit); err != nil {
+		return err
+	}
+	return s.sd.stopUnit(unit)
+}
+
+func (s systemdServices) running(vpnName string) (bool, string, error) {
+	state, err := s.sd.activeState(getUnitName(vpnName))
+	if err != nil {
+		return false, "", err
+	}
+	return isActiveState(state), state, nil
+}
+
+func (s systemdServices) Close() {
+	s.sd.Close()
+}
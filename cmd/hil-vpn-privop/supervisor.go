@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// This file implements a serviceManager for hosts which don't run systemd.
+// Each vpn's openvpn instance is run by a supervisor: a copy of
+// hil-vpn-privop running the (internal) 'supervise' subcommand, which runs
+// openvpn and restarts it if it fails, much as systemd would. The start
+// subcommand spawns the supervisor, records its pid in a pidfile in
+// supervisorDir, and waits for it to report whether openvpn started; the
+// stop subcommand signals it to shut down.
+//
+// The pidfiles live under Runstatedir, so they don't survive a reboot.
+// Instead, start also enables the vpn, as systemd would, by leaving a file
+// next to its config (see getEnabledPath); the boot subcommand starts the
+// enabled vpns again.
+
+// The directory in which we keep the supervisors' pidfiles and logs.
+var supervisorDir = staticconfig.Runstatedir + "/hil-vpn/supervisor"
+
+// Return the command line with which to run openvpn for the named vpn. This
+// is a variable so that tests can substitute something else.
+var openvpnCommand = func(vpnName string) []string {
+	return []string{"openvpn", "--cd", configDir, "--config", getCfgPath(vpnName)}
+}
+
+var (
+	// How long openvpn must run for, after it is first started, before we
+	// consider it to have started successfully.
+	supervisorStartGrace = 2 * time.Second
+
+	// How long to wait for a supervisor to exit when stopping a vpn,
+	// before killing it.
+	supervisorStopTimeout = 90 * time.Second
+
+	// How long to wait before restarting openvpn after it fails. This
+	// doubles with each consecutive failure, up to maxRestartDelay. Once
+	// openvpn has stayed up for longer than maxRestartDelay, it is reset.
+	restartDelay    = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// How often to check whether a supervisor has exited, while stopping it.
+const supervisorPollInterval = 50 * time.Millisecond
+
+// The message a supervisor sends on its status pipe once openvpn has
+// started.
+const supervisorReady = "ready"
+
+// The fd on which a supervisor inherits its status pipe.
+const supervisorStatusFd = 3
+
+// Get the path to the named vpn's supervisor's pidfile.
+func getPidPath(vpnName string) string {
+	return supervisorDir + "/" + vpnName + ".pid"
+}
+
+// Get the path to the file to which the named vpn's supervisor, and
+// openvpn, write their logs.
+func getLogPath(vpnName string) string {
+	return supervisorDir + "/" + vpnName + ".log"
+}
+
+// Get the path to the file in which the named vpn's supervisor records the
+// state of openvpn; see writeSupervisorState.
+func getStatePath(vpnName string) string {
+	return supervisorDir + "/" + vpnName + ".state"
+}
+
+// Get the path to the file whose presence marks the named vpn as enabled,
+// i.e. to be started at boot.
+func getEnabledPath(vpnName string) string {
+	return configDir + "/hil-vpn-" + vpnName + ".enabled"
+}
+
+var enabledFileRe = regexp.MustCompile("^hil-vpn-([-_a-zA-Z0-9]+).enabled$")
+
+// Return the names of the vpns which are enabled; see bootCmd.
+func enabledVpns() []string {
+	names := []string{}
+	for _, fi := range scanConfigDir() {
+		if matches := enabledFileRe.FindStringSubmatch(fi.Name()); matches != nil {
+			names = append(names, matches[1])
+		}
+	}
+	return names
+}
+
+// Record whether the named vpn is enabled.
+func setEnabled(vpnName string, enabled bool) error {
+	defer lockConfigDir(unix.LOCK_EX).release()
+	if enabled {
+		return writeFileAtomic(getEnabledPath(vpnName), nil, 0600, true)
+	}
+	err := os.Remove(getEnabledPath(vpnName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return syncDir(configDir)
+}
+
+// A serviceManager which runs openvpn itself.
+type supervisorServices struct{}
+
+func (supervisorServices) start(vpnName string) error {
+	// As with systemd, the vpn stays enabled even if it fails to start.
+	if err := setEnabled(vpnName, true); err != nil {
+		return err
+	}
+	pid, err := supervisorPid(vpnName)
+	if err != nil || pid != 0 {
+		return err
+	}
+	if err = ensurePrivateDir(supervisorDir); err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logPath := getLogPath(vpnName)
+	logFile, err := os.OpenFile(logPath,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer statusR.Close()
+
+	cmd := exec.Command(self, "supervise", vpnName)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{statusW}
+	// Put the supervisor in its own session, so that it (and openvpn)
+	// aren't affected by signals sent to ours, and so that we can kill
+	// them both if need be; see stop.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	statusW.Close()
+	if err != nil {
+		return fmt.Errorf("Starting supervisor: %v", err)
+	}
+	pidData := []byte(strconv.Itoa(cmd.Process.Pid) + "\n")
+	if err = writeFileAtomic(getPidPath(vpnName), pidData, 0600, true); err != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+		return fmt.Errorf("Writing pidfile: %v", err)
+	}
+
+	// The supervisor reports whether openvpn started, then closes the
+	// pipe. If it dies, we just see the pipe close.
+	status, _ := bufio.NewReader(statusR).ReadString('\n')
+	if msg := strings.TrimSpace(status); msg != supervisorReady {
+		cmd.Wait()
+		os.Remove(getPidPath(vpnName))
+		if msg == "" {
+			msg = "supervisor exited unexpectedly"
+		}
+		return fmt.Errorf("Starting %s: %s; see %s for details", vpnName, msg, logPath)
+	}
+	// Reap the supervisor, should it exit while we're still running:
+	go cmd.Wait()
+	return nil
+}
+
+func (supervisorServices) stop(vpnName string) error {
+	if err := setEnabled(vpnName, false); err != nil {
+		return err
+	}
+	pid, err := supervisorPid(vpnName)
+	if err != nil {
+		return err
+	}
+	if pid != 0 {
+		if err = syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("Signalling supervisor (pid %d): %v", pid, err)
+		}
+		if !waitSupervisorExit(pid, vpnName, supervisorStopTimeout) {
+			log.Printf("Supervisor for %s (pid %d) did not exit after %v; killing it.",
+				vpnName, pid, supervisorStopTimeout)
+			syscall.Kill(-pid, syscall.SIGKILL)
+			if !waitSupervisorExit(pid, vpnName, supervisorStopTimeout) {
+				return fmt.Errorf("Stopping %s: supervisor (pid %d) did not exit",
+					vpnName, pid)
+			}
+		}
+	}
+	os.Remove(getStatePath(vpnName))
+	if err = os.Remove(getPidPath(vpnName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (supervisorServices) running(vpnName string) (bool, string, error) {
+	pid, err := supervisorPid(vpnName)
+	if err != nil {
+		return false, "", err
+	}
+	if pid == 0 {
+		return false, "inactive", nil
+	}
+	return true, fmt.Sprintf("supervised by pid %d", pid), nil
+}
+
+func (supervisorServices) Close() {}
+
+// Return the pid of the named vpn's supervisor, or 0 if it isn't running.
+func supervisorPid(vpnName string) (int, error) {
+	data, err := ioutil.ReadFile(getPidPath(vpnName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("Invalid pidfile %s", getPidPath(vpnName))
+	}
+	if !isSupervisor(pid, vpnName) {
+		// The pidfile is stale; e.g. the supervisor was killed, or gave
+		// up after openvpn exited cleanly.
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// Report whether `pid` is a running supervisor for the named vpn. We check
+// its command line, rather than just that it exists, since the pid may
+// have been reused.
+func isSupervisor(pid int, vpnName string) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	// Arguments are NUL-terminated; zombies have no arguments at all.
+	args := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	n := len(args)
+	return n >= 2 && args[n-2] == "supervise" && args[n-1] == vpnName
+}
+
+// Wait up to `timeout` for the supervisor `pid` to exit, returning whether
+// it did.
+func waitSupervisorExit(pid int, vpnName string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for isSupervisor(pid, vpnName) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(supervisorPollInterval)
+	}
+	return true
+}
+
+// Implement the internal 'supervise' subcommand: run openvpn for the named
+// vpn until we receive SIGTERM, restarting it if it fails. Once openvpn has
+// started (or failed to), report the outcome on our status pipe; if it
+// fails before then, give up.
+func superviseCmd(vpnName string) {
+	// Keep openvpn from inheriting the status pipe, which would stop the
+	// start subcommand from seeing it close if we die.
+	syscall.CloseOnExec(supervisorStatusFd)
+	status := os.NewFile(supervisorStatusFd, "status")
+	report := func(msg string) {
+		if status != nil {
+			fmt.Fprintln(status, msg)
+			status.Close()
+			status = nil
+		}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	delay := restartDelay
+
+	for {
+		args := openvpnCommand(vpnName)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		started := time.Now()
+		err := cmd.Start()
+		if err == nil {
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			err = superviseRun(cmd, exited, sigs, func() {
+				log.Printf("openvpn for %s started (pid %d)", vpnName, cmd.Process.Pid)
+				writeSupervisorState(vpnName, "active", "")
+				report(supervisorReady)
+			})
+		}
+		if err == nil {
+			// Either we were asked to stop, or openvpn exited
+			// cleanly; systemd doesn't restart it in the latter case
+			// either.
+			report("openvpn exited before it finished starting")
+			log.Printf("Supervisor for %s exiting.", vpnName)
+			os.Remove(getStatePath(vpnName))
+			os.Exit(0)
+		}
+		log.Printf("openvpn for %s failed: %v", vpnName, err)
+		if status != nil {
+			report(fmt.Sprintf("openvpn failed to start: %v", err))
+			os.Exit(1)
+		}
+
+		if time.Since(started) > maxRestartDelay {
+			delay = restartDelay
+		}
+		log.Printf("Restarting openvpn for %s in %v.", vpnName, delay)
+		writeSupervisorState(vpnName, "activating", exitResult(err))
+		select {
+		case <-time.After(delay):
+		case <-sigs:
+			log.Printf("Supervisor for %s exiting.", vpnName)
+			os.Remove(getStatePath(vpnName))
+			os.Exit(0)
+		}
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// Wait for a running openvpn, `cmd`, to exit, or for us to be signalled
+// to stop, in which case we pass the signal on to openvpn and wait for it
+// to exit. Returns nil if openvpn exited cleanly or was stopped, otherwise
+// the reason it failed. `ready` is called once it has been running for
+// supervisorStartGrace.
+func superviseRun(cmd *exec.Cmd, exited <-chan error, sigs <-chan os.Signal, ready func()) error {
+	grace := time.After(supervisorStartGrace)
+	for {
+		select {
+		case <-grace:
+			grace = nil
+			ready()
+		case sig := <-sigs:
+			cmd.Process.Signal(sig)
+			<-exited
+			return nil
+		case err := <-exited:
+			return err
+		}
+	}
+}
+
+// Describe how openvpn failed, given the error from waiting for it, in the
+// terms systemd uses for a service's Result.
+func exitResult(err error) string {
+	if e, ok := err.(*exec.ExitError); ok {
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return "signal"
+		}
+		return "exit-code"
+	}
+	return "resources"
+}
+
+// Record the state of the named vpn's openvpn instance, as reported by the
+// watch subcommand: "active", or "activating" while waiting to restart it,
+// in which case `result` says why it failed.
+func writeSupervisorState(vpnName, state, result string) {
+	data := []byte(strings.TrimSpace(state+" "+result) + "\n")
+	if err := writeFileAtomic(getStatePath(vpnName), data, 0600, true); err != nil {
+		log.Printf("Recording state of %s: %v", vpnName, err)
+	}
+}
+
+// Return an event describing the current state of the named vpn's openvpn
+// instance.
+func supervisorEvent(vpnName string) privproto.Event {
+	ev := privproto.Event{Vpn: vpnName, State: "inactive"}
+	if pid, err := supervisorPid(vpnName); err != nil || pid == 0 {
+		return ev
+	}
+	data, err := ioutil.ReadFile(getStatePath(vpnName))
+	fields := strings.Fields(string(data))
+	if err != nil || len(fields) == 0 {
+		// The supervisor hasn't got as far as recording anything.
+		ev.State = "activating"
+		return ev
+	}
+	ev.State = fields[0]
+	if len(fields) > 1 {
+		ev.Result = fields[1]
+	}
+	return ev
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The supervisor runs as a separate process, which supervisorServices
+// starts by re-running our own executable; in tests, that is the test
+// binary. When it is run that way, TestMain runs the supervisor instead of
+// the tests, with a shell script standing in for openvpn.
+//
+// The script records its pid in $HIL_VPN_PRIVOP_TEST_DIR/<vpn>.openvpn,
+// then runs until it is killed, except for vpns whose names start with
+// "fail", for which it exits immediately with an error.
+//
+// Tests may also run the test binary as hil-vpn-privop itself, by setting
+// $HIL_VPN_PRIVOP_TEST_MAIN; see runMain.
+const fakeOpenvpn = `
+case "$1" in
+fail*)
+	echo "fake openvpn: bad config" >&2
+	exit 1
+	;;
+esac
+echo $$ > "$HIL_VPN_PRIVOP_TEST_DIR/$1.openvpn"
+exec sleep 1000
+`
+
+func TestMain(m *testing.M) {
+	if os.Getenv("HIL_VPN_PRIVOP_TEST_SUPERVISE") != "" {
+		openvpnCommand = func(vpnName string) []string {
+			return []string{"/bin/sh", "-c", fakeOpenvpn, "sh", vpnName}
+		}
+		supervisorDir = os.Getenv("HIL_VPN_PRIVOP_TEST_DIR") + "/supervisor"
+		supervisorStartGrace = 100 * time.Millisecond
+		restartDelay = 50 * time.Millisecond
+		superviseCmd(os.Args[len(os.Args)-1])
+	}
+	if os.Getenv("HIL_VPN_PRIVOP_TEST_MAIN") != "" {
+		dir := os.Getenv("HIL_VPN_PRIVOP_TEST_DIR")
+		configDir, lockDir = dir+"/config", dir+"/locks"
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Return the pid of the fake openvpn most recently started for the named
+// vpn.
+func fakeOpenvpnPid(t *testing.T, dir, vpnName string) int {
+	data, err := ioutil.ReadFile(dir + "/" + vpnName + ".openvpn")
+	if err != nil {
+		t.Fatal("Reading fake openvpn's pid:", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal("Parsing fake openvpn's pid:", err)
+	}
+	return pid
+}
+
+// Report whether the process `pid` exists.
+func processExists(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// Check that the supervisor reports the named vpn as running, or not.
+func checkSupervisorRunning(t *testing.T, s supervisorServices, vpnName string, expected bool) {
+	running, state, err := s.running(vpnName)
+	if err != nil {
+		t.Fatal("Checking whether vpn is running:", err)
+	}
+	if running != expected {
+		t.Fatalf("Expected running = %v for %s, but got %v (%s).",
+			expected, vpnName, running, state)
+	}
+}
+
+// Check that the state reported for the named vpn by watch is `state`.
+func checkSupervisorEvent(t *testing.T, vpnName, state string) {
+	if ev := supervisorEvent(vpnName); ev.State != state {
+		t.Fatalf("Expected state %q for %s, but got %+v.", state, vpnName, ev)
+	}
+}
+
+// Test starting and stopping vpns, and restarting openvpn when it dies.
+func TestSupervisor(t *testing.T) {
+	setupConfigDir(t)
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSupervisorDir := supervisorDir
+	supervisorDir = dir + "/supervisor"
+	defer func() { supervisorDir = oldSupervisorDir }()
+	os.Setenv("HIL_VPN_PRIVOP_TEST_SUPERVISE", "1")
+	os.Setenv("HIL_VPN_PRIVOP_TEST_DIR", dir)
+	defer os.Unsetenv("HIL_VPN_PRIVOP_TEST_SUPERVISE")
+	defer os.Unsetenv("HIL_VPN_PRIVOP_TEST_DIR")
+
+	s := supervisorServices{}
+	checkSupervisorRunning(t, s, "vpn-a", false)
+	if err = s.start("vpn-a"); err != nil {
+		t.Fatal("Starting vpn:", err)
+	}
+	defer s.stop("vpn-a")
+	checkSupervisorRunning(t, s, "vpn-a", true)
+	checkSupervisorEvent(t, "vpn-a", "active")
+	supervisor, _ := supervisorPid("vpn-a")
+	openvpn := fakeOpenvpnPid(t, dir, "vpn-a")
+
+	// Starting a running vpn does nothing:
+	if err = s.start("vpn-a"); err != nil {
+		t.Fatal("Starting running vpn:", err)
+	}
+	if pid, _ := supervisorPid("vpn-a"); pid != supervisor {
+		t.Fatalf("Supervisor pid changed from %d to %d.", supervisor, pid)
+	}
+
+	// If openvpn dies, it should be restarted:
+	syscall.Kill(openvpn, syscall.SIGKILL)
+	deadline := time.Now().Add(5 * time.Second)
+	for fakeOpenvpnPid(t, dir, "vpn-a") == openvpn {
+		if time.Now().After(deadline) {
+			t.Fatal("openvpn was not restarted.")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	checkSupervisorRunning(t, s, "vpn-a", true)
+	openvpn = fakeOpenvpnPid(t, dir, "vpn-a")
+
+	if err = s.stop("vpn-a"); err != nil {
+		t.Fatal("Stopping vpn:", err)
+	}
+	checkSupervisorRunning(t, s, "vpn-a", false)
+	checkSupervisorEvent(t, "vpn-a", "inactive")
+	if processExists(openvpn) {
+		t.Fatal("openvpn is still running after stopping the vpn.")
+	}
+	if _, err = os.Stat(getPidPath("vpn-a")); !os.IsNotExist(err) {
+		t.Fatal("Pidfile was not removed:", err)
+	}
+	if _, err = os.Stat(getEnabledPath("vpn-a")); !os.IsNotExist(err) {
+		t.Fatal("vpn is still enabled:", err)
+	}
+
+	// Stopping a stopped vpn does nothing:
+	if err = s.stop("vpn-a"); err != nil {
+		t.Fatal("Stopping stopped vpn:", err)
+	}
+}
+
+// Test that a failure to start openvpn is reported, and points at the log.
+func TestSupervisorStartFailed(t *testing.T) {
+	setupConfigDir(t)
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSupervisorDir := supervisorDir
+	supervisorDir = dir + "/supervisor"
+	defer func() { supervisorDir = oldSupervisorDir }()
+	os.Setenv("HIL_VPN_PRIVOP_TEST_SUPERVISE", "1")
+	os.Setenv("HIL_VPN_PRIVOP_TEST_DIR", dir)
+	defer os.Unsetenv("HIL_VPN_PRIVOP_TEST_SUPERVISE")
+	defer os.Unsetenv("HIL_VPN_PRIVOP_TEST_DIR")
+
+	s := supervisorServices{}
+	err = s.start("fail-a")
+	if err == nil || !strings.Contains(err.Error(), getLogPath("fail-a")) {
+		t.Fatalf("Expected an error referring to the log, but got %v", err)
+	}
+	checkSupervisorRunning(t, s, "fail-a", false)
+	log, err := ioutil.ReadFile(getLogPath("fail-a"))
+	if err != nil || !strings.Contains(string(log), "fake openvpn: bad config") {
+		t.Fatalf("openvpn's output is missing from the log (%v): %q", err, log)
+	}
+}
+
+// Test that the vpns which were started, and not since stopped, are started
+// again by the boot subcommand after the host reboots.
+func TestSupervisorBoot(t *testing.T) {
+	setupRender(t)
+	setupConfigDir(t)
+	oldConfigPath, oldServiceManager := configPath, defaultConfig.ServiceManager
+	configPath = configDir + "/privop.json"
+	defaultConfig.ServiceManager = "supervisor"
+	oldSupervisorDir := supervisorDir
+	supervisorDir = configDir + "/supervisor"
+	t.Cleanup(func() {
+		configPath, defaultConfig.ServiceManager = oldConfigPath, oldServiceManager
+		supervisorDir = oldSupervisorDir
+	})
+	os.Setenv("HIL_VPN_PRIVOP_TEST_SUPERVISE", "1")
+	os.Setenv("HIL_VPN_PRIVOP_TEST_DIR", configDir)
+	defer os.Unsetenv("HIL_VPN_PRIVOP_TEST_SUPERVISE")
+	defer os.Unsetenv("HIL_VPN_PRIVOP_TEST_DIR")
+
+	// Routed vpns, so that starting them doesn't touch any bridges:
+	for _, name := range []string{"vpn-a", "vpn-b"} {
+		cfg := goldenCfg
+		cfg.Name = name
+		cfg.Key = "key"
+		cfg.setRouted(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"))
+		if err := cfg.Save(openVpnCfgTpl, &defaultConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := supervisorServices{}
+	defer s.stop("vpn-a")
+	startCmd("vpn-a")
+	startCmd("vpn-b")
+	stopCmd("vpn-b")
+
+	// Reboot: the supervisor dies, and Runstatedir is emptied.
+	pid, _ := supervisorPid("vpn-a")
+	syscall.Kill(-pid, syscall.SIGKILL)
+	if !waitSupervisorExit(pid, "vpn-a", 5*time.Second) {
+		t.Fatal("The supervisor did not die.")
+	}
+	if err := os.RemoveAll(supervisorDir); err != nil {
+		t.Fatal(err)
+	}
+	checkSupervisorRunning(t, s, "vpn-a", false)
+
+	started, err := bootCmd()
+	if err != nil {
+		t.Fatal("Booting:", err)
+	}
+	if !reflect.DeepEqual(started, []string{"vpn-a"}) {
+		t.Fatalf("Expected only vpn-a to be started, but got %v", started)
+	}
+	checkSupervisorRunning(t, s, "vpn-a", true)
+	checkSupervisorRunning(t, s, "vpn-b", false)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// This file implements the small part of systemd's D-Bus API which we use
+// to manage the vpns' openvpn services. Compared to running systemctl, this
+// lets us wait for the jobs we start and find out exactly how they ended,
+// and tell "not running" apart from a failure to ask.
+
+const (
+	systemdDest    = "org.freedesktop.systemd1"
+	systemdPath    = dbus.ObjectPath("/org/freedesktop/systemd1")
+	systemdManager = "org.freedesktop.systemd1.Manager"
+	systemdUnit    = "org.freedesktop.systemd1.Unit"
+	systemdService = "org.freedesktop.systemd1.Service"
+
+	// The error systemd returns when asked about a unit which isn't
+	// loaded.
+	systemdNoSuchUnit = "org.freedesktop.systemd1.NoSuchUnit"
+)
+
+// Connect to the bus on which systemd is listening. This is a variable so
+// that tests can point it at a private bus.
+var dialSystemd = func() (*dbus.Conn, error) {
+	return dbus.ConnectSystemBus()
+}
+
+// How long to wait for a job to finish.
+var systemdJobTimeout = 90 * time.Second
+
+// A connection to systemd.
+type systemdConn struct {
+	conn    *dbus.Conn
+	manager dbus.BusObject
+
+	// Receives the JobRemoved signals, which report that jobs have
+	// finished.
+	signals chan *dbus.Signal
+}
+
+// Connect to systemd.
+func connectSystemd() (*systemdConn, error) {
+	conn, err := dialSystemd()
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to systemd: %v", err)
+	}
+	s := &systemdConn{
+		conn:    conn,
+		manager: conn.Object(systemdDest, systemdPath),
+		signals: make(chan *dbus.Signal, 16),
+	}
+	// We have to listen for jobs finishing before we start any, or we
+	// might miss the signal.
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(systemdPath),
+		dbus.WithMatchInterface(systemdManager),
+		dbus.WithMatchMember("JobRemoved"),
+	)
+	if err == nil {
+		conn.Signal(s.signals)
+		// systemd only sends signals to clients which subscribe:
+		err = s.manager.Call(systemdManager+".Subscribe", 0).Err
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Subscribing to systemd signals: %v", err)
+	}
+	return s, nil
+}
+
+// Close the connection.
+func (s *systemdConn) Close() {
+	s.conn.Close()
+}
+
+// Start the named unit, and wait for it to finish starting.
+func (s *systemdConn) startUnit(unit string) error {
+	return s.runJob("StartUnit", unit)
+}
+
+// Stop the named unit, and wait for it to finish stopping.
+func (s *systemdConn) stopUnit(unit string) error {
+	return s.runJob("StopUnit", unit)
+}
+
+// Enable the named unit, so that it is started at boot.
+func (s *systemdConn) enableUnit(unit string) error {
+	var carriesInstallInfo bool
+	var changes []unitFileChange
+	err := s.manager.Call(systemdManager+".EnableUnitFiles", 0,
+		[]string{unit}, false, false).Store(&carriesInstallInfo, &changes)
+	if err != nil {
+		return fmt.Errorf("Enabling %s: %v", unit, err)
+	}
+	return s.reload()
+}
+
+// Disable the named unit.
+func (s *systemdConn) disableUnit(unit string) error {
+	var changes []unitFileChange
+	err := s.manager.Call(systemdManager+".DisableUnitFiles", 0,
+		[]string{unit}, false).Store(&changes)
+	if err != nil {
+		return fmt.Errorf("Disabling %s: %v", unit, err)
+	}
+	return s.reload()
+}
+
+// Return the state of the named unit's unit file, e.g. "enabled" or
+// "static". Unlike the other methods, this works for template units.
+func (s *systemdConn) unitFileState(unit string) (string, error) {
+	var state string
+	err := s.manager.Call(systemdManager+".GetUnitFileState", 0, unit).Store(&state)
+	if err != nil {
+		return "", fmt.Errorf("Getting state of %s: %v", unit, err)
+	}
+	return state, nil
+}
+
+// Return the ActiveState of the named unit, e.g. "active" or "inactive".
+// Units which systemd hasn't loaded are inactive.
+func (s *systemdConn) activeState(unit string) (string, error) {
+	var path dbus.ObjectPath
+	err := s.manager.Call(systemdManager+".GetUnit", 0, unit).Store(&path)
+	if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == systemdNoSuchUnit {
+		return "inactive", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Looking up %s: %v", unit, err)
+	}
+	v, err := s.conn.Object(systemdDest, path).GetProperty(systemdUnit + ".ActiveState")
+	if err != nil {
+		return "", fmt.Errorf("Getting state of %s: %v", unit, err)
+	}
+	state, ok := v.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("Getting state of %s: unexpected value %v", unit, v)
+	}
+	return state, nil
+}
+
+// Return the Result of the service whose unit has the object path `path`,
+// which says how it last failed (e.g. "exit-code"), or "success". Returns
+// "" if it can't be found out.
+func (s *systemdConn) serviceResult(path dbus.ObjectPath) string {
+	v, err := s.conn.Object(systemdDest, path).GetProperty(systemdService + ".Result")
+	if err != nil {
+		return ""
+	}
+	result, _ := v.Value().(string)
+	return result
+}
+
+// Report whether a unit in the given ActiveState may be running.
+func isActiveState(state string) bool {
+	return state != "inactive" && state != "failed"
+}
+
+// A change made by EnableUnitFiles or DisableUnitFiles.
+type unitFileChange struct {
+	Type        string
+	Filename    string
+	Destination string
+}
+
+// Reload systemd's configuration, as systemctl does after enabling or
+// disabling units.
+func (s *systemdConn) reload() error {
+	if err := s.manager.Call(systemdManager+".Reload", 0).Err; err != nil {
+		return fmt.Errorf("Reloading systemd: %v", err)
+	}
+	return nil
+}
+
+// Call `method` (StartUnit or StopUnit) on the named unit, and wait for
+// the resulting job to finish.
+func (s *systemdConn) runJob(method, unit string) error {
+	var job dbus.ObjectPath
+	err := s.manager.Call(systemdManager+"."+method, 0, unit, "replace").Store(&job)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, unit, err)
+	}
+	timeout := time.After(systemdJobTimeout)
+	for {
+		select {
+		case sig := <-s.signals:
+			// The body is (id, job, unit, result):
+			if sig.Name != systemdManager+".JobRemoved" || len(sig.Body) != 4 {
+				continue
+			}
+			if path, _ := sig.Body[1].(dbus.ObjectPath); path != job {
+				continue
+			}
+			result, _ := sig.Body[3].(string)
+			return jobResultError(method, unit, result)
+		case <-timeout:
+			return fmt.Errorf("%s %s: timed out after %v waiting for job %s",
+				method, unit, systemdJobTimeout, job)
+		}
+	}
+}
+
+// Return an error describing a job which finished with `result`, or nil if
+// it succeeded.
+func jobResultError(method, unit, result string) error {
+	switch result {
+	case "done":
+		return nil
+	case "failed":
+		return fmt.Errorf("%s %s: job failed; see `journalctl -u %s` for details",
+			method, unit, unit)
+	case "dependency":
+		return fmt.Errorf("%s %s: a dependency of the unit failed", method, unit)
+	default:
+		return fmt.Errorf("%s %s: job finished with result %q", method, unit, result)
+	}
+}
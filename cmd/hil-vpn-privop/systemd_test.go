@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// These tests run our systemd client against a fake systemd, on a private
+// bus run by dbus-daemon. They are skipped if dbus-daemon isn't available;
+// since hil-vpn-privop resets $PATH on startup, set $DBUS_DAEMON to its
+// path if it lives somewhere unusual.
+
+// Start a private bus, returning its address and a function which shuts
+// it down.
+func startPrivateBus(t *testing.T) (string, func()) {
+	daemon := os.Getenv("DBUS_DAEMON")
+	if daemon == "" {
+		var err error
+		daemon, err = exec.LookPath("dbus-daemon")
+		if err != nil {
+			t.Skip("dbus-daemon not found; set $DBUS_DAEMON to run this test.")
+		}
+	}
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--session", "--address=unix:path="+dir+"/bus",
+		"--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal("Starting dbus-daemon:", err)
+	}
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatal("Reading bus address:", err)
+	}
+	return strings.TrimSpace(addr), func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+// A fake systemd, implementing just enough of the Manager interface for
+// systemdConn. Its methods are called from the bus connection's goroutines,
+// so the fields below must only be accessed with the lock held, including
+// by tests (see isEnabled and setResult).
+type fakeSystemd struct {
+	sync.Mutex
+	conn *dbus.Conn
+
+	// ActiveState of each loaded unit.
+	units map[string]string
+
+	// Units which have been enabled.
+	enabled map[string]bool
+
+	// The result which jobs for each unit should finish with; "done"
+	// if unset.
+	results map[string]string
+
+	jobs int
+}
+
+func (f *fakeSystemd) Subscribe() *dbus.Error {
+	return nil
+}
+
+func (f *fakeSystemd) Reload() *dbus.Error {
+	return nil
+}
+
+func (f *fakeSystemd) StartUnit(unit, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.job(unit, "active"), nil
+}
+
+func (f *fakeSystemd) StopUnit(unit, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.job(unit, "inactive"), nil
+}
+
+// Create a job, which will set the unit's state to `state` if it
+// succeeds, and report its completion.
+func (f *fakeSystemd) job(unit, state string) dbus.ObjectPath {
+	f.Lock()
+	defer f.Unlock()
+	f.jobs++
+	id := uint32(f.jobs)
+	path := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/systemd1/job/%d", id))
+	result := f.results[unit]
+	if result == "" {
+		result = "done"
+		f.units[unit] = state
+	} else {
+		f.units[unit] = "failed"
+	}
+	state = f.units[unit]
+	unitPath := f.exportUnit(unit)
+	go func() {
+		f.conn.Emit(unitPath, "org.freedesktop.DBus.Properties.PropertiesChanged",
+			systemdUnit, map[string]dbus.Variant{"ActiveState": dbus.MakeVariant(state)},
+			[]string{})
+		f.conn.Emit(systemdPath, systemdManager+".JobRemoved", id, path, unit, result)
+	}()
+	return path
+}
+
+func (f *fakeSystemd) EnableUnitFiles(files []string, runtime, force bool) (bool, []unitFileChange, *dbus.Error) {
+	f.Lock()
+	defer f.Unlock()
+	for _, file := range files {
+		f.enabled[file] = true
+	}
+	return true, []unitFileChange{}, nil
+}
+
+func (f *fakeSystemd) DisableUnitFiles(files []string, runtime bool) ([]unitFileChange, *dbus.Error) {
+	f.Lock()
+	defer f.Unlock()
+	for _, file := range files {
+		delete(f.enabled, file)
+	}
+	return []unitFileChange{}, nil
+}
+
+func (f *fakeSystemd) GetUnitFileState(unit string) (string, *dbus.Error) {
+	if unit != getUnitName("") {
+		return "", dbus.NewError("org.freedesktop.DBus.Error.FileNotFound",
+			[]interface{}{"No such file or directory"})
+	}
+	return "static", nil
+}
+
+func (f *fakeSystemd) GetUnit(unit string) (dbus.ObjectPath, *dbus.Error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.units[unit]; !ok {
+		return "", dbus.NewError(systemdNoSuchUnit,
+			[]interface{}{"Unit " + unit + " not loaded."})
+	}
+	return f.exportUnit(unit), nil
+}
+
+// Report whether the named unit has been enabled.
+func (f *fakeSystemd) isEnabled(unit string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.enabled[unit]
+}
+
+// Make jobs for the named unit finish with `result`.
+func (f *fakeSystemd) setResult(unit, result string) {
+	f.Lock()
+	defer f.Unlock()
+	f.results[unit] = result
+}
+
+// Export an object for the named unit, returning its path.
+func (f *fakeSystemd) exportUnit(unit string) dbus.ObjectPath {
+	path := dbus.ObjectPath("/org/freedesktop/systemd1/unit/" + dbusEscape(unit))
+	f.conn.Export(fakeUnit{f, unit}, path, "org.freedesktop.DBus.Properties")
+	return path
+}
+
+// A unit object, which only supports getting its ActiveState, and the
+// Result of its service.
+type fakeUnit struct {
+	f    *fakeSystemd
+	unit string
+}
+
+func (u fakeUnit) Get(iface, prop string) (dbus.Variant, *dbus.Error) {
+	u.f.Lock()
+	defer u.f.Unlock()
+	switch {
+	case iface == systemdUnit && prop == "ActiveState":
+		return dbus.MakeVariant(u.f.units[u.unit]), nil
+	case iface == systemdService && prop == "Result":
+		if u.f.units[u.unit] == "failed" {
+			return dbus.MakeVariant("exit-code"), nil
+		}
+		return dbus.MakeVariant("success"), nil
+	default:
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property %s.%s", iface, prop))
+	}
+}
+
+// Escape `s` for use in an object path, as systemd does.
+func dbusEscape(s string) string {
+	out := ""
+	for _, c := range []byte(s) {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			out += string(c)
+		} else {
+			out += fmt.Sprintf("_%02x", c)
+		}
+	}
+	return out
+}
+
+// Start a fake systemd on a private bus, and point dialSystemd at it.
+func startFakeSystemd(t *testing.T) (*fakeSystemd, func()) {
+	addr, stopBus := startPrivateBus(t)
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		stopBus()
+		t.Fatal("Connecting to private bus:", err)
+	}
+	f := &fakeSystemd{
+		conn:    conn,
+		units:   map[string]string{},
+		enabled: map[string]bool{},
+		results: map[string]string{},
+	}
+	conn.Export(f, systemdPath, systemdManager)
+	reply, err := conn.RequestName(systemdDest, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		stopBus()
+		t.Fatal("Claiming bus name:", reply, err)
+	}
+	oldDial := dialSystemd
+	dialSystemd = func() (*dbus.Conn, error) {
+		return dbus.Connect(addr)
+	}
+	return f, func() {
+		dialSystemd = oldDial
+		conn.Close()
+		stopBus()
+	}
+}
+
+// Test starting and stopping units, and checking their state.
+func TestSystemdStartStop(t *testing.T) {
+	f, stop := startFakeSystemd(t)
+	defer stop()
+
+	sd, err := connectSystemd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	unit := getUnitName("vpn-a")
+
+	checkState := func(expected string) {
+		state, err := sd.activeState(unit)
+		if err != nil {
+			t.Fatal("Getting state:", err)
+		}
+		if state != expected {
+			t.Fatalf("Unexpected state for %s: %q (expected %q)", unit, state, expected)
+		}
+	}
+
+	// Units which aren't loaded aren't running:
+	checkState("inactive")
+
+	if err = sd.enableUnit(unit); err != nil {
+		t.Fatal("Enabling unit:", err)
+	}
+	if err = sd.startUnit(unit); err != nil {
+		t.Fatal("Starting unit:", err)
+	}
+	if !f.isEnabled(unit) {
+		t.Fatal("Unit was not enabled.")
+	}
+	checkState("active")
+	if !isActiveState("active") {
+		t.Fatal("isActiveState(\"active\") is false.")
+	}
+
+	if err = sd.disableUnit(unit); err != nil {
+		t.Fatal("Disabling unit:", err)
+	}
+	if err = sd.stopUnit(unit); err != nil {
+		t.Fatal("Stopping unit:", err)
+	}
+	if f.isEnabled(unit) {
+		t.Fatal("Unit was not disabled.")
+	}
+	checkState("inactive")
+
+	state, err := sd.unitFileState(getUnitName(""))
+	if err != nil || state != "static" {
+		t.Fatalf("Unexpected template unit state: %q, %v", state, err)
+	}
+	if _, err = sd.unitFileState("nonexistent.service"); err == nil {
+		t.Fatal("Got a state for a nonexistent unit file.")
+	}
+}
+
+// Test that failed jobs are reported as errors.
+func TestSystemdJobFailed(t *testing.T) {
+	f, stop := startFakeSystemd(t)
+	defer stop()
+
+	sd, err := connectSystemd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	unit := getUnitName("vpn-b")
+
+	f.setResult(unit, "failed")
+	err = sd.startUnit(unit)
+	if err == nil || !strings.Contains(err.Error(), "journalctl -u "+unit) {
+		t.Fatalf("Expected an error referring to the journal, but got %v", err)
+	}
+	state, err := sd.activeState(unit)
+	if err != nil {
+		t.Fatal("Getting state:", err)
+	}
+	if isActiveState(state) {
+		t.Fatalf("A failed unit (state %q) is considered active.", state)
+	}
+}
+
+// Test that watch reports the initial state of each vpn, and then changes
+// as they happen.
+func TestSystemdWatch(t *testing.T) {
+	f, stop := startFakeSystemd(t)
+	defer stop()
+	dir, err := ioutil.TempDir("", "hil-vpn-privop-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldConfigDir, oldLockDir := configDir, lockDir
+	configDir, lockDir = dir, dir+"/locks"
+	defer func() {
+		configDir, lockDir = oldConfigDir, oldLockDir
+	}()
+	if err = ioutil.WriteFile(getKeyPath("vpn-a"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := connectSystemd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	events := make(chan privproto.Event)
+	go systemdServices{watcher}.watch(events)
+	expect := func(expected privproto.Event) {
+		select {
+		case ev := <-events:
+			if ev != expected {
+				t.Fatalf("Expected event %+v, but got %+v", expected, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event %+v", expected)
+		}
+	}
+	expect(privproto.Event{Vpn: "vpn-a", State: "inactive"})
+
+	sd, err := connectSystemd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if err = sd.startUnit(getUnitName("vpn-a")); err != nil {
+		t.Fatal("Starting unit:", err)
+	}
+	expect(privproto.Event{Vpn: "vpn-a", State: "active"})
+
+	f.setResult(getUnitName("vpn-b"), "failed")
+	sd.startUnit(getUnitName("vpn-b"))
+	expect(privproto.Event{Vpn: "vpn-b", State: "failed", Result: "exit-code"})
+}
+
+func TestVpnNameFromUnitPath(t *testing.T) {
+	cases := []struct {
+		path string
+		name string
+		ok   bool
+	}{
+		{"/org/freedesktop/systemd1/unit/" + dbusEscape(getUnitName("hil_vpn_1")), "hil_vpn_1", true},
+		{"/org/freedesktop/systemd1/unit/" + dbusEscape("ssh.service"), "", false},
+		{"/org/freedesktop/systemd1/unit/" + dbusEscape(getUnitName("a/b")), "", false},
+		{"/org/freedesktop/systemd1/unit/openvpn_2", "", false},
+		{"/org/freedesktop/systemd1", "", false},
+	}
+	for _, c := range cases {
+		name, ok := vpnNameFromUnitPath(dbus.ObjectPath(c.path))
+		if ok != c.ok || (ok && name != c.name) {
+			t.Errorf("vpnNameFromUnitPath(%q) = (%q, %v), expected (%q, %v)",
+				c.path, name, ok, c.name, c.ok)
+		}
+	}
+}
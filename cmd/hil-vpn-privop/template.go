@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// This file implements loading of admin-supplied openvpn config templates.
+// If a template is installed at templatePath, it is used instead of the
+// built-in openVpnCfgTpl. Since the generated configs are run by openvpn as
+// root, we are careful about what we accept: the file must be owned by root
+// and not writable by anyone else, it must reference all of the fields we
+// need to produce a working config, and the configs it renders must not
+// contain directives which would let it run arbitrary commands, or read or
+// write arbitrary files. Since a template may render differently for
+// different vpns, the latter is checked every time a config is rendered
+// (see OpenVpnCfg.Render), not just when the template is loaded.
+
+// Path at which an admin may install a custom template.
+var templatePath = staticconfig.Sysconfdir + "/hil-vpn/openvpn.conf.tpl"
+
+// Fields which every template must reference.
+var requiredTemplateFields = []string{
+	"NewInterfaceName",
+	"Name",
+	"Port",
+	"Network",
+	"Libexecdir",
+}
+
+// Directives which may cause openvpn to execute a command. We only permit
+// these if the command is one of our own hooks.
+var hookDirectives = map[string]bool{
+	"up":                    true,
+	"down":                  true,
+	"ipchange":              true,
+	"route-up":              true,
+	"route-pre-down":        true,
+	"client-connect":        true,
+	"client-disconnect":     true,
+	"learn-address":         true,
+	"auth-user-pass-verify": true,
+	"tls-verify":            true,
+}
+
+// Programs which hook directives are permitted to run. These are looked
+// up in Libexecdir.
+var hookPrograms = map[string]bool{
+	"hil-vpn-hook": true,
+}
+
+// Directives which are never permitted in a template.
+var forbiddenDirectives = map[string]string{
+	"plugin":                "plugins run arbitrary code inside openvpn",
+	"config":                "including other files bypasses template validation",
+	"iproute":               "it replaces the ip command openvpn runs as root",
+	"management":            "it exposes control of openvpn on a socket",
+	"log":                   "it writes to an arbitrary file as root",
+	"log-append":            "it writes to an arbitrary file as root",
+	"status":                "it writes to an arbitrary file as root",
+	"writepid":              "it writes to an arbitrary file as root",
+	"replay-persist":        "it writes to an arbitrary file as root",
+	"ifconfig-pool-persist": "it writes to an arbitrary file as root",
+	"tmp-dir":               "it writes to an arbitrary directory as root",
+	"cd":                    "it changes the directory relative paths refer to",
+	"chroot":                "it changes the directory relative paths refer to",
+	"dev-node":              "it opens an arbitrary device node",
+}
+
+// Load the openvpn config template. If the admin has installed one at
+// templatePath, it is loaded and validated, otherwise the built-in
+// template is returned.
+func loadTemplate() (*template.Template, error) {
+	data, err := readTrustedFile(templatePath)
+	if os.IsNotExist(err) {
+		return openVpnCfgTpl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tpl, err := template.New("openvpn-config").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Parsing %s: %v", templatePath, err)
+	}
+	if err = checkTemplate(tpl); err != nil {
+		return nil, fmt.Errorf("Invalid template %s: %v", templatePath, err)
+	}
+	return tpl, nil
+}
+
+// Read the contents of the file at `path`, after verifying that it is a
+// regular file owned by root and not writable by group or other.
+func readTrustedFile(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("%s must not be writable by group or other", path)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 {
+		return nil, fmt.Errorf("%s must be owned by root", path)
+	}
+	return ioutil.ReadAll(f)
+}
+
+// Verify that `tpl` references all of the required fields, and that the
+// config it renders does not contain any unsafe directives.
+func checkTemplate(tpl *template.Template) error {
+	fields := map[string]bool{}
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			templateFields(t.Tree.Root, fields)
+		}
+	}
+	// Templates written before vpns could be trunks, or be on vxlan
+	// networks, use .Vlan or .VlanList, which are still fine for vpns
+	// carrying a single vlan untagged; see OpenVpnCfg.Render.
+	if fields["Vlan"] || fields["VlanList"] {
+		fields["Network"] = true
+	}
+	for _, name := range requiredTemplateFields {
+		if !fields[name] {
+			return fmt.Errorf("template does not reference required field .%s", name)
+		}
+	}
+
+	// Render the template with some sample values, which checks the
+	// result; catching unsafe directives here, rather than when the first
+	// vpn is created, is friendlier to the admin. The settings only affect
+	// the hook's arguments, so the defaults will do.
+	return OpenVpnCfg{
+		Name:          "template-check",
+		Port:          1194,
+		Vlan:          1,
+		InterfaceName: "templatechk",
+	}.Render(&bytes.Buffer{}, tpl, &defaultConfig)
+}
+
+// Walk the parse tree rooted at `node`, adding the names of all fields
+// (e.g. `.Port`) referenced by it to `fields`.
+func templateFields(node parse.Node, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateFields(child, fields)
+		}
+	case *parse.ActionNode:
+		templateFields(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				templateFields(arg, fields)
+			}
+		}
+	case *parse.FieldNode:
+		fields[n.Ident[0]] = true
+	case *parse.ChainNode:
+		templateFields(n.Node, fields)
+	case *parse.IfNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *parse.RangeNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *parse.WithNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *parse.TemplateNode:
+		templateFields(n.Pipe, fields)
+	}
+}
+
+// Helper for templateFields, handling the parts common to if, range and
+// with.
+func templateBranchFields(n *parse.BranchNode, fields map[string]bool) {
+	templateFields(n.Pipe, fields)
+	templateFields(n.List, fields)
+	templateFields(n.ElseList, fields)
+}
+
+// Check a rendered openvpn config for unsafe directives, returning an
+// error describing the first one found.
+func checkDirectives(config []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		fields := strings.Fields(line)
+		directive := strings.TrimPrefix(fields[0], "--")
+		args := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+
+		if reason, ok := forbiddenDirectives[directive]; ok {
+			return fmt.Errorf("line %d: %q is not permitted; %s",
+				lineNo, directive, reason)
+		}
+		if directive == "script-security" {
+			level, err := strconv.Atoi(args)
+			if err != nil || level < 0 || level > 2 {
+				return fmt.Errorf("line %d: script-security level must be "+
+					"between 0 and 2, not %q", lineNo, args)
+			}
+		}
+		if hookDirectives[directive] {
+			command := strings.Fields(strings.Trim(args, `"'`))
+			if len(command) == 0 || !isHookProgram(command[0]) {
+				return fmt.Errorf("line %d: %q may only run hil-vpn hooks "+
+					"from %s", lineNo, directive, staticconfig.Libexecdir)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Report whether `path` is one of the hooks in hookPrograms.
+func isHookProgram(path string) bool {
+	dir, prog := filepath.Split(path)
+	return dir == staticconfig.Libexecdir+"/" && hookPrograms[prog]
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// This file implements drift detection for the files we generate; see
+// verifyCmd.
+
+// Kinds of problems reported by verifyVpns.
+const (
+	problemNoMetadata   = "no_metadata"
+	problemConfMissing  = "conf_missing"
+	problemConfModified = "conf_modified"
+	problemKeyMissing   = "key_missing"
+	problemKeyModified  = "key_modified"
+	problemKeyMode      = "key_mode"
+)
+
+var metaFileRe = regexp.MustCompile("^hil-vpn-([-_a-zA-Z0-9]+).json$")
+
+// Check the files of every vpn we know about, returning a list of
+// problems found.
+func verifyVpns() []privproto.Problem {
+	// A vpn whose key is missing isn't reported by listVpns, so we look
+	// for metadata files as well as keys:
+	names := map[string]bool{}
+	for _, fi := range scanConfigDir() {
+		if matches := keyFileRe.FindStringSubmatch(fi.Name()); matches != nil {
+			names[matches[1]] = true
+		}
+		if matches := metaFileRe.FindStringSubmatch(fi.Name()); matches != nil {
+			names[matches[1]] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	problems := []privproto.Problem{}
+	for _, name := range sorted {
+		problems = append(problems, verifyVpn(name)...)
+	}
+	return problems
+}
+
+// Check the files of the named vpn.
+func verifyVpn(name string) []privproto.Problem {
+	defer lockVpn(name, unix.LOCK_SH).release()
+	problems := []privproto.Problem{}
+	report := func(kind, format string, args ...interface{}) {
+		problems = append(problems, privproto.Problem{
+			Vpn:    name,
+			Kind:   kind,
+			Detail: fmt.Sprintf(format, args...),
+		})
+	}
+
+	meta, err := readMetadata(name)
+	if os.IsNotExist(err) {
+		report(problemNoMetadata, "no recorded hashes; run 'regen' to record them")
+		meta = &vpnMetadata{}
+	} else if err != nil {
+		report(problemNoMetadata, "reading metadata: %v", err)
+		meta = &vpnMetadata{}
+	}
+
+	conf, err := ioutil.ReadFile(getCfgPath(name))
+	switch {
+	case os.IsNotExist(err):
+		report(problemConfMissing, "%s does not exist", getCfgPath(name))
+	case err != nil:
+		report(problemConfMissing, "reading %s: %v", getCfgPath(name), err)
+	case meta.ConfSHA256 != "" && hashOf(conf) != meta.ConfSHA256:
+		report(problemConfModified, "%s has been modified", getCfgPath(name))
+	}
+
+	keyPath := getKeyPath(name)
+	fi, err := os.Lstat(keyPath)
+	if os.IsNotExist(err) {
+		report(problemKeyMissing, "%s does not exist", keyPath)
+		return problems
+	} else if err != nil {
+		report(problemKeyMissing, "checking %s: %v", keyPath, err)
+		return problems
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0600 {
+		report(problemKeyMode, "%s has mode %v; should be -rw-------", keyPath, fi.Mode())
+	}
+	key, err := ioutil.ReadFile(keyPath)
+	switch {
+	case err != nil:
+		report(problemKeyMissing, "reading %s: %v", keyPath, err)
+	case meta.KeySHA256 != "" && hashOf(key) != meta.KeySHA256:
+		report(problemKeyModified, "%s has been modified", keyPath)
+	}
+	return problems
+}
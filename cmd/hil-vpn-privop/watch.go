@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
+)
+
+// This file implements the 'watch' subcommand, which reports changes in the
+// state of the vpns' openvpn instances as they happen, so that hil-vpnd can
+// notice (and react to) vpns which crash. With systemd, we listen for
+// changes to the units' properties; the supervisor has no equivalent, so
+// there we poll the supervisors' state files.
+
+// How often to check the supervisors' state files.
+var watchPollInterval = time.Second
+
+// Implement the 'watch' subcommand. This runs until we fail to write to
+// stdout (i.e. the reader goes away), or something else goes wrong.
+func watchCmd() {
+	services, err := connectServices()
+	chkfatal("Watching vpns", err)
+	defer services.Close()
+	events := make(chan privproto.Event)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- services.watch(events)
+	}()
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case ev := <-events:
+			if jsonOutput {
+				err = enc.Encode(privproto.Response{Event: &ev})
+			} else {
+				_, err = fmt.Printf("%s\t%s\t%s\n", ev.Vpn, ev.State, ev.Result)
+			}
+			chkfatal("Writing event", err)
+		case err = <-errs:
+			chkfatal("Watching vpns", err)
+			return
+		}
+	}
+}
+
+func (s systemdServices) watch(events chan<- privproto.Event) error {
+	// Listen for changes before getting the initial states, so we can't
+	// miss any in between:
+	err := s.sd.conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchPathNamespace(systemdPath+"/unit"),
+	)
+	if err != nil {
+		return fmt.Errorf("Subscribing to unit changes: %v", err)
+	}
+	for _, name := range listVpns() {
+		state, err := s.sd.activeState(getUnitName(name))
+		if err != nil {
+			return err
+		}
+		events <- privproto.Event{Vpn: name, State: state}
+	}
+	for sig := range s.sd.signals {
+		name, ok := vpnNameFromUnitPath(sig.Path)
+		if !ok || sig.Name != "org.freedesktop.DBus.Properties.PropertiesChanged" {
+			continue
+		}
+		// The body is (interface, changed properties, invalidated
+		// properties):
+		if len(sig.Body) != 3 || sig.Body[0] != systemdUnit {
+			continue
+		}
+		changed, _ := sig.Body[1].(map[string]dbus.Variant)
+		v, ok := changed["ActiveState"]
+		if !ok {
+			continue
+		}
+		state, _ := v.Value().(string)
+		ev := privproto.Event{Vpn: name, State: state}
+		if state == "failed" || state == "activating" {
+			// Find out why it failed (or why it is being restarted);
+			// this isn't necessarily included in the signal.
+			ev.Result = s.sd.serviceResult(sig.Path)
+		}
+		events <- ev
+	}
+	return fmt.Errorf("Lost connection to systemd")
+}
+
+// Return the name of the vpn whose unit has the object path `path`, and
+// whether `path` is the object path of a vpn's unit at all.
+func vpnNameFromUnitPath(path dbus.ObjectPath) (string, bool) {
+	prefix := string(systemdPath) + "/unit/"
+	if !strings.HasPrefix(string(path), prefix) {
+		return "", false
+	}
+	unit, ok := unescapeUnitPath(strings.TrimPrefix(string(path), prefix))
+	if !ok {
+		return "", false
+	}
+	unitPrefix, unitSuffix := getServiceName(""), ".service"
+	if !strings.HasPrefix(unit, unitPrefix) || !strings.HasSuffix(unit, unitSuffix) {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(unit, unitPrefix), unitSuffix)
+	return name, validate.CheckVpnName(name) == nil
+}
+
+// Undo systemd's escaping of unit names in object paths, which replaces
+// each byte other than an ASCII letter or digit with _xx, where xx is the
+// byte in hex.
+func unescapeUnitPath(s string) (string, bool) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '_' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", false
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		out = append(out, byte(b))
+		i += 2
+	}
+	return string(out), true
+}
+
+func (supervisorServices) watch(events chan<- privproto.Event) error {
+	states := map[string]privproto.Event{}
+	for {
+		for _, name := range listVpns() {
+			ev := supervisorEvent(name)
+			if old, ok := states[name]; !ok || old != ev {
+				states[name] = ev
+				events <- ev
+			}
+		}
+		time.Sleep(watchPollInterval)
+	}
+}
@@ -1,37 +1,272 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
 	"github.com/CCI-MOC/hil-vpn/internal/validate"
 
 	"github.com/CCI-MOC/obmd/adminauth"
 	"github.com/CCI-MOC/obmd/token"
 )
 
-// Request body for a create-vpn api call.
+// The modes a vpn may be created in; see CreateVpnReq.
+const (
+	ModeBridged = "bridged"
+	ModeRouted  = "routed"
+)
+
+// Request body for a create-vpn api call. Mode is ModeBridged (the default)
+// or ModeRouted.
+//
+// A bridged vpn is attached to a network, whose type is given by Network:
+// validate.NetworkVlan (the default), in which case it carries either the
+// single vlan Vlan, untagged, or the vlans in Vlans, tagged, even if there
+// is just one; or
+// validate.NetworkVxlan, in which case it is on the vxlan network Vni.
+//
+// A routed vpn isn't attached to a network, so none of those may be given;
+// instead, it gets a point-to-point link whose addresses are allocated by
+// the IPAM.
 type CreateVpnReq struct {
-	Vlan uint16 `json:"vlan"`
+	Mode    string   `json:"mode,omitempty"`
+	Network string   `json:"network,omitempty"`
+	Vlan    uint16   `json:"vlan"`
+	Vlans   []uint16 `json:"vlans,omitempty"`
+	Vni     uint32   `json:"vni,omitempty"`
+}
+
+// What a create-vpn api call asks for, once validated; see
+// CreateVpnReq.spec.
+type vpnSpec struct {
+	// The vlans a bridged vpn is to carry, and whether it carries them
+	// tagged, as a trunk, or its VNI if it is on a vxlan network.
+	vlans  []uint16
+	tagged bool
+	vni    uint32
+
+	// Whether the vpn is routed, in which case the above are unset.
+	routed bool
+}
+
+// Return what the request asks for, or an error if it isn't valid.
+func (r CreateVpnReq) spec() (vpnSpec, error) {
+	switch r.Mode {
+	case "", ModeBridged:
+		return r.network()
+	case ModeRouted:
+		if r.Network != "" || r.Vlan != 0 || r.Vlans != nil || r.Vni != 0 {
+			return vpnSpec{}, fmt.Errorf("network, vlan, vlans and vni are "+
+				"not valid for %s vpns", ModeRouted)
+		}
+		return vpnSpec{routed: true}, nil
+	default:
+		return vpnSpec{}, fmt.Errorf("Unknown mode %q; must be %q or %q",
+			r.Mode, ModeBridged, ModeRouted)
+	}
+}
+
+// Return the network a bridged vpn is to be attached to: the vlans it is to
+// carry, tagged if they were given as vlans, or its VNI if it is on a vxlan
+// network. Returns an error if the request doesn't specify a valid network.
+func (r CreateVpnReq) network() (vpnSpec, error) {
+	switch r.Network {
+	case "", validate.NetworkVlan:
+		if r.Vni != 0 {
+			return vpnSpec{}, fmt.Errorf("vni is only valid for %s networks",
+				validate.NetworkVxlan)
+		}
+		if r.Vlans == nil {
+			return vpnSpec{vlans: []uint16{r.Vlan}}, validate.CheckVlanNo(r.Vlan)
+		}
+		if r.Vlan != 0 {
+			return vpnSpec{}, fmt.Errorf("Only one of vlan and vlans may be given")
+		}
+		return vpnSpec{vlans: r.Vlans, tagged: true}, validate.CheckVlans(r.Vlans)
+	case validate.NetworkVxlan:
+		if r.Vlan != 0 || r.Vlans != nil {
+			return vpnSpec{}, fmt.Errorf("vlan and vlans are not valid for %s networks",
+				validate.NetworkVxlan)
+		}
+		return vpnSpec{vni: r.Vni}, validate.CheckVni(r.Vni)
+	default:
+		return vpnSpec{}, fmt.Errorf("Unknown network type %q; must be %q or %q",
+			r.Network, validate.NetworkVlan, validate.NetworkVxlan)
+	}
 }
 
-// Response body for a (successful) create-vpn api call.
+// Check that a vpn as described by `spec` can be created, given the
+// features which hil-vpn-privop supports, and, for a routed vpn, whether
+// `ipam` has any pools. If not, write a response saying so, and return
+// false.
+func checkSpecSupported(w http.ResponseWriter, spec vpnSpec, features featureSet, ipam *IPAM) bool {
+	if spec.tagged && !features[privproto.FeatureVlans] {
+		notSupported(w, privproto.FeatureVlans)
+		return false
+	}
+	if spec.vni != 0 && !features[privproto.FeatureVxlan] {
+		notSupported(w, privproto.FeatureVxlan)
+		return false
+	}
+	if spec.routed && !features[privproto.FeatureRouted] {
+		notSupported(w, privproto.FeatureRouted)
+		return false
+	}
+	if spec.routed && !ipam.Enabled() {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Routed vpns are not enabled on this server."))
+		return false
+	}
+	return true
+}
+
+// Allocate the point-to-point links for the routed vpns among `ids`, per
+// `specs`, returning each vpn's link (nil for bridged vpns). If this fails,
+// write a response saying why, and return false; the caller is responsible
+// for releasing the vpns.
+func allocLinks(w http.ResponseWriter, ipam *IPAM, ids []UniqueId, specs []vpnSpec) ([]*P2PLink, bool) {
+	links := make([]*P2PLink, len(ids))
+	var routed []int
+	var routedIds []UniqueId
+	for i, spec := range specs {
+		if spec.routed {
+			routed = append(routed, i)
+			routedIds = append(routedIds, ids[i])
+		}
+	}
+	if len(routed) == 0 {
+		return links, true
+	}
+	allocated, err := ipam.AllocN(routedIds)
+	switch err {
+	case nil:
+	case ErrNoFreeSubnets:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(
+			"There are no free subnets; cannot allocate addresses for " +
+				"a new routed network."))
+		return nil, false
+	default:
+		log.Println("error allocating addresses for new vpns: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	for j, i := range routed {
+		links[i] = allocated[j]
+	}
+	return links, true
+}
+
+// Return the request to create the vpn described by `spec`, with the
+// point-to-point link `link` if it is routed.
+func specRequest(name string, spec vpnSpec, link *P2PLink, portNo uint16) privproto.Request {
+	if spec.routed {
+		return createRoutedRequest(name, link, portNo)
+	}
+	return createRequest(name, spec.vlans, spec.tagged, spec.vni, portNo)
+}
+
+// Response body for a (successful) create-vpn api call. For a routed vpn,
+// this includes the addresses of its point-to-point link.
 type CreateVpnResp struct {
 	Key  string `json:"key"`
 	Id   string `json:"id"`
 	Port uint16 `json:"port"`
+	*P2PLink
+}
+
+// Response body for a status api call.
+type StatusResp struct {
+	// The number of vpns which currently exist.
+	Vpns int `json:"vpns"`
+
+	// Problems found with the vpns' config files; see PrivOps.VerifyVPNs.
+	// Null if hil-vpn-privop does not support verifying them.
+	Problems []privproto.Problem `json:"problems"`
+
+	// The health of each vpn, by id. Null if hil-vpn-privop does not
+	// support watching them.
+	Health map[string]VpnHealth `json:"health"`
+}
+
+// Choose an http status code to report a failed privileged operation.
+func privOpStatus(err error) int {
+	if err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	e, ok := err.(*privproto.Error)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	switch e.Code {
+	case privproto.ErrNotFound:
+		return http.StatusNotFound
+	case privproto.ErrInvalidArgument:
+		return http.StatusBadRequest
+	case privproto.ErrAlreadyExists, privproto.ErrStillRunning:
+		return http.StatusConflict
+	case privproto.ErrLockTimeout:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Report whether a privileged operation which failed with `err` may have
+// been carried out anyway, in whole or in part: its context ended while it
+// was running, so it was stopped part way through (see PrivOpsCmd.run). We
+// then can't tell whether the vpns it operated on exist, so, as when we
+// fail to back out a change, we keep their ids, ports and addresses
+// reserved; hil-vpnd finds out which vpns really exist when it next starts
+// (see newDaemon).
+func outcomeUnknown(err error) bool {
+	return err == context.DeadlineExceeded || err == context.Canceled
+}
+
+// Write a 501 Not Implemented response, for an endpoint which requires a
+// feature that hil-vpn-privop doesn't support.
+func notSupported(w http.ResponseWriter, feature string) {
+	w.WriteHeader(http.StatusNotImplemented)
+	w.Write([]byte(fmt.Sprintf(
+		"The installed hil-vpn-privop does not support %q.", feature)))
 }
 
 // Create an http.Handler implementing the REST API from the spec.
-func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates) http.Handler {
+//
+// Endpoints which depend on optional hil-vpn-privop features not listed in
+// `features` report 501 Not Implemented. `health` may be nil if the vpns'
+// health isn't being monitored.
+func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates, ipam *IPAM, features featureSet, health *healthMonitor) http.Handler {
 	r := mux.NewRouter()
 	adminR := adminauth.AdminRouter(adminToken, r)
 
+	// These need to be registered before /vpns/{id}, which would
+	// otherwise match DELETE /vpns/bulk:
+	adminR.Methods("POST").Path("/vpns/bulk").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !features[privproto.FeatureBatch] {
+				notSupported(w, privproto.FeatureBatch)
+				return
+			}
+			bulkCreate(w, req, privops, states, ipam, features)
+		})
+	adminR.Methods("DELETE").Path("/vpns/bulk").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !features[privproto.FeatureBatch] {
+				notSupported(w, privproto.FeatureBatch)
+				return
+			}
+			bulkDelete(w, req, privops, states, ipam)
+		})
+
 	adminR.Methods("POST").Path("/vpns/new").
 		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			var args CreateVpnReq
@@ -42,11 +277,15 @@ func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates) htt
 				return
 			}
 
-			if err := validate.CheckVlanNo(args.Vlan); err != nil {
+			spec, err := args.spec()
+			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				w.Write([]byte(err.Error()))
 				return
 			}
+			if !checkSpecSupported(w, spec, features, ipam) {
+				return
+			}
 
 			id, port, err := states.NewVpn()
 			switch err {
@@ -63,23 +302,42 @@ func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates) htt
 				return
 			}
 
+			links, ok := allocLinks(w, ipam, []UniqueId{id}, []vpnSpec{spec})
+			if !ok {
+				states.DeleteVpn(id)
+				states.ReleasePort(port)
+				return
+			}
+			link := links[0]
+
 			vpnName := makeVpnName(id, port)
-			keyText, err := privops.CreateVPN(vpnName, args.Vlan, port)
+			var keyText string
+			if spec.routed {
+				keyText, err = privops.CreateRoutedVPN(req.Context(), vpnName, link, port)
+			} else {
+				keyText, err = privops.CreateVPN(req.Context(), vpnName, spec.vlans, spec.tagged, spec.vni, port)
+			}
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				w.WriteHeader(privOpStatus(err))
 				log.Println("Error creating vpn: ", err)
+				if outcomeUnknown(err) {
+					// The vpn may exist after all; see outcomeUnknown.
+					return
+				}
 				states.DeleteVpn(id)
 				states.ReleasePort(port)
+				ipam.Release(id)
 				return
 			}
 
-			err = privops.StartVPN(vpnName)
+			err = privops.StartVPN(req.Context(), vpnName)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				w.WriteHeader(privOpStatus(err))
 				log.Println("Error starting vpn: ", err)
 
-				// try to back out the change.
-				err = privops.DeleteVPN(vpnName)
+				// try to back out the change. We do this even if the
+				// request was cancelled, so we don't use its context.
+				err = privops.DeleteVPN(context.Background(), vpnName)
 				if err != nil {
 					log.Println("Error deleting vpn")
 					// NOTE: that in this case we do *not* return the port
@@ -88,6 +346,7 @@ func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates) htt
 				} else {
 					states.DeleteVpn(id)
 					states.ReleasePort(port)
+					ipam.Release(id)
 				}
 				return
 			}
@@ -95,9 +354,10 @@ func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates) htt
 			// OK, we're good -- report the info to the caller.
 			w.Header().Set("Content-Type", "application/json")
 			err = json.NewEncoder(w).Encode(CreateVpnResp{
-				Key:  keyText,
-				Id:   fmt.Sprintf("%x", id),
-				Port: port,
+				Key:     keyText,
+				Id:      fmt.Sprintf("%x", id),
+				Port:    port,
+				P2PLink: link,
 			})
 			if err != nil {
 				log.Println("Error writing data to client:", err)
@@ -132,20 +392,78 @@ func makeHandler(adminToken token.Token, privops PrivOps, states *VpnStates) htt
 			}
 			vpnName := makeVpnName(id, port)
 
-			if err = privops.StopVPN(vpnName); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			if err = privops.StopVPN(req.Context(), vpnName); err != nil {
+				w.WriteHeader(privOpStatus(err))
 				log.Println("Error stopping vpn:", err)
 				return
 			}
-			if err = privops.DeleteVPN(vpnName); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			if err = privops.DeleteVPN(req.Context(), vpnName); err != nil {
+				w.WriteHeader(privOpStatus(err))
 				log.Println("Error deleting vpn:", err)
 				return
 			}
 
-			// OK; everything went through, so it's safe to flag the port as
-			// available for re-use:
+			// OK; everything went through, so it's safe to flag the port
+			// (and the addresses, if any) as available for re-use:
 			states.ReleasePort(port)
+			ipam.Release(id)
+		})
+
+	adminR.Methods("GET").Path("/status").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var problems []privproto.Problem
+			if features[privproto.FeatureVerify] {
+				var err error
+				problems, err = privops.VerifyVPNs(req.Context())
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					log.Println("Error verifying vpns:", err)
+					return
+				}
+			}
+			states.Lock()
+			numVpns := len(states.UsedPorts)
+			states.Unlock()
+			var vpnHealth map[string]VpnHealth
+			if health != nil {
+				vpnHealth = health.report()
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			err := json.NewEncoder(w).Encode(StatusResp{
+				Vpns:     numVpns,
+				Problems: problems,
+				Health:   vpnHealth,
+			})
+			if err != nil {
+				log.Println("Error writing data to client:", err)
+			}
+		})
+
+	adminR.Methods("POST").Path("/maintenance/regen").
+		HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !features[privproto.FeatureRegen] {
+				notSupported(w, privproto.FeatureRegen)
+				return
+			}
+			dryRun := false
+			if v := req.URL.Query().Get("dry-run"); v != "" {
+				var err error
+				dryRun, err = strconv.ParseBool(v)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("Invalid value for dry-run"))
+					return
+				}
+			}
+			out, err := privops.RegenVPNs(req.Context(), dryRun)
+			if err != nil {
+				w.WriteHeader(privOpStatus(err))
+				log.Println("Error regenerating vpn configs:", err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(out))
 		})
 
 	return r
@@ -6,12 +6,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"testing"
 
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+
 	"github.com/CCI-MOC/obmd/token"
 )
 
@@ -77,6 +83,27 @@ func initTestServer(ops *MockPrivOps) *httptest.Server {
 	return server
 }
 
+// Like initTestServer, but with routed vpns enabled, allocating their links
+// from the single subnet 10.99.0.0/30.
+func initRoutedTestServer(t *testing.T, ops *MockPrivOps) *httptest.Server {
+	dir, err := ioutil.TempDir("", "hil-vpnd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	daemon, err := newDaemon(config{
+		AdminToken:    adminToken,
+		MinPort:       5000,
+		MaxPort:       5009,
+		RoutedPools:   []string{"10.99.0.0/30"},
+		IPAMStateFile: filepath.Join(dir, "ipam.json"),
+	}, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(daemon.handler)
+}
+
 // Test that we reject unauthenticated API calls.
 func TestNoAdminDeny(t *testing.T) {
 	ops := NewMockPrivOps()
@@ -126,13 +153,13 @@ func successfullyCreateVpn(t *testing.T, vlanNo uint16, ops *MockPrivOps, server
 		t.Fatal("Decoding response body:", err)
 	}
 
-	vpn, ok := ops.vpns[expectedVpnName(results)]
+	vpn, ok := ops.snapshot()[expectedVpnName(results)]
 	if !ok {
 		t.Fatalf("API request returned success, but vpn %s does not exist.", results.Id)
 	}
-	if vpn.vlanNo != vlanNo {
-		t.Fatalf("Created VPN does not have the expected vlan; should be %d but is %d.",
-			vlanNo, vpn.vlanNo)
+	if len(vpn.vlans) != 1 || vpn.vlans[0] != vlanNo || vpn.tagged {
+		t.Fatalf("Created VPN does not have the expected vlan; should be %d, "+
+			"untagged, but is %v (tagged: %v).", vlanNo, vpn.vlans, vpn.tagged)
 	}
 	if vpn.key != results.Key {
 		t.Fatalf("Returned key disagrees with stored key; %v vs %v", results.Key, vpn.key)
@@ -176,11 +203,11 @@ func TestCreateRestore(t *testing.T) {
 	}
 
 	// now check that we have two vpns, and they have different ports.
-	if len(ops.vpns) != 2 {
-		t.Fatalf("There should be 2 vpns, but there are only %d.", len(ops.vpns))
+	if len(ops.snapshot()) != 2 {
+		t.Fatalf("There should be 2 vpns, but there are only %d.", len(ops.snapshot()))
 	}
-	vpns := []*vpnInfo{}
-	for _, v := range ops.vpns {
+	vpns := []vpnInfo{}
+	for _, v := range ops.snapshot() {
 		vpns = append(vpns, v)
 	}
 	if vpns[0].portNo == vpns[1].portNo {
@@ -191,26 +218,170 @@ func TestCreateRestore(t *testing.T) {
 
 // Test expected failures creating vpns
 func TestCreateFail(t *testing.T) {
-	badVlans := []uint16{0, 4095, 4096, 10000}
+	badBodies := []string{
+		`{"vlan": 0}`,
+		`{"vlan": 4095}`,
+		`{"vlan": 4096}`,
+		`{"vlan": 10000}`,
+		`{"vlans": []}`,
+		`{"vlans": [232, 0]}`,
+		`{"vlans": [232, 232]}`,
+		`{"vlan": 232, "vlans": [233, 234]}`,
+		`{"network": "vxlan", "vni": 0}`,
+		`{"network": "vxlan", "vni": 16777216}`,
+		`{"network": "vxlan", "vlan": 232, "vni": 5000}`,
+		`{"vlan": 232, "vni": 5000}`,
+		`{"network": "geneve", "vni": 5000}`,
+		`{"mode": "routed", "vlan": 232}`,
+		`{"mode": "routed", "network": "vxlan", "vni": 5000}`,
+		`{"mode": "tunnel"}`,
+	}
 	ops := NewMockPrivOps()
 	server := initTestServer(ops)
 	defer server.Close()
 	client := server.Client()
-	for _, vlanId := range badVlans {
-		reqBody := bytes.NewBufferString(fmt.Sprintf(`{"vlan": %d}`, vlanId))
+	for _, body := range badBodies {
+		reqBody := bytes.NewBufferString(body)
 		resp, err := postReq(client, server.URL+"/vpns/new", "application/json", reqBody)
 		if err != nil {
 			t.Fatal("Making request:", err)
 		}
 		if resp.StatusCode != http.StatusBadRequest {
-			t.Fatalf("Unexpected status code: %d (expected %d)",
+			t.Fatalf("Unexpected status code for %s: %d (expected %d)",
+				body,
 				resp.StatusCode,
 				http.StatusBadRequest)
 		}
 
-		if len(ops.vpns) != 0 {
-			t.Fatalf("A VPN was created; vpns: %v", ops.vpns)
+		if len(ops.snapshot()) != 0 {
+			t.Fatalf("A VPN was created; vpns: %v", ops.snapshot())
+		}
+	}
+}
+
+// Test creating trunks: vpns which carry the vlans listed in vlans, tagged,
+// even if there is just one.
+func TestCreateVlans(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+	client := server.Client()
+	for _, vlans := range [][]uint16{{232, 233}, {232}} {
+		body, _ := json.Marshal(CreateVpnReq{Vlans: vlans})
+		resp, err := postReq(client, server.URL+"/vpns/new", "application/json",
+			bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal("Making request:", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+		}
+		var results CreateVpnResp
+		if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatal("Decoding response body:", err)
+		}
+		vpn, ok := ops.snapshot()[expectedVpnName(results)]
+		if !ok {
+			t.Fatalf("API request returned success, but vpn %s does not exist.", results.Id)
+		}
+		if !reflect.DeepEqual(vpn.vlans, vlans) || !vpn.tagged {
+			t.Fatalf("Created VPN has vlans %v (tagged: %v); should be %v, tagged.",
+				vpn.vlans, vpn.tagged, vlans)
+		}
+	}
+}
+
+// Test creating a vpn on a vxlan network.
+func TestCreateVxlan(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+	client := server.Client()
+	resp, err := postReq(client, server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"network": "vxlan", "vni": 5000}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	var results CreateVpnResp
+	if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatal("Decoding response body:", err)
+	}
+	vpn, ok := ops.snapshot()[expectedVpnName(results)]
+	if !ok {
+		t.Fatalf("API request returned success, but vpn %s does not exist.", results.Id)
+	}
+	if vpn.vni != 5000 || len(vpn.vlans) != 0 {
+		t.Fatalf("Created VPN has vni %d and vlans %v; should be on vni 5000.",
+			vpn.vni, vpn.vlans)
+	}
+}
+
+// Test creating routed vpns, and that their addresses are re-used once
+// they are deleted.
+func TestCreateRouted(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initRoutedTestServer(t, ops)
+	defer server.Close()
+	client := server.Client()
+	create := func(status int) CreateVpnResp {
+		resp, err := postReq(client, server.URL+"/vpns/new", "application/json",
+			bytes.NewBufferString(`{"mode": "routed"}`))
+		if err != nil {
+			t.Fatal("Making request:", err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("Unexpected status code: %d (expected %d)", resp.StatusCode, status)
+		}
+		var results CreateVpnResp
+		if status == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+				t.Fatal("Decoding response body:", err)
+			}
 		}
+		return results
+	}
+
+	results := create(http.StatusOK)
+	vpn, ok := ops.snapshot()[expectedVpnName(results)]
+	if !ok {
+		t.Fatalf("API request returned success, but vpn %s does not exist.", results.Id)
+	}
+	if results.P2PLink == nil || results.Subnet != "10.99.0.0/30" ||
+		!results.ServerAddr.Equal(net.ParseIP("10.99.0.1")) ||
+		!results.ClientAddr.Equal(net.ParseIP("10.99.0.2")) {
+		t.Fatalf("Unexpected addresses in response: %+v", results.P2PLink)
+	}
+	if vpn.link == nil || !vpn.link.ServerAddr.Equal(results.ServerAddr) ||
+		!vpn.link.ClientAddr.Equal(results.ClientAddr) || len(vpn.vlans) != 0 {
+		t.Fatalf("Created VPN is not as expected: %+v", vpn)
+	}
+
+	// The pool only has room for one vpn; a second fails, and returns
+	// its port to the free pool:
+	create(http.StatusServiceUnavailable)
+	if len(ops.snapshot()) != 1 {
+		t.Fatalf("Expected 1 vpn, but there are %d.", len(ops.snapshot()))
+	}
+	for i := 0; i < 9; i++ {
+		successfullyCreateVpn(t, uint16(100+i), ops, server)
+	}
+
+	deleteUrl, err := url.Parse(server.URL + "/vpns/" + results.Id)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := doReq(client, &http.Request{Method: "DELETE", URL: deleteUrl})
+	if err != nil {
+		t.Fatal("Error making http request:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status code:", resp.StatusCode)
+	}
+	if create(http.StatusOK).Subnet != "10.99.0.0/30" {
+		t.Fatal("The deleted vpn's subnet was not re-used.")
 	}
 }
 
@@ -240,7 +411,7 @@ func TestDelete(t *testing.T) {
 		t.Fatal("Decoding response body:", err)
 	}
 
-	_, ok := ops.vpns[expectedVpnName(results)]
+	_, ok := ops.snapshot()[expectedVpnName(results)]
 	if !ok {
 		t.Fatal("VPN not created")
 	}
@@ -262,7 +433,7 @@ func TestDelete(t *testing.T) {
 		t.Fatal("Unexpected status code:", err)
 	}
 
-	_, ok = ops.vpns[expectedVpnName(results)]
+	_, ok = ops.snapshot()[expectedVpnName(results)]
 	if ok {
 		t.Fatal("VPN not deleted")
 	}
@@ -273,3 +444,105 @@ func TestRestore(t *testing.T) {
 	server := initTestServer(ops)
 	server.Close()
 }
+
+// Test the config regeneration maintenance endpoint.
+func TestRegen(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+	client := server.Client()
+
+	for _, query := range []string{"", "?dry-run=true"} {
+		resp, err := postReq(client, server.URL+"/maintenance/regen"+query, "text/plain", &bytes.Buffer{})
+		if err != nil {
+			t.Fatal("Making request:", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+		}
+	}
+	if len(ops.getRegenCalls()) != 2 || ops.getRegenCalls()[0] || !ops.getRegenCalls()[1] {
+		t.Fatalf("Unexpected calls to RegenVPNs: %v", ops.getRegenCalls())
+	}
+
+	resp, err := postReq(client, server.URL+"/maintenance/regen?dry-run=maybe", "text/plain", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected status code: %d (expected %d)",
+			resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// Test that the status endpoint reports problems found by VerifyVPNs.
+func TestStatus(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+	client := server.Client()
+	successfullyCreateVpn(t, 232, ops, server)
+	problems := []privproto.Problem{
+		{Vpn: "some-vpn", Kind: "conf_modified", Detail: "it was modified"},
+	}
+	ops.setProblems(problems)
+
+	statusUrl, err := url.Parse(server.URL + "/status")
+	if err != nil {
+		panic(err)
+	}
+	resp, err := doReq(client, &http.Request{
+		Method: "GET",
+		URL:    statusUrl,
+	})
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	var status StatusResp
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal("Decoding response body:", err)
+	}
+	if status.Vpns != 1 {
+		t.Fatalf("Expected 1 vpn, but status reports %d.", status.Vpns)
+	}
+	if !reflect.DeepEqual(status.Problems, problems) {
+		t.Fatalf("Unexpected problems; got %v, wanted %v", status.Problems, problems)
+	}
+}
+
+// Test that typed errors from PrivOps are reported with appropriate http
+// status codes.
+func TestPrivOpErrorStatus(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+	client := server.Client()
+
+	ops.setErr("CreateVPN", &privproto.Error{Code: privproto.ErrAlreadyExists})
+	resp, err := postReq(client, server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"vlan": 232}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Unexpected status code: %d (expected %d)",
+			resp.StatusCode, http.StatusConflict)
+	}
+	if len(ops.snapshot()) != 0 {
+		t.Fatalf("A VPN was created; vpns: %v", ops.snapshot())
+	}
+
+	ops.setErr("CreateVPN", &privproto.Error{Code: privproto.ErrLockTimeout})
+	resp, err = postReq(client, server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"vlan": 232}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected status code: %d (expected %d)",
+			resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
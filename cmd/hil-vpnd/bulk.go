@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// This file implements the bulk create & delete api calls. Each carries
+// out all of its privileged operations in a single PrivOps.Batch call.
+//
+// If the caller asks for atomic semantics, either every vpn in the request
+// is created (or deleted), or none are. Otherwise, each vpn succeeds or
+// fails on its own, and the response reports which is which.
+
+// Request body for a bulk create api call.
+type BulkCreateReq struct {
+	Vpns   []CreateVpnReq `json:"vpns"`
+	Atomic bool           `json:"atomic"`
+}
+
+// Request body for a bulk delete api call.
+type BulkDeleteReq struct {
+	Ids    []string `json:"ids"`
+	Atomic bool     `json:"atomic"`
+}
+
+// The outcome for a single vpn in a bulk api call.
+type BulkResult struct {
+	// The vpn's id. For a create, this is only set on success.
+	Id string `json:"id,omitempty"`
+
+	// The new vpn's key and port, and its point-to-point link if it is
+	// routed (create only).
+	Key  string `json:"key,omitempty"`
+	Port uint16 `json:"port,omitempty"`
+	*P2PLink
+
+	// If the operation failed for this vpn, a description of why.
+	Error string `json:"error,omitempty"`
+}
+
+// Response body for a bulk api call.
+type BulkResp struct {
+	// The outcome for each vpn, in the same order as the request.
+	Results []BulkResult `json:"results"`
+
+	// Whether an atomic request failed part way through, and the vpns
+	// which had already been created (or deleted) were rolled back.
+	RolledBack bool `json:"rolled_back"`
+}
+
+// Return the error (if any) from request `i` of a batch, given the
+// results. Requests past the end of the results were never attempted,
+// because an earlier request in an atomic batch failed.
+func batchErr(results []privproto.Response, i int) *privproto.Error {
+	if i >= len(results) {
+		return &privproto.Error{
+			Code:    privproto.ErrInternal,
+			Message: "not attempted",
+		}
+	}
+	return results[i].Error
+}
+
+// Write `resp` to the client, with the given http status code.
+func writeBulkResp(w http.ResponseWriter, status int, resp BulkResp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("Error writing data to client:", err)
+	}
+}
+
+// Handle a bulk create api call.
+func bulkCreate(w http.ResponseWriter, req *http.Request, privops PrivOps, states *VpnStates, ipam *IPAM, features featureSet) {
+	var args BulkCreateReq
+	err := json.NewDecoder(req.Body).Decode(&args)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid Request Body"))
+		return
+	}
+	specs := make([]vpnSpec, len(args.Vpns))
+	for i, vpn := range args.Vpns {
+		if specs[i], err = vpn.spec(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !checkSpecSupported(w, specs[i], features, ipam) {
+			return
+		}
+	}
+
+	// Allocate all of the ports and addresses up front, so we fail early
+	// (and without touching anything) if there aren't enough to go around:
+	ids, ports, err := states.NewVpns(len(args.Vpns))
+	switch err {
+	case nil:
+	case ErrNoFreePorts:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf(
+			"There are not enough free port numbers; cannot allocate "+
+				"%d new networks.", len(args.Vpns))))
+		return
+	default:
+		log.Println("error allocating new vpns: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	links, ok := allocLinks(w, ipam, ids, specs)
+	if !ok {
+		for i, id := range ids {
+			states.DeleteVpn(id)
+			states.ReleasePort(ports[i])
+		}
+		return
+	}
+
+	// Create & start each vpn; request 2*i creates vpn i, and request
+	// 2*i+1 starts it.
+	names := make([]string, len(ids))
+	reqs := make([]privproto.Request, 0, 2*len(ids))
+	for i, id := range ids {
+		names[i] = makeVpnName(id, ports[i])
+		reqs = append(reqs,
+			specRequest(names[i], specs[i], links[i], ports[i]),
+			privproto.Request{Op: privproto.OpStart, Name: names[i]},
+		)
+	}
+	results, err := privops.Batch(req.Context(), reqs, args.Atomic)
+	if results == nil && outcomeUnknown(err) {
+		// Any of the vpns may exist, so we hang on to all of them.
+		log.Println("Error creating vpns: ", err)
+		w.WriteHeader(privOpStatus(err))
+		return
+	}
+	if err != nil && (args.Atomic || results == nil) {
+		// Either nothing was done, or it was all rolled back, so none
+		// of the vpns exist.
+		log.Println("Error creating vpns: ", err)
+		for i, id := range ids {
+			states.DeleteVpn(id)
+			states.ReleasePort(ports[i])
+			ipam.Release(id)
+		}
+		if results == nil {
+			w.WriteHeader(privOpStatus(err))
+			return
+		}
+		resp := BulkResp{Results: make([]BulkResult, len(ids)), RolledBack: true}
+		for i := range ids {
+			resp.Results[i].Error = "rolled back"
+			for _, j := range []int{2 * i, 2*i + 1} {
+				if e := batchErr(results, j); e != nil {
+					resp.Results[i].Error = e.Message
+					break
+				}
+			}
+		}
+		writeBulkResp(w, privOpStatus(err), resp)
+		return
+	}
+
+	resp := BulkResp{Results: make([]BulkResult, len(ids))}
+	var cleanup []privproto.Request
+	for i, id := range ids {
+		if e := batchErr(results, 2*i); e != nil {
+			log.Printf("Error creating vpn %s: %v", names[i], e)
+			resp.Results[i].Error = e.Message
+			states.DeleteVpn(id)
+			states.ReleasePort(ports[i])
+			ipam.Release(id)
+			continue
+		}
+		if e := batchErr(results, 2*i+1); e != nil {
+			log.Printf("Error starting vpn %s: %v", names[i], e)
+			resp.Results[i].Error = e.Message
+			// try to back out the change; see below.
+			cleanup = append(cleanup, privproto.Request{
+				Op:   privproto.OpDelete,
+				Name: names[i],
+			})
+			continue
+		}
+		resp.Results[i] = BulkResult{
+			Id:      fmt.Sprintf("%x", id),
+			Key:     results[2*i].Key,
+			Port:    ports[i],
+			P2PLink: links[i],
+		}
+	}
+	if len(cleanup) != 0 {
+		// As with a single create, we do this even if the request was
+		// cancelled, so we don't use its context.
+		cleanupResults, err := privops.Batch(context.Background(), cleanup, false)
+		if err != nil {
+			log.Println("Error deleting vpns:", err)
+		}
+		for i, req := range cleanup {
+			if batchErr(cleanupResults, i) != nil {
+				// As with a single create, we do *not* return the
+				// port to the free pool, since we don't want another
+				// network to possibly re-use the openvpn config we
+				// just created.
+				log.Println("Error deleting vpn", req.Name)
+				continue
+			}
+			id, port, _ := parseVpnName(req.Name)
+			states.DeleteVpn(id)
+			states.ReleasePort(port)
+			ipam.Release(id)
+		}
+	}
+	writeBulkResp(w, http.StatusOK, resp)
+}
+
+// Handle a bulk delete api call.
+func bulkDelete(w http.ResponseWriter, req *http.Request, privops PrivOps, states *VpnStates, ipam *IPAM) {
+	var args BulkDeleteReq
+	err := json.NewDecoder(req.Body).Decode(&args)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid Request Body"))
+		return
+	}
+	ids := make([]UniqueId, len(args.Ids))
+	seen := map[UniqueId]bool{}
+	for i, idStr := range args.Ids {
+		idSlice, err := hex.DecodeString(idStr)
+		if err != nil || len(idSlice) != len(ids[i][:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid vpn id %q", idStr)))
+			return
+		}
+		copy(ids[i][:], idSlice)
+		if seen[ids[i]] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Duplicate vpn id %q", idStr)))
+			return
+		}
+		seen[ids[i]] = true
+	}
+
+	ports, err := states.DeleteVpns(ids, args.Atomic)
+	switch err {
+	case nil:
+	case ErrNoSuchVpn:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Unexpected error from DeleteVpns:", err)
+		return
+	}
+
+	// Stop & delete each vpn that exists; for the i'th such vpn, request
+	// 2*i stops it, and request 2*i+1 deletes it.
+	resp := BulkResp{Results: make([]BulkResult, len(ids))}
+	var found []int
+	var reqs []privproto.Request
+	for i, id := range ids {
+		resp.Results[i].Id = args.Ids[i]
+		if ports[i] == 0 {
+			resp.Results[i].Error = ErrNoSuchVpn.Error()
+			continue
+		}
+		found = append(found, i)
+		name := makeVpnName(id, ports[i])
+		reqs = append(reqs,
+			privproto.Request{Op: privproto.OpStop, Name: name},
+			privproto.Request{Op: privproto.OpDelete, Name: name},
+		)
+	}
+	results, err := privops.Batch(req.Context(), reqs, args.Atomic)
+	if results == nil && outcomeUnknown(err) {
+		// Any of the vpns may be gone, so we neither restore them nor
+		// release their ports and addresses; see outcomeUnknown.
+		log.Println("Error deleting vpns:", err)
+		w.WriteHeader(privOpStatus(err))
+		return
+	}
+	if err != nil && (args.Atomic || results == nil) {
+		// Either nothing was done, or it was all rolled back, so all of
+		// the vpns still exist.
+		log.Println("Error deleting vpns:", err)
+		for _, i := range found {
+			states.RestoreVpn(ids[i], ports[i])
+		}
+		if results == nil {
+			w.WriteHeader(privOpStatus(err))
+			return
+		}
+		resp.RolledBack = true
+		for j, i := range found {
+			resp.Results[i].Error = "rolled back"
+			for _, k := range []int{2 * j, 2*j + 1} {
+				if e := batchErr(results, k); e != nil {
+					resp.Results[i].Error = e.Message
+					break
+				}
+			}
+		}
+		writeBulkResp(w, privOpStatus(err), resp)
+		return
+	}
+
+	for j, i := range found {
+		stopErr := batchErr(results, 2*j)
+		if deleteErr := batchErr(results, 2*j+1); deleteErr != nil {
+			log.Printf("Error deleting vpn %s: %v", reqs[2*j+1].Name, deleteErr)
+			resp.Results[i].Error = deleteErr.Message
+			if stopErr != nil {
+				// We didn't manage to touch the vpn at all, so it
+				// still exists.
+				resp.Results[i].Error = stopErr.Message
+				states.RestoreVpn(ids[i], ports[i])
+			}
+			continue
+		}
+		// OK; the vpn is gone, so it's safe to flag the port (and the
+		// addresses, if any) as available for re-use:
+		states.ReleasePort(ports[i])
+		ipam.Release(ids[i])
+	}
+	writeBulkResp(w, http.StatusOK, resp)
+}
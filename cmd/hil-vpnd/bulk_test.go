@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Make a bulk api call with the given method and body, checking the status
+// code and returning the decoded response.
+func bulkReq(t *testing.T, server *httptest.Server, method, body string, status int) BulkResp {
+	bulkUrl, err := url.Parse(server.URL + "/vpns/bulk")
+	if err != nil {
+		panic(err)
+	}
+	resp, err := doReq(server.Client(), &http.Request{
+		Method: method,
+		URL:    bulkUrl,
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   ioutil.NopCloser(bytes.NewBufferString(body)),
+	})
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("Unexpected status code: %d (expected %d)", resp.StatusCode, status)
+	}
+	var results BulkResp
+	if status == http.StatusOK || resp.Header.Get("Content-Type") == "application/json" {
+		if err = json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatal("Decoding response body:", err)
+		}
+	}
+	return results
+}
+
+// Test creating and then deleting several vpns at once.
+func TestBulkCreateDelete(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+
+	created := bulkReq(t, server, "POST",
+		`{"vpns": [{"vlan": 100}, {"vlan": 200}, {"vlan": 300}]}`, http.StatusOK)
+	if len(created.Results) != 3 {
+		t.Fatalf("Expected 3 results, but got %d.", len(created.Results))
+	}
+	for i, result := range created.Results {
+		if result.Error != "" {
+			t.Fatalf("Creating vpn %d failed: %s", i, result.Error)
+		}
+		vpn, ok := ops.snapshot()[expectedVpnName(CreateVpnResp{Id: result.Id, Port: result.Port})]
+		if !ok {
+			t.Fatalf("API request returned success, but vpn %s does not exist.", result.Id)
+		}
+		if vpn.vlans[0] != uint16(100*(i+1)) || vpn.key != result.Key || !vpn.running {
+			t.Fatalf("vpn %s is not as expected: %+v", result.Id, vpn)
+		}
+	}
+
+	deleted := bulkReq(t, server, "DELETE",
+		`{"ids": ["`+created.Results[0].Id+`", "`+created.Results[2].Id+`", "`+
+			"00000000000000000000000000000000"+`"]}`,
+		http.StatusOK)
+	if deleted.Results[0].Error != "" || deleted.Results[1].Error != "" {
+		t.Fatalf("Unexpected errors deleting vpns: %+v", deleted.Results)
+	}
+	if deleted.Results[2].Error == "" {
+		t.Fatal("Deleting a non-existent vpn succeeded.")
+	}
+	if len(ops.snapshot()) != 1 {
+		t.Fatalf("Expected 1 remaining vpn, but there are %d.", len(ops.snapshot()))
+	}
+
+	// An atomic delete including a non-existent vpn should do nothing:
+	bulkReq(t, server, "DELETE",
+		`{"atomic": true, "ids": ["`+created.Results[1].Id+`", "`+
+			created.Results[0].Id+`"]}`,
+		http.StatusBadRequest)
+	if len(ops.snapshot()) != 1 {
+		t.Fatalf("Expected 1 remaining vpn, but there are %d.", len(ops.snapshot()))
+	}
+}
+
+// Test that a failed atomic bulk create leaves nothing behind, and returns
+// the ports to the free pool.
+func TestBulkCreateAtomicRollback(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+
+	ops.setErr("StartVPN", &privproto.Error{Code: privproto.ErrLockTimeout, Message: "busy"})
+	resp := bulkReq(t, server, "POST",
+		`{"atomic": true, "vpns": [{"vlan": 100}, {"vlan": 200}]}`,
+		http.StatusServiceUnavailable)
+	if !resp.RolledBack {
+		t.Fatal("Response does not report that the request was rolled back.")
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Error != "busy" {
+		t.Fatalf("Unexpected results: %+v", resp.Results)
+	}
+	if len(ops.snapshot()) != 0 {
+		t.Fatalf("VPNs were created; vpns: %v", ops.snapshot())
+	}
+
+	// Without atomic semantics, each vpn fails separately, and is
+	// cleaned up.
+	resp = bulkReq(t, server, "POST",
+		`{"vpns": [{"vlan": 100}, {"vlan": 200}]}`, http.StatusOK)
+	if resp.RolledBack || resp.Results[0].Error != "busy" || resp.Results[1].Error != "busy" {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	if len(ops.snapshot()) != 0 {
+		t.Fatalf("VPNs were left behind; vpns: %v", ops.snapshot())
+	}
+
+	// All of the ports should be free again:
+	ops.setErr("StartVPN", nil)
+	bulkReq(t, server, "POST", `{"vpns": [`+
+		`{"vlan": 1}, {"vlan": 2}, {"vlan": 3}, {"vlan": 4}, {"vlan": 5}, `+
+		`{"vlan": 6}, {"vlan": 7}, {"vlan": 8}, {"vlan": 9}, {"vlan": 10}]}`,
+		http.StatusOK)
+	if len(ops.snapshot()) != 10 {
+		t.Fatalf("Expected 10 vpns, but there are %d.", len(ops.snapshot()))
+	}
+}
+
+// Test that a bulk create needing more ports than are available fails
+// without creating anything.
+func TestBulkCreateNoFreePorts(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initTestServer(ops)
+	defer server.Close()
+
+	bulkReq(t, server, "POST", `{"vpns": [`+
+		`{"vlan": 1}, {"vlan": 2}, {"vlan": 3}, {"vlan": 4}, {"vlan": 5}, `+
+		`{"vlan": 6}, {"vlan": 7}, {"vlan": 8}, {"vlan": 9}, {"vlan": 10}, `+
+		`{"vlan": 11}]}`,
+		http.StatusServiceUnavailable)
+	if len(ops.snapshot()) != 0 {
+		t.Fatalf("VPNs were created; vpns: %v", ops.snapshot())
+	}
+}
+
+// Test a bulk create mixing bridged and routed vpns, and that one needing
+// more subnets than are available fails without creating anything.
+func TestBulkCreateRouted(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initRoutedTestServer(t, ops)
+	defer server.Close()
+
+	bulkReq(t, server, "POST",
+		`{"vpns": [{"mode": "routed"}, {"mode": "routed"}]}`,
+		http.StatusServiceUnavailable)
+	if len(ops.snapshot()) != 0 {
+		t.Fatalf("VPNs were created; vpns: %v", ops.snapshot())
+	}
+
+	created := bulkReq(t, server, "POST",
+		`{"vpns": [{"vlan": 100}, {"mode": "routed"}]}`, http.StatusOK)
+	if created.Results[0].P2PLink != nil {
+		t.Fatalf("Bridged vpn was given addresses: %+v", created.Results[0].P2PLink)
+	}
+	link := created.Results[1].P2PLink
+	if link == nil || link.Subnet != "10.99.0.0/30" {
+		t.Fatalf("Routed vpn was not given the expected addresses: %+v", link)
+	}
+	vpn, ok := ops.snapshot()[expectedVpnName(CreateVpnResp{Id: created.Results[1].Id, Port: created.Results[1].Port})]
+	if !ok || vpn.link == nil || !vpn.link.ClientAddr.Equal(link.ClientAddr) {
+		t.Fatalf("Routed vpn is not as expected: %+v", vpn)
+	}
+
+	bulkReq(t, server, "DELETE", `{"ids": ["`+created.Results[1].Id+`"]}`, http.StatusOK)
+	bulkReq(t, server, "POST", `{"vpns": [{"mode": "routed"}]}`, http.StatusOK)
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net/http"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
 )
 
 // A Daemon manages the runtime state and configuration of hil-vpnd.
@@ -10,19 +14,67 @@ type Daemon struct {
 	handler   http.Handler
 	privops   PrivOps
 	vpnStates *VpnStates
+
+	// Allocates routed vpns' addresses.
+	ipam *IPAM
+
+	// The optional hil-vpn-privop features we may use.
+	features featureSet
+
+	// Monitors the vpns' health; nil if hil-vpn-privop doesn't support
+	// watching them. It must be started (and eventually stopped) by the
+	// caller of newDaemon.
+	health *healthMonitor
 }
 
-// Generate a new daemon using the given config and PrivOps
+// Generate a new daemon using the given config and PrivOps. The timeouts
+// and retry policy in the config are applied to each privileged operation;
+// each retry gets a fresh timeout.
 func newDaemon(cfg config, privops PrivOps) (*Daemon, error) {
-	vpnNames, err := privops.ListVPNs()
+	ctx := context.Background()
+	privops = retryPrivOps{
+		ops:     timeoutPrivOps{ops: privops, timeouts: cfg.PrivOpTimeouts},
+		retries: cfg.PrivOpRetries,
+	}
+	version, err := getVersion(ctx, privops)
+	if err != nil {
+		return nil, err
+	}
+	features, err := checkVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	if !features[privproto.FeaturePreflight] {
+		log.Println("Skipping preflight checks.")
+	} else if err = preflight(ctx, privops); err != nil {
+		if !cfg.PreflightWarnOnly {
+			return nil, err
+		}
+		log.Println("Warning:", err)
+	}
+
+	vpnNames, err := privops.ListVPNs(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Listing existing vpns: %v", err)
 	}
 	vpnStates := newStates(cfg, vpnNames)
+	ipam, err := newIPAM(cfg.RoutedPools, cfg.IPAMStateFile, vpnStates)
+	if err != nil {
+		return nil, err
+	}
+
+	var health *healthMonitor
+	if features[privproto.FeatureWatch] {
+		health = newHealthMonitor(privops, vpnStates, cfg.RestartPolicy)
+	}
 
 	return &Daemon{
-		handler:   makeHandler(cfg.AdminToken, privops, vpnStates),
+		handler:   makeHandler(cfg.AdminToken, privops, vpnStates, ipam, features, health),
 		privops:   privops,
 		vpnStates: vpnStates,
+		ipam:      ipam,
+		features:  features,
+		health:    health,
 	}, nil
 }
@@ -1,3 +1,19 @@
 export LISTEN_ADDR=127.0.0.1:8080
 export MIN_VPN_PORT=6000
 export MAX_VPN_PORT=6010
+# To use hil-vpn-privop running as a service instead of via sudo:
+# export PRIVOP_SOCKET=/usr/local/var/run/hil-vpn-privop.sock
+# In a development environment without openvpn, bridges, etc., start up
+# anyway if the preflight checks fail:
+# export PREFLIGHT_WARN_ONLY=true
+# Each privileged operation has a timeout, which may be overridden:
+# export PRIVOP_TIMEOUT_START=2m
+# ...as may the number of times it is retried after a transient failure:
+# export PRIVOP_RETRIES_START=5
+# Failed vpns are restarted, with increasing delays if they keep failing;
+# to leave them be instead:
+# export RESTART_POLICY=never
+# To allow routed vpns, allocate their addresses from these pools, and
+# keep track of which are in use in the given file:
+# export ROUTED_POOLS=10.99.0.0/24,fd00:99::/120
+# export IPAM_STATE_FILE=/usr/local/var/lib/hil-vpnd/ipam.json
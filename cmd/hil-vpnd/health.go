@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// This file implements monitoring of the vpns' health. We watch for changes
+// in the state of the vpns' openvpn instances (see PrivOps.Watch), keep
+// track of which have failed, and restart those which the service manager
+// has given up on, according to a configurable policy. The results are
+// reported by the status api call.
+
+// Restart policies; see restartPolicy.Policy.
+const (
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// How to restart vpns which have failed.
+//
+// The service manager (e.g. systemd) may restart a crashed openvpn itself,
+// but gives up if it keeps crashing, leaving the vpn "failed". We restart
+// failed vpns after a delay, which doubles with each consecutive restart
+// (up to MaxBackoff), so that a vpn which is crash-looping doesn't eat the
+// host. Once a vpn has stayed up for ResetAfter, the delay goes back to
+// InitialBackoff.
+type restartPolicy struct {
+	// Either RestartOnFailure or RestartNever.
+	Policy string `env:"RESTART_POLICY" envDefault:"on-failure"`
+
+	InitialBackoff time.Duration `env:"RESTART_INITIAL_BACKOFF" envDefault:"10s"`
+	MaxBackoff     time.Duration `env:"RESTART_MAX_BACKOFF" envDefault:"10m"`
+	ResetAfter     time.Duration `env:"RESTART_RESET_AFTER" envDefault:"10m"`
+
+	// The number of consecutive restarts after which we give up on a
+	// vpn. Zero means never give up.
+	MaxRestarts int `env:"RESTART_MAX_RESTARTS" envDefault:"0"`
+}
+
+// Verify that the settings in `p` are valid.
+func (p restartPolicy) check() error {
+	switch p.Policy {
+	case RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("RESTART_POLICY must be %q or %q, not %q",
+			RestartOnFailure, RestartNever, p.Policy)
+	}
+	if p.InitialBackoff <= 0 || p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("RESTART_MAX_BACKOFF must be at least " +
+			"RESTART_INITIAL_BACKOFF, which must be positive")
+	}
+	return nil
+}
+
+// Return how long to wait before the restart following `restarts`
+// consecutive restarts.
+func (p restartPolicy) backoff(restarts int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < restarts && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// How long to wait before re-establishing a watch which failed.
+var watchRetryDelay = 5 * time.Second
+
+// The health of a vpn, as reported by the status api call.
+type VpnHealth struct {
+	// The state of the vpn's openvpn instance; see privproto.Event.
+	State string `json:"state"`
+
+	// The number of times openvpn has failed since hil-vpnd started,
+	// and when and how (e.g. "exit-code") it last did.
+	Failures    int        `json:"failures"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastResult  string     `json:"last_result,omitempty"`
+
+	// The number of times hil-vpnd has restarted the vpn.
+	Restarts int `json:"restarts"`
+
+	// If a restart is pending, when it will happen.
+	NextRestart *time.Time `json:"next_restart,omitempty"`
+
+	// Whether we have given up restarting the vpn, per
+	// RESTART_MAX_RESTARTS.
+	GaveUp bool `json:"gave_up,omitempty"`
+}
+
+// Our record of a vpn's health.
+type vpnHealth struct {
+	VpnHealth
+
+	// The number of consecutive restarts; see restartPolicy.
+	restarts int
+
+	// When the vpn last became active.
+	activeSince time.Time
+
+	// The timer for a pending restart, if any.
+	timer *time.Timer
+}
+
+// Monitors the health of the vpns, restarting them as needed.
+type healthMonitor struct {
+	sync.Mutex
+	privops PrivOps
+	states  *VpnStates
+	policy  restartPolicy
+
+	// The health of each vpn, by name.
+	vpns map[string]*vpnHealth
+
+	// Set by Start: cancels the monitor's context, and is closed once
+	// run has returned.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Counts restarts which are pending or in progress.
+	restarting sync.WaitGroup
+}
+
+func newHealthMonitor(privops PrivOps, states *VpnStates, policy restartPolicy) *healthMonitor {
+	return &healthMonitor{
+		privops: privops,
+		states:  states,
+		policy:  policy,
+		vpns:    map[string]*vpnHealth{},
+	}
+}
+
+// Start monitoring the vpns in the background, until ctx is done or Stop
+// is called.
+func (m *healthMonitor) Start(ctx context.Context) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		m.run(ctx)
+	}()
+}
+
+// Stop monitoring the vpns, cancelling any pending restarts, and wait for
+// everything the monitor had in progress to finish.
+func (m *healthMonitor) Stop() {
+	m.cancel()
+	<-m.done
+	// Now that ctx is done, scheduleRestart won't schedule any more.
+	m.Lock()
+	for _, h := range m.vpns {
+		m.cancelRestart(h)
+	}
+	m.Unlock()
+	m.restarting.Wait()
+}
+
+// Watch the vpns until ctx is done, re-establishing the watch if it fails.
+func (m *healthMonitor) run(ctx context.Context) {
+	events := make(chan privproto.Event)
+	var handler sync.WaitGroup
+	handler.Add(1)
+	defer handler.Wait()
+	go func() {
+		defer handler.Done()
+		for {
+			select {
+			case ev := <-events:
+				m.handle(ctx, ev)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		err := m.privops.Watch(ctx, events)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Watching vpns failed (%v); retrying in %v.", err, watchRetryDelay)
+		select {
+		case <-time.After(watchRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Report whether the named vpn (still) exists.
+func (m *healthMonitor) exists(name string) bool {
+	id, port, err := parseVpnName(name)
+	if err != nil {
+		return false
+	}
+	m.states.Lock()
+	defer m.states.Unlock()
+	return m.states.UsedPorts[id] == port
+}
+
+// Update our records in light of `ev`, scheduling a restart if needed.
+func (m *healthMonitor) handle(ctx context.Context, ev privproto.Event) {
+	if _, _, err := parseVpnName(ev.Vpn); err != nil {
+		// Not one of ours.
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	h, ok := m.vpns[ev.Vpn]
+	if !ok {
+		h = &vpnHealth{}
+		m.vpns[ev.Vpn] = h
+	}
+	now := time.Now()
+	h.State = ev.State
+	switch ev.State {
+	case "active":
+		h.activeSince = now
+		// If a restart is pending, something else restarted it first.
+		m.cancelRestart(h)
+	case "failed", "activating":
+		if ev.Result == "" || ev.Result == "success" {
+			// Starting normally, rather than after a failure.
+			break
+		}
+		if !h.activeSince.IsZero() && now.Sub(h.activeSince) >= m.policy.ResetAfter {
+			// It had been up long enough to count as recovered.
+			h.restarts = 0
+			h.GaveUp = false
+		}
+		h.activeSince = time.Time{}
+		h.Failures++
+		h.LastFailure = &now
+		h.LastResult = ev.Result
+		log.Printf("vpn %s failed (%s); now %s.", ev.Vpn, ev.Result, ev.State)
+	}
+	if ev.State == "failed" {
+		m.scheduleRestart(ctx, ev.Vpn, h)
+	}
+}
+
+// Schedule a restart of the named vpn, whose health is `h`, if the policy
+// calls for it. The caller must hold m's lock.
+func (m *healthMonitor) scheduleRestart(ctx context.Context, name string, h *vpnHealth) {
+	if m.policy.Policy != RestartOnFailure || h.timer != nil || h.GaveUp || ctx.Err() != nil {
+		return
+	}
+	if m.policy.MaxRestarts > 0 && h.restarts >= m.policy.MaxRestarts {
+		log.Printf("vpn %s has been restarted %d times in a row; giving up.",
+			name, h.restarts)
+		h.GaveUp = true
+		return
+	}
+	delay := m.policy.backoff(h.restarts)
+	next := time.Now().Add(delay)
+	h.NextRestart = &next
+	h.restarts++
+	log.Printf("Restarting vpn %s in %v.", name, delay)
+	m.restarting.Add(1)
+	h.timer = time.AfterFunc(delay, func() {
+		defer m.restarting.Done()
+		m.restart(ctx, name)
+	})
+}
+
+// Cancel the pending restart of the vpn whose health is `h`, if there is
+// one which hasn't begun yet. The caller must hold m's lock.
+func (m *healthMonitor) cancelRestart(h *vpnHealth) {
+	if h.timer != nil && h.timer.Stop() {
+		h.timer = nil
+		h.NextRestart = nil
+		m.restarting.Done()
+	}
+}
+
+// Restart the named vpn, which has failed.
+func (m *healthMonitor) restart(ctx context.Context, name string) {
+	m.Lock()
+	h := m.vpns[name]
+	h.timer = nil
+	h.NextRestart = nil
+	m.Unlock()
+
+	// The vpn may have been deleted in the meantime. There is still a
+	// window in which a delete could race with the restart, in which
+	// case the delete fails with ErrStillRunning, and may be retried.
+	if ctx.Err() != nil || !m.exists(name) {
+		return
+	}
+	err := m.privops.StartVPN(ctx, name)
+
+	m.Lock()
+	defer m.Unlock()
+	h.Restarts++
+	if err != nil {
+		log.Printf("Restarting vpn %s failed: %v", name, err)
+		m.scheduleRestart(ctx, name, h)
+	}
+}
+
+// Return the health of each existing vpn which we know about, by id.
+func (m *healthMonitor) report() map[string]VpnHealth {
+	m.Lock()
+	defer m.Unlock()
+	ret := map[string]VpnHealth{}
+	for name, h := range m.vpns {
+		if !m.exists(name) {
+			if h.timer == nil {
+				delete(m.vpns, name)
+			}
+			continue
+		}
+		id, _, _ := parseVpnName(name)
+		ret[fmt.Sprintf("%x", id)] = h.VpnHealth
+	}
+	return ret
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Start a test server whose daemon restarts failed vpns per `policy`, and
+// create a vpn on it, returning the vpn's name. The daemon's health monitor
+// is stopped when the test finishes.
+func initHealthTestServer(t *testing.T, ops *MockPrivOps, policy restartPolicy) (*httptest.Server, string) {
+	daemon, err := newDaemon(config{
+		AdminToken:    adminToken,
+		MinPort:       5000,
+		MaxPort:       5009,
+		RestartPolicy: policy,
+	}, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.health.Start(context.Background())
+	t.Cleanup(daemon.health.Stop)
+	server := httptest.NewServer(daemon.handler)
+	successfullyCreateVpn(t, 232, ops, server)
+	for name := range ops.snapshot() {
+		return server, name
+	}
+	panic("BUG: no vpn was created")
+}
+
+// Get the health of the named vpn from the status api call.
+func getHealth(t *testing.T, server *httptest.Server, name string) VpnHealth {
+	statusUrl, err := url.Parse(server.URL + "/status")
+	if err != nil {
+		panic(err)
+	}
+	resp, err := doReq(server.Client(), &http.Request{Method: "GET", URL: statusUrl})
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+	var status StatusResp
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal("Decoding response body:", err)
+	}
+	id, _, _ := parseVpnName(name)
+	return status.Health[fmt.Sprintf("%x", id)]
+}
+
+// Wait until the named vpn's health satisfies `cond`, returning it.
+func waitHealth(t *testing.T, server *httptest.Server, name string, cond func(VpnHealth) bool) VpnHealth {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h := getHealth(t, server, name)
+		if cond(h) {
+			return h
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for vpn health; last saw %+v", h)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Report whether the named vpn is running, according to the mock.
+func mockRunning(ops *MockPrivOps, name string) bool {
+	return ops.snapshot()[name].running
+}
+
+// Test that failed vpns are restarted, and that we give up on them once
+// they have been restarted too many times in a row.
+func TestHealthRestart(t *testing.T) {
+	ops := NewMockPrivOps()
+	server, name := initHealthTestServer(t, ops, restartPolicy{
+		Policy:         RestartOnFailure,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		ResetAfter:     time.Hour,
+		MaxRestarts:    2,
+	})
+	defer server.Close()
+
+	waitHealth(t, server, name, func(h VpnHealth) bool { return h.State == "active" })
+	for i := 1; i <= 2; i++ {
+		ops.crash(name, "exit-code")
+		h := waitHealth(t, server, name, func(h VpnHealth) bool {
+			return h.Restarts == i && h.State == "active"
+		})
+		if h.Failures != i || h.LastResult != "exit-code" || h.LastFailure == nil {
+			t.Fatalf("Failure was not recorded: %+v", h)
+		}
+		if !mockRunning(ops, name) {
+			t.Fatal("vpn was not restarted.")
+		}
+	}
+
+	ops.crash(name, "signal")
+	h := waitHealth(t, server, name, func(h VpnHealth) bool { return h.GaveUp })
+	if h.State != "failed" || h.Failures != 3 || h.Restarts != 2 {
+		t.Fatalf("Unexpected health after giving up: %+v", h)
+	}
+	if mockRunning(ops, name) {
+		t.Fatal("vpn was restarted more than RESTART_MAX_RESTARTS times.")
+	}
+}
+
+// Test that failed vpns are left alone if the policy says so.
+func TestHealthNoRestart(t *testing.T) {
+	ops := NewMockPrivOps()
+	server, name := initHealthTestServer(t, ops, restartPolicy{
+		Policy:         RestartNever,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+	defer server.Close()
+
+	ops.crash(name, "exit-code")
+	h := waitHealth(t, server, name, func(h VpnHealth) bool { return h.State == "failed" })
+	if h.Failures != 1 || h.NextRestart != nil {
+		t.Fatalf("Unexpected health: %+v", h)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if mockRunning(ops, name) {
+		t.Fatal("vpn was restarted, despite RESTART_POLICY=never.")
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	p := restartPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for restarts, expected := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	} {
+		if d := p.backoff(restarts); d != expected {
+			t.Errorf("backoff(%d) = %v, expected %v", restarts, d, expected)
+		}
+	}
+}
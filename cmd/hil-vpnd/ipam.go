@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// This file implements IP address management for routed vpns. Each routed
+// vpn gets a point-to-point link of its own, allocated from the configured
+// pools: a /30 from an IPv4 pool, whose first usable address is the
+// server's end and the second the client's, or a /127 from an IPv6 pool,
+// whose two addresses are the server's and the client's ends respectively.
+//
+// Unlike ports, the assignments can't be recovered from the vpns' names
+// (see newStates), so we persist them to a file, and reload them at
+// startup.
+
+var (
+	// Error indicating that the pools are all used up.
+	ErrNoFreeSubnets = errors.New("There are no free subnets for routed vpns")
+
+	// Error indicating that no pools are configured, so routed vpns are
+	// disabled.
+	ErrNoPools = errors.New("No address pools are configured for routed vpns")
+)
+
+// The addresses of a routed vpn's point-to-point link. The client should
+// use ClientAddr for its end of the link, with ServerAddr as its peer.
+type P2PLink struct {
+	Subnet     string `json:"subnet"`
+	ServerAddr net.IP `json:"server_addr"`
+	ClientAddr net.IP `json:"client_addr"`
+}
+
+// Tracks which subnets of the pools are assigned to which routed vpns.
+type IPAM struct {
+	sync.Mutex
+
+	// The pools to allocate from, in order of preference.
+	pools []*net.IPNet
+
+	// The file in which we persist the assignments.
+	path string
+
+	// The subnet assigned to each routed vpn.
+	assigned map[UniqueId]*net.IPNet
+}
+
+// The size of the subnets we allocate from `pool`: /30 for IPv4, or /127
+// for IPv6.
+func subnetBits(pool *net.IPNet) int {
+	if pool.IP.To4() != nil {
+		return 30
+	}
+	return 127
+}
+
+// Parse the pools in `pools`, each a subnet in CIDR notation, checking that
+// each is large enough to hold at least one link, and that no two overlap.
+func parsePools(pools []string) ([]*net.IPNet, error) {
+	ret := []*net.IPNet{}
+	for _, s := range pools {
+		_, pool, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address pool %q: %v", s, err)
+		}
+		if pool.IP.To4() != nil {
+			pool.IP = pool.IP.To4()
+		}
+		if ones, _ := pool.Mask.Size(); ones > subnetBits(pool) {
+			return nil, fmt.Errorf("Address pool %s is too small; it must be "+
+				"at least a /%d", pool, subnetBits(pool))
+		}
+		for _, other := range ret {
+			if other.Contains(pool.IP) || pool.Contains(other.IP) {
+				return nil, fmt.Errorf("Address pools %s and %s overlap",
+					other, pool)
+			}
+		}
+		ret = append(ret, pool)
+	}
+	return ret, nil
+}
+
+// Create an IPAM allocating from `pools` (see parsePools), loading its
+// assignments from the file at `path`, if it exists. Assignments to vpns
+// which no longer exist, per `states`, are dropped. The rest must each be
+// a link's subnet in one of the pools (see checkAssigned), so that they
+// can't overlap anything we allocate later.
+func newIPAM(pools []string, path string, states *VpnStates) (*IPAM, error) {
+	parsed, err := parsePools(pools)
+	if err != nil {
+		return nil, err
+	}
+	m := &IPAM{pools: parsed, path: path, assigned: map[UniqueId]*net.IPNet{}}
+	if path == "" {
+		return m, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Reading IPAM state: %v", err)
+	}
+	saved := map[string]string{}
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("Parsing IPAM state %s: %v", path, err)
+	}
+	states.Lock()
+	defer states.Unlock()
+	stale := false
+	for idStr, subnetStr := range saved {
+		var id UniqueId
+		idSlice, err := hex.DecodeString(idStr)
+		_, subnet, subnetErr := net.ParseCIDR(subnetStr)
+		if err != nil || len(idSlice) != len(id) || subnetErr != nil {
+			return nil, fmt.Errorf("Invalid assignment in IPAM state %s: %q: %q",
+				path, idStr, subnetStr)
+		}
+		copy(id[:], idSlice)
+		if _, ok := states.UsedPorts[id]; !ok {
+			stale = true
+			continue
+		}
+		m.assigned[id] = subnet
+	}
+	if err = m.checkAssigned(); err != nil {
+		return nil, fmt.Errorf("Invalid IPAM state %s: %v", path, err)
+	}
+	if stale {
+		if err = m.save(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Report whether routed vpns are enabled, i.e. whether there are any pools.
+func (m *IPAM) Enabled() bool {
+	return len(m.pools) != 0
+}
+
+// Check that each of the assignments is the subnet of a link in one of the
+// pools, and that no two vpns share one. If the pools were changed while
+// routed vpns existed, this may not be so.
+func (m *IPAM) checkAssigned() error {
+	owners := map[string]UniqueId{}
+	for id, subnet := range m.assigned {
+		var pool *net.IPNet
+		for _, p := range m.pools {
+			if len(p.IP) == len(subnet.IP) && p.Contains(subnet.IP) {
+				pool = p
+				break
+			}
+		}
+		if pool == nil {
+			return fmt.Errorf("The link %s of vpn %x is not in any of the "+
+				"address pools", subnet, id)
+		}
+		if ones, _ := subnet.Mask.Size(); ones != subnetBits(pool) {
+			return fmt.Errorf("The link %s of vpn %x is not a /%d",
+				subnet, id, subnetBits(pool))
+		}
+		if owner, ok := owners[subnet.String()]; ok {
+			return fmt.Errorf("The link %s is assigned to both vpn %x and "+
+				"vpn %x", subnet, owner, id)
+		}
+		owners[subnet.String()] = id
+	}
+	return nil
+}
+
+// Allocate links for each of the routed vpns in `ids` at once, returning
+// them in the same order. Either all of them are allocated, or none are,
+// as with VpnStates.NewVpns. May return ErrNoFreeSubnets if the pools are
+// used up, or ErrNoPools if there aren't any.
+func (m *IPAM) AllocN(ids []UniqueId) ([]*P2PLink, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.Enabled() {
+		return nil, ErrNoPools
+	}
+	used := map[string]bool{}
+	for _, subnet := range m.assigned {
+		used[subnet.String()] = true
+	}
+	subnets := make([]*net.IPNet, len(ids))
+	for i := range ids {
+		subnets[i] = m.findFree(used)
+		if subnets[i] == nil {
+			return nil, ErrNoFreeSubnets
+		}
+		used[subnets[i].String()] = true
+	}
+	for i, id := range ids {
+		m.assigned[id] = subnets[i]
+	}
+	if err := m.save(); err != nil {
+		for _, id := range ids {
+			delete(m.assigned, id)
+		}
+		return nil, err
+	}
+	links := make([]*P2PLink, len(ids))
+	for i := range ids {
+		links[i] = linkFor(subnets[i])
+	}
+	return links, nil
+}
+
+// Return the link for the vpn `id` to the pools, if it has one. As with
+// VpnStates.ReleasePort, this must only be done once the vpn is gone.
+//
+// Failing to save the change is logged, but the link is freed regardless;
+// the stale assignment is dropped when the state file is next loaded (see
+// newIPAM), since the vpn no longer exists.
+func (m *IPAM) Release(id UniqueId) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.assigned[id]; !ok {
+		return
+	}
+	delete(m.assigned, id)
+	if err := m.save(); err != nil {
+		log.Println("Warning:", err)
+	}
+}
+
+// Return the first subnet of the pools which isn't in `used`, or nil if
+// there are none.
+func (m *IPAM) findFree(used map[string]bool) *net.IPNet {
+	for _, pool := range m.pools {
+		bits := subnetBits(pool)
+		mask := net.CIDRMask(bits, 8*len(pool.IP))
+		step := big.NewInt(1 << uint(8*len(pool.IP)-bits))
+		addr := new(big.Int).SetBytes(pool.IP)
+		// Each subnet we skip is in `used`, so this takes at most
+		// len(used)+1 steps per pool.
+		for {
+			subnet := &net.IPNet{IP: bigToIP(addr, len(pool.IP)), Mask: mask}
+			if subnet.IP == nil || !pool.Contains(subnet.IP) {
+				break
+			}
+			if !used[subnet.String()] {
+				return subnet
+			}
+			addr.Add(addr, step)
+		}
+	}
+	return nil
+}
+
+// Return the addresses of the link with the subnet `subnet`.
+func linkFor(subnet *net.IPNet) *P2PLink {
+	addr := new(big.Int).SetBytes(subnet.IP)
+	if ones, _ := subnet.Mask.Size(); ones == 30 {
+		// Skip the network address.
+		addr.Add(addr, big.NewInt(1))
+	}
+	server := bigToIP(addr, len(subnet.IP))
+	client := bigToIP(addr.Add(addr, big.NewInt(1)), len(subnet.IP))
+	return &P2PLink{Subnet: subnet.String(), ServerAddr: server, ClientAddr: client}
+}
+
+// Return `n` as an IP address of `size` bytes, or nil if it doesn't fit.
+func bigToIP(n *big.Int, size int) net.IP {
+	b := n.Bytes()
+	if len(b) > size {
+		return nil
+	}
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+// Write the assignments to the state file, replacing it atomically, and
+// make sure the new file has reached the disk before returning. The caller
+// must hold the lock.
+func (m *IPAM) save() error {
+	if m.path == "" {
+		return nil
+	}
+	saved := map[string]string{}
+	for id, subnet := range m.assigned {
+		saved[fmt.Sprintf("%x", id)] = subnet.String()
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), filepath.Base(m.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Saving IPAM state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.path)
+	}
+	if err == nil {
+		// The rename is only durable once the directory is synced:
+		err = syncDir(filepath.Dir(m.path))
+	}
+	if err != nil {
+		return fmt.Errorf("Saving IPAM state: %v", err)
+	}
+	return nil
+}
+
+// Flush the directory `dir` to disk, so that entries which have been
+// added to or removed from it persist across a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a VpnStates in which each of `ids` exists.
+func statesWith(ids ...UniqueId) *VpnStates {
+	states := newStates(config{MinPort: 4000, MaxPort: 4009}, []string{})
+	for i, id := range ids {
+		states.RestoreVpn(id, uint16(4000+i))
+	}
+	return states
+}
+
+// Allocate a link for the routed vpn `id` alone.
+func allocOne(ipam *IPAM, id UniqueId) (*P2PLink, error) {
+	links, err := ipam.AllocN([]UniqueId{id})
+	if err != nil {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+// Return the link assigned to the routed vpn `id`, or nil if it has none.
+func assignedLink(ipam *IPAM, id UniqueId) *P2PLink {
+	ipam.Lock()
+	defer ipam.Unlock()
+	subnet, ok := ipam.assigned[id]
+	if !ok {
+		return nil
+	}
+	return linkFor(subnet)
+}
+
+// Check that `link` has the given addresses.
+func checkLink(t *testing.T, link *P2PLink, subnet, server, client string) {
+	if link == nil {
+		t.Fatalf("Expected link %s, but got none.", subnet)
+	}
+	if link.Subnet != subnet || link.ServerAddr.String() != server ||
+		link.ClientAddr.String() != client {
+		t.Fatalf("Expected link %s (server %s, client %s), but got %+v",
+			subnet, server, client, link)
+	}
+}
+
+func TestIPAM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-ipam-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.json")
+	pools := []string{"10.0.0.0/29", "fd00::/126"}
+
+	ids := []UniqueId{{1}, {2}, {3}, {4}, {5}}
+	states := statesWith(ids...)
+	ipam, err := newIPAM(pools, path, states)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocate links, making sure we get them in the expected order:
+	expected := [][3]string{
+		{"10.0.0.0/30", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.4/30", "10.0.0.5", "10.0.0.6"},
+		{"fd00::/127", "fd00::", "fd00::1"},
+		{"fd00::2/127", "fd00::2", "fd00::3"},
+	}
+	for i, want := range expected {
+		link, err := allocOne(ipam, ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLink(t, link, want[0], want[1], want[2])
+	}
+
+	// We should be out of subnets now:
+	if _, err = allocOne(ipam, ids[4]); err != ErrNoFreeSubnets {
+		t.Fatal("Should have gotten ErrNoFreeSubnets, but err was ", err)
+	}
+
+	// Released subnets are re-used:
+	ipam.Release(ids[1])
+	ipam.Release(ids[1])
+	link, err := allocOne(ipam, ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, link, "10.0.0.4/30", "10.0.0.5", "10.0.0.6")
+
+	// Allocating several links at once either gets all of them, or none:
+	ipam.Release(ids[0])
+	if _, err = ipam.AllocN([]UniqueId{ids[1], ids[0]}); err != ErrNoFreeSubnets {
+		t.Fatal("Should have gotten ErrNoFreeSubnets, but err was ", err)
+	}
+	if assignedLink(ipam, ids[0]) != nil || assignedLink(ipam, ids[1]) != nil {
+		t.Fatal("A failed AllocN allocated links anyway.")
+	}
+
+	// The assignments survive a restart, except for those of vpns
+	// which are gone by then:
+	ipam, err = newIPAM(pools, path, statesWith(ids[2], ids[4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, assignedLink(ipam, ids[2]), "fd00::/127", "fd00::", "fd00::1")
+	checkLink(t, assignedLink(ipam, ids[4]), "10.0.0.4/30", "10.0.0.5", "10.0.0.6")
+	if assignedLink(ipam, ids[3]) != nil {
+		t.Fatal("Kept the link of a vpn which no longer exists.")
+	}
+	link, err = allocOne(ipam, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLink(t, link, "10.0.0.0/30", "10.0.0.1", "10.0.0.2")
+}
+
+// Routed vpns are disabled without any pools.
+func TestIPAMNoPools(t *testing.T) {
+	ipam, err := newIPAM(nil, "", statesWith())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipam.Enabled() {
+		t.Fatal("IPAM with no pools claims to be enabled.")
+	}
+	if _, err = allocOne(ipam, UniqueId{1}); err != ErrNoPools {
+		t.Fatal("Should have gotten ErrNoPools, but err was ", err)
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	good := []string{"10.0.0.0/30", "192.168.0.0/16", "fd00::/127", "fd01::/64"}
+	if _, err := parsePools(good); err != nil {
+		t.Fatal("Rejected valid pools:", err)
+	}
+	for _, pool := range []string{"10.0.0.0/31", "fd00::/128", "10.0.0.0", "bogus"} {
+		if _, err := parsePools([]string{pool}); err == nil {
+			t.Errorf("Accepted invalid pool %q", pool)
+		}
+	}
+	overlapping := [][]string{
+		{"10.0.0.0/24", "10.0.0.128/25"},
+		{"10.0.0.4/30", "10.0.0.0/16"},
+		{"fd00::/64", "fd00::/64"},
+	}
+	for _, pools := range overlapping {
+		if _, err := parsePools(pools); err == nil {
+			t.Errorf("Accepted overlapping pools %v", pools)
+		}
+	}
+}
+
+// Saved assignments which don't fit the pools are refused, rather than
+// risking handing out addresses which are already in use.
+func TestIPAMBadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hil-vpn-ipam-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.json")
+	pools := []string{"10.0.0.0/29", "fd00::/126"}
+	a, b := UniqueId{1}, UniqueId{2}
+	states := statesWith(a, b)
+
+	good := fmt.Sprintf(`{"%x": "10.0.0.4/30", "%x": "fd00::2/127"}`, a, b)
+	bad := []string{
+		// Outside the pools:
+		fmt.Sprintf(`{"%x": "10.0.1.0/30"}`, a),
+		// Not the size of a link, and overlapping others:
+		fmt.Sprintf(`{"%x": "10.0.0.0/29"}`, a),
+		// Shared by two vpns:
+		fmt.Sprintf(`{"%x": "10.0.0.4/30", "%x": "10.0.0.4/30"}`, a, b),
+	}
+	for _, state := range append([]string{good}, bad...) {
+		if err = ioutil.WriteFile(path, []byte(state), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = newIPAM(pools, path, states)
+		if state == good && err != nil {
+			t.Fatalf("Refused valid state %s: %v", state, err)
+		} else if state != good && err == nil {
+			t.Errorf("Accepted invalid state %s", state)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 
@@ -15,6 +16,31 @@ type config struct {
 	MaxPort      int         `env:"MAX_VPN_PORT,required"`
 	AdminToken   token.Token `env:"ADMIN_TOKEN,required"`
 	ServerConfig httpserver.Config
+
+	// If set, talk to hil-vpn-privop running as a service on this socket,
+	// instead of invoking it via sudo.
+	PrivOpSocket string `env:"PRIVOP_SOCKET"`
+
+	// If true, start up even if some of hil-vpn-privop's preflight
+	// checks fail, logging a warning instead.
+	PreflightWarnOnly bool `env:"PREFLIGHT_WARN_ONLY"`
+
+	// How long to wait for each privileged operation.
+	PrivOpTimeouts privOpTimeouts
+
+	// How to retry privileged operations which fail transiently.
+	PrivOpRetries privOpRetries
+
+	// How to restart vpns which fail.
+	RestartPolicy restartPolicy
+
+	// Subnets (in CIDR notation) from which to allocate routed vpns'
+	// point-to-point links; see IPAM. If empty, routed vpns are disabled.
+	RoutedPools []string `env:"ROUTED_POOLS" envSeparator:","`
+
+	// The file in which to persist the links' assignments. Required if
+	// RoutedPools is set.
+	IPAMStateFile string `env:"IPAM_STATE_FILE"`
 }
 
 // Parse and validate the config, then return it.
@@ -26,6 +52,18 @@ func getConfig() config {
 	if err := env.Parse(&cfg.ServerConfig); err != nil {
 		log.Fatal("Parsing config from environment: ", err)
 	}
+	if err := env.Parse(&cfg.PrivOpTimeouts); err != nil {
+		log.Fatal("Parsing config from environment: ", err)
+	}
+	if err := env.Parse(&cfg.PrivOpRetries); err != nil {
+		log.Fatal("Parsing config from environment: ", err)
+	}
+	if err := env.Parse(&cfg.RestartPolicy); err != nil {
+		log.Fatal("Parsing config from environment: ", err)
+	}
+	if err := cfg.RestartPolicy.check(); err != nil {
+		log.Fatal("Config error: ", err)
+	}
 	if err := cfg.ServerConfig.Validate(); err != nil {
 		log.Fatal(err)
 	}
@@ -39,15 +77,30 @@ func getConfig() config {
 	if cfg.MaxPort >= (1 << 16) {
 		log.Fatalf("MAX_VPN_PORT is out of range (%d)", cfg.MaxPort)
 	}
+	if _, err := parsePools(cfg.RoutedPools); err != nil {
+		log.Fatal("Config error: ROUTED_POOLS: ", err)
+	}
+	if len(cfg.RoutedPools) != 0 && cfg.IPAMStateFile == "" {
+		log.Fatal("Config error: ROUTED_POOLS is set, but IPAM_STATE_FILE is not")
+	}
 	return cfg
 }
 
 func main() {
 	cfg := getConfig()
-	daemon, err := newDaemon(cfg, PrivOpsCmd{})
+	var privops PrivOps = PrivOpsCmd{}
+	if cfg.PrivOpSocket != "" {
+		privops = PrivOpsSocket{Path: cfg.PrivOpSocket}
+	}
+	daemon, err := newDaemon(cfg, privops)
 	if err != nil {
 		log.Fatal(err)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if daemon.health != nil {
+		daemon.health.Start(ctx)
+	}
 	http.Handle("/", daemon.handler)
 	panic(httpserver.Run(&cfg.ServerConfig, nil))
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
 	"github.com/CCI-MOC/hil-vpn/internal/validate"
 )
 
@@ -13,12 +16,46 @@ import (
 type MockPrivOps struct {
 	lock sync.Mutex
 	vpns map[string]*vpnInfo
+
+	// The dryRun argument of each call to RegenVPNs, in order.
+	regenCalls []bool
+
+	// Problems to be reported by VerifyVPNs.
+	problems []privproto.Problem
+
+	// The version to be reported by Version. If nil, the mock reports
+	// the current protocol version, with all features.
+	version *privproto.Version
+
+	// Checks to be reported by Preflight.
+	checks []privproto.Check
+
+	// Delays to inject into the named methods (e.g. "StartVPN"), which
+	// wait this long (or until their context is done) before doing
+	// anything else.
+	delays map[string]time.Duration
+
+	// Errors to be returned by the named methods (e.g. "StartVPN"),
+	// which then do nothing else.
+	errs map[string]error
+
+	// If a method has an entry here, its error in errs is only returned
+	// this many more times, after which the method succeeds.
+	errCounts map[string]int
+
+	// Events to be sent by Watch. StartVPN and StopVPN send events here
+	// as systemd would, and tests may send their own (e.g. see crash).
+	events chan privproto.Event
 }
 
 // Create a new MockPrivOps, with no existent vpns.
 func NewMockPrivOps() *MockPrivOps {
 	return &MockPrivOps{
-		vpns: make(map[string]*vpnInfo),
+		vpns:      make(map[string]*vpnInfo),
+		delays:    make(map[string]time.Duration),
+		errs:      make(map[string]error),
+		errCounts: make(map[string]int),
+		events:    make(chan privproto.Event, 64),
 	}
 }
 
@@ -27,8 +64,15 @@ type vpnInfo struct {
 	// The port number that openvpn would listen on
 	portNo uint16
 
-	// The vlan number for the network
-	vlanNo uint16
+	// The vlans carried by the vpn, and whether it carries them tagged,
+	// or its VNI if it is on a vxlan network
+	vlans  []uint16
+	tagged bool
+	vni    uint32
+
+	// The point-to-point link of a routed vpn, in which case it has no
+	// vlans or VNI
+	link *P2PLink
 
 	// The OpenVPN static key. For testing we just use a random
 	// string here.
@@ -59,12 +103,28 @@ func (ops *MockPrivOps) mustGetVpn(name string) *vpnInfo {
 
 //// Implementations of the methods needed to implement the PrivOps interface.
 
-func (ops *MockPrivOps) CreateVPN(name string, vlanNo uint16, portNo uint16) (string, error) {
+func (ops *MockPrivOps) CreateVPN(ctx context.Context, name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) (string, error) {
+	return ops.create(ctx, name, &vpnInfo{portNo: portNo, vlans: vlans, tagged: tagged, vni: vni})
+}
+
+func (ops *MockPrivOps) CreateRoutedVPN(ctx context.Context, name string, link *P2PLink, portNo uint16) (string, error) {
+	return ops.create(ctx, name, &vpnInfo{portNo: portNo, link: link})
+}
+
+// Helper for CreateVPN and CreateRoutedVPN, which adds the vpn described by
+// `vpn` (sans its key).
+func (ops *MockPrivOps) create(ctx context.Context, name string, vpn *vpnInfo) (string, error) {
+	if err := ops.delay(ctx, "CreateVPN"); err != nil {
+		return "", err
+	}
 	if err := validate.CheckVpnName(name); err != nil {
 		panic(err)
 	}
 	ops.startOp()
 	defer ops.endOp()
+	if err := ops.injectedErr("CreateVPN"); err != nil {
+		return "", err
+	}
 	if _, ok := ops.vpns[name]; ok {
 		panic(fmt.Sprintf(
 			"Tried to create a vpn with the same name (%q) as an existing one.",
@@ -77,40 +137,57 @@ func (ops *MockPrivOps) CreateVPN(name string, vlanNo uint16, portNo uint16) (st
 		return "", err
 	}
 
-	ops.vpns[name] = &vpnInfo{
-		portNo: portNo,
-		vlanNo: vlanNo,
-		key:    key,
-	}
+	vpn.key = key
+	ops.vpns[name] = vpn
 
 	return key, nil
 }
 
-func (ops *MockPrivOps) StartVPN(name string) error {
+func (ops *MockPrivOps) StartVPN(ctx context.Context, name string) error {
+	if err := ops.delay(ctx, "StartVPN"); err != nil {
+		return err
+	}
 	ops.startOp()
 	defer ops.endOp()
+	if err := ops.injectedErr("StartVPN"); err != nil {
+		return err
+	}
 	vpn := ops.mustGetVpn(name)
 	if vpn.running {
 		panic(fmt.Sprintf("Tried to start already-running vpn %q", name))
 	}
 	vpn.running = true
+	ops.sendEvent(privproto.Event{Vpn: name, State: "active"})
 	return nil
 }
 
-func (ops *MockPrivOps) StopVPN(name string) error {
+func (ops *MockPrivOps) StopVPN(ctx context.Context, name string) error {
+	if err := ops.delay(ctx, "StopVPN"); err != nil {
+		return err
+	}
 	ops.startOp()
 	defer ops.endOp()
+	if err := ops.injectedErr("StopVPN"); err != nil {
+		return err
+	}
 	vpn := ops.mustGetVpn(name)
 	if !vpn.running {
 		panic(fmt.Sprintf("Tried to stop vpn %q, which is not running.", name))
 	}
 	vpn.running = false
+	ops.sendEvent(privproto.Event{Vpn: name, State: "inactive"})
 	return nil
 }
 
-func (ops *MockPrivOps) DeleteVPN(name string) error {
+func (ops *MockPrivOps) DeleteVPN(ctx context.Context, name string) error {
+	if err := ops.delay(ctx, "DeleteVPN"); err != nil {
+		return err
+	}
 	ops.startOp()
 	defer ops.endOp()
+	if err := ops.injectedErr("DeleteVPN"); err != nil {
+		return err
+	}
 	vpn, ok := ops.vpns[name]
 	if !ok {
 		panic(fmt.Sprintf("Tried to delete non-existent vpn %q", name))
@@ -122,7 +199,10 @@ func (ops *MockPrivOps) DeleteVPN(name string) error {
 	return nil
 }
 
-func (ops *MockPrivOps) ListVPNs() ([]string, error) {
+func (ops *MockPrivOps) ListVPNs(ctx context.Context) ([]string, error) {
+	if err := ops.delay(ctx, "ListVPNs"); err != nil {
+		return nil, err
+	}
 	ops.startOp()
 	defer ops.endOp()
 	ret := make([]string, 0, len(ops.vpns))
@@ -132,6 +212,285 @@ func (ops *MockPrivOps) ListVPNs() ([]string, error) {
 	return ret, nil
 }
 
+func (ops *MockPrivOps) RegenVPNs(ctx context.Context, dryRun bool) (string, error) {
+	if err := ops.delay(ctx, "RegenVPNs"); err != nil {
+		return "", err
+	}
+	ops.startOp()
+	defer ops.endOp()
+	ops.regenCalls = append(ops.regenCalls, dryRun)
+	return "", nil
+}
+
+func (ops *MockPrivOps) VerifyVPNs(ctx context.Context) ([]privproto.Problem, error) {
+	if err := ops.delay(ctx, "VerifyVPNs"); err != nil {
+		return nil, err
+	}
+	ops.startOp()
+	defer ops.endOp()
+	return ops.problems, nil
+}
+
+func (ops *MockPrivOps) Batch(ctx context.Context, reqs []privproto.Request, atomic bool) ([]privproto.Response, error) {
+	if err := ops.delay(ctx, "Batch"); err != nil {
+		return nil, err
+	}
+	ops.lock.Lock()
+	err := ops.injectedErr("Batch")
+	ops.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []privproto.Response{}
+	var undo []func() error
+	for i, req := range reqs {
+		var resp privproto.Response
+		var undoReq func() error
+		switch req.Op {
+		case privproto.OpCreate:
+			if req.ServerAddr != nil {
+				link := &P2PLink{ServerAddr: req.ServerAddr, ClientAddr: req.ClientAddr}
+				resp.Key, err = ops.CreateRoutedVPN(ctx, req.Name, link, req.Port)
+			} else {
+				resp.Key, err = ops.CreateVPN(ctx, req.Name, req.VlanSet(), req.Tagged(), req.Vni, req.Port)
+			}
+			undoReq = func() error { return ops.DeleteVPN(ctx, req.Name) }
+		case privproto.OpStart:
+			err = ops.StartVPN(ctx, req.Name)
+			undoReq = func() error { return ops.StopVPN(ctx, req.Name) }
+		case privproto.OpStop:
+			err = ops.StopVPN(ctx, req.Name)
+			undoReq = func() error { return ops.StartVPN(ctx, req.Name) }
+		case privproto.OpDelete:
+			ops.lock.Lock()
+			saved := *ops.mustGetVpn(req.Name)
+			ops.lock.Unlock()
+			err = ops.DeleteVPN(ctx, req.Name)
+			undoReq = func() error {
+				ops.startOp()
+				defer ops.endOp()
+				ops.vpns[req.Name] = &saved
+				return nil
+			}
+		default:
+			err = &privproto.Error{
+				Code:    privproto.ErrInvalidArgument,
+				Message: "Operation may not be used in a batch: " + req.Op,
+			}
+		}
+		if err != nil {
+			resp.Error = mockError(err)
+		} else {
+			undo = append(undo, undoReq)
+		}
+		results = append(results, resp)
+		if err != nil && atomic {
+			for j := len(undo) - 1; j >= 0; j-- {
+				if err := undo[j](); err != nil {
+					panic(fmt.Sprintf("Rolling back batch: %v", err))
+				}
+			}
+			return results, &privproto.Error{
+				Code:    resp.Error.Code,
+				Message: fmt.Sprintf("request %d of batch: %s", i, resp.Error.Message),
+			}
+		}
+	}
+	return results, nil
+}
+
+func (ops *MockPrivOps) Version(ctx context.Context) (privproto.Version, error) {
+	if err := ops.delay(ctx, "Version"); err != nil {
+		return privproto.Version{}, err
+	}
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	if err := ops.injectedErr("Version"); err != nil {
+		return privproto.Version{}, err
+	}
+	if ops.version != nil {
+		return *ops.version, nil
+	}
+	return privproto.Version{
+		Protocol:    privproto.ProtocolVersion,
+		Features:    privproto.Features,
+		NamePattern: validate.VpnNamePattern,
+	}, nil
+}
+
+func (ops *MockPrivOps) Preflight(ctx context.Context) ([]privproto.Check, error) {
+	if err := ops.delay(ctx, "Preflight"); err != nil {
+		return nil, err
+	}
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	if err := ops.injectedErr("Preflight"); err != nil {
+		return nil, err
+	}
+	return ops.checks, nil
+}
+
+func (ops *MockPrivOps) Watch(ctx context.Context, events chan<- privproto.Event) error {
+	ops.lock.Lock()
+	if err := ops.injectedErr("Watch"); err != nil {
+		ops.lock.Unlock()
+		return err
+	}
+	var initial []privproto.Event
+	for name, vpn := range ops.vpns {
+		ev := privproto.Event{Vpn: name, State: "inactive"}
+		if vpn.running {
+			ev.State = "active"
+		}
+		initial = append(initial, ev)
+	}
+	ops.lock.Unlock()
+	for _, ev := range initial {
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		select {
+		case ev := <-ops.events:
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Simulate the named vpn's openvpn crashing, with the service manager
+// giving up on it.
+func (ops *MockPrivOps) crash(name, result string) {
+	ops.startOp()
+	defer ops.endOp()
+	ops.mustGetVpn(name).running = false
+	ops.sendEvent(privproto.Event{Vpn: name, State: "failed", Result: result})
+}
+
+// Queue `ev` to be sent by Watch. If nothing is watching, and the queue is
+// full, it is dropped. The caller must hold ops.lock.
+func (ops *MockPrivOps) sendEvent(ev privproto.Event) {
+	select {
+	case ops.events <- ev:
+	default:
+	}
+}
+
+//// Helpers for tests. The daemon may call the mock from other goroutines
+//// (e.g. the http server's), so tests must go through these, which lock
+//// the ops value, rather than touching its fields directly.
+
+// Return a copy of the vpns, by name.
+func (ops *MockPrivOps) snapshot() map[string]vpnInfo {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	ret := make(map[string]vpnInfo, len(ops.vpns))
+	for name, vpn := range ops.vpns {
+		ret[name] = *vpn
+	}
+	return ret
+}
+
+// Return a copy of regenCalls.
+func (ops *MockPrivOps) getRegenCalls() []bool {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	return append([]bool{}, ops.regenCalls...)
+}
+
+// Make `method` fail with `err`, or succeed again if err is nil.
+func (ops *MockPrivOps) setErr(method string, err error) {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	if err == nil {
+		delete(ops.errs, method)
+	} else {
+		ops.errs[method] = err
+	}
+	delete(ops.errCounts, method)
+}
+
+// Make `method` fail with `err` only `count` more times.
+func (ops *MockPrivOps) setErrCount(method string, err error, count int) {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	ops.errs[method] = err
+	ops.errCounts[method] = count
+}
+
+// Return how many more times `method` will fail; see setErrCount.
+func (ops *MockPrivOps) errsLeft(method string) int {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	return ops.errCounts[method]
+}
+
+// Make `method` wait for `d` before doing anything, or not at all if d is
+// zero.
+func (ops *MockPrivOps) setDelay(method string, d time.Duration) {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	if d == 0 {
+		delete(ops.delays, method)
+	} else {
+		ops.delays[method] = d
+	}
+}
+
+// Set the problems to be reported by VerifyVPNs.
+func (ops *MockPrivOps) setProblems(problems []privproto.Problem) {
+	ops.lock.Lock()
+	defer ops.lock.Unlock()
+	ops.problems = problems
+}
+
+// Convert `err` to a *privproto.Error, as hil-vpn-privop would report it.
+func mockError(err error) *privproto.Error {
+	if e, ok := err.(*privproto.Error); ok {
+		return e
+	}
+	return &privproto.Error{Code: privproto.ErrInternal, Message: err.Error()}
+}
+
+// Return the error to be injected into `method`, if any. The caller must
+// hold ops.lock.
+func (ops *MockPrivOps) injectedErr(method string) error {
+	err := ops.errs[method]
+	if count, ok := ops.errCounts[method]; ok && err != nil {
+		if count == 0 {
+			return nil
+		}
+		ops.errCounts[method] = count - 1
+	}
+	return err
+}
+
+// Wait for the delay configured for `method`, if any. Returns ctx.Err() if
+// ctx is done first.
+func (ops *MockPrivOps) delay(ctx context.Context, method string) error {
+	ops.lock.Lock()
+	d := ops.delays[method]
+	ops.lock.Unlock()
+	if d == 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 //// Internal consistency stuff.
 
 // Call this at the start of every privileged operation; it locks the ops
@@ -153,6 +512,7 @@ func (ops *MockPrivOps) validate() {
 	// Keep track of what port numbers we've seen as we walk through
 	// the set of vpns.
 	usedPorts := make(map[uint16]struct{})
+	usedAddrs := make(map[string]struct{})
 
 	for k, v := range ops.vpns {
 		// Make sure the port number isn't used by any vpn we've seen in
@@ -166,12 +526,32 @@ func (ops *MockPrivOps) validate() {
 		// OK, we're good. Add this to the list for later checks:
 		usedPorts[v.portNo] = struct{}{}
 
-		// Make sure the vlan number is valid:
-		if v.vlanNo == 0 || v.vlanNo > 4096 {
+		if v.link != nil {
+			// Make sure the link is valid, and doesn't overlap any
+			// other's:
+			err := validate.CheckP2PAddrs(v.link.ServerAddr, v.link.ClientAddr)
+			if err != nil {
+				panic(fmt.Sprintf("Illegal link for vpn %q: %v", k, err))
+			}
+			for _, addr := range []string{v.link.ServerAddr.String(), v.link.ClientAddr.String()} {
+				if _, ok := usedAddrs[addr]; ok {
+					panic(fmt.Sprintf(
+						"Address %s is used by more than one vpn!",
+						addr,
+					))
+				}
+				usedAddrs[addr] = struct{}{}
+			}
+			continue
+		}
+
+		// Make sure the network is valid:
+		_, _, _, err := validate.ParseNetwork(createRequest(k, v.vlans, v.tagged, v.vni, v.portNo).Network())
+		if err != nil {
 			panic(fmt.Sprintf(
-				"Illegal vlan number for vpn %q: %d",
+				"Illegal network for vpn %q: %v",
 				k,
-				v.vlanNo,
+				err,
 			))
 		}
 	}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// Explain a failure to run hil-vpn-privop at all, which is most often due
+// to a misconfiguration of sudo.
+func privOpUnavailable(err error) error {
+	return fmt.Errorf("Could not run hil-vpn-privop: %v. If hil-vpnd uses "+
+		"sudo, make sure this user may run %s/hil-vpn-privop as root "+
+		"without a password; if PRIVOP_SOCKET is set, make sure "+
+		"`hil-vpn-privop serve` is running.", err, staticconfig.Libexecdir)
+}
+
+// Run hil-vpn-privop's preflight checks, logging a report of the results.
+// Returns an error if any of them failed.
+func preflight(ctx context.Context, privops PrivOps) error {
+	checks, err := privops.Preflight(ctx)
+	if _, ok := err.(*privproto.Error); err != nil && !ok {
+		return privOpUnavailable(err)
+	} else if err != nil {
+		return fmt.Errorf("Running preflight checks: %v", err)
+	}
+	failed := 0
+	for _, c := range checks {
+		if c.OK {
+			log.Printf("preflight: ok: %s: %s", c.Name, c.Detail)
+			continue
+		}
+		failed++
+		log.Printf("preflight: FAILED: %s: %s", c.Name, c.Detail)
+		if c.Fix != "" {
+			log.Printf("preflight:     to fix: %s", c.Fix)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d preflight checks failed; see above.",
+			failed, len(checks))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Test that the daemon refuses to start if preflight checks fail, unless
+// configured to only warn.
+func TestPreflight(t *testing.T) {
+	cfg := config{
+		AdminToken: adminToken,
+		MinPort:    5000,
+		MaxPort:    5009,
+	}
+	ops := NewMockPrivOps()
+	ops.checks = []privproto.Check{
+		{Name: "root", OK: true, Detail: "running as root"},
+		{Name: "openvpn", Detail: "openvpn not found", Fix: "Install openvpn."},
+	}
+	if _, err := newDaemon(cfg, ops); err == nil {
+		t.Fatal("Daemon started despite a failing preflight check.")
+	}
+
+	cfg.PreflightWarnOnly = true
+	if _, err := newDaemon(cfg, ops); err != nil {
+		t.Fatal("Daemon failed to start with PreflightWarnOnly set:", err)
+	}
+
+	// If hil-vpn-privop can't run at all, the error should point at
+	// sudo:
+	ops.checks[1].OK = true
+	ops.version = nil
+	ops.errs["Preflight"] = errors.New("exit status 1")
+	cfg.PreflightWarnOnly = false
+	_, err := newDaemon(cfg, ops)
+	if err == nil || !strings.Contains(err.Error(), "sudo") {
+		t.Fatalf("Expected an error mentioning sudo, but got %v", err)
+	}
+}
@@ -1,75 +1,295 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
+	"syscall"
+	"time"
 
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
 	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
 )
 
 // The PrivOps interface captures the privileged operations that hil-vpnd
-// needs to perform. In a production setup, we always do this by calling the
-// 'hil-vpn-privop' command (see PrivOpsCmd), but this interface allows us
-// to test more easily.
+// needs to perform. In a production setup, we do this either by calling the
+// 'hil-vpn-privop' command via sudo (see PrivOpsCmd), or by talking to
+// hil-vpn-privop running as a service (see PrivOpsSocket), but this
+// interface allows us to test more easily.
+//
+// Errors returned by PrivOps methods are of type *privproto.Error when the
+// operation itself failed, which callers may inspect to find out why (see
+// privproto.IsCode). Other errors indicate a failure to communicate with
+// hil-vpn-privop at all.
+//
+// Each method takes a context; if it is cancelled or its deadline passes,
+// the method returns ctx.Err(). Note that the operation may still complete
+// in the background; hil-vpn-privop's locking keeps it from interfering
+// with later operations.
 type PrivOps interface {
-	CreateVPN(name string, vlanNo uint16, portNo uint16) (string, error)
-	StartVPN(name string) error
-	StopVPN(name string) error
-	DeleteVPN(name string) error
-	ListVPNs() ([]string, error)
+	// Create a vpn carrying the vlans in `vlans`, tagged if `tagged` is
+	// set, or, if `vni` is non-zero, on that vxlan network, returning its
+	// key. Trunks require privproto.FeatureVlans.
+	CreateVPN(ctx context.Context, name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) (string, error)
+
+	// Create a routed vpn, with the point-to-point link `link`, returning
+	// its key. Requires privproto.FeatureRouted.
+	CreateRoutedVPN(ctx context.Context, name string, link *P2PLink, portNo uint16) (string, error)
+	StartVPN(ctx context.Context, name string) error
+	StopVPN(ctx context.Context, name string) error
+	DeleteVPN(ctx context.Context, name string) error
+	ListVPNs(ctx context.Context) ([]string, error)
+
+	// Re-render the configs of all existing vpns with the current
+	// template. If dryRun is true, nothing is changed, and the
+	// returned string is a diff of the changes that would be made.
+	// Otherwise, it is a list of the vpns whose configs changed.
+	RegenVPNs(ctx context.Context, dryRun bool) (string, error)
+
+	// Check the files of all existing vpns for signs that they have been
+	// modified by something other than hil-vpn-privop.
+	VerifyVPNs(ctx context.Context) ([]privproto.Problem, error)
+
+	// Perform the requests in `reqs` (which must be create, start, stop
+	// or delete requests) in order, returning the result of each. If
+	// atomic is true, either all of them succeed, or the ones already
+	// performed are rolled back, and the error is that of the request
+	// which failed; the results then stop at that request.
+	Batch(ctx context.Context, reqs []privproto.Request, atomic bool) ([]privproto.Response, error)
+
+	// Report the protocol version and features supported by
+	// hil-vpn-privop. See checkVersion.
+	Version(ctx context.Context) (privproto.Version, error)
+
+	// Check that the environment has everything hil-vpn-privop needs.
+	Preflight(ctx context.Context) ([]privproto.Check, error)
+
+	// Send changes in the state of the vpns to `events`, starting with
+	// the current state of each, until ctx is done or the watch fails.
+	// Unlike the other methods, this normally runs indefinitely, and
+	// always returns an error.
+	Watch(ctx context.Context, events chan<- privproto.Event) error
 }
 
 // An implementation of PrivOps that calls the 'hil-vpn-privop' command.
 type PrivOpsCmd struct{}
 
-func privOpCmd(args ...string) *exec.Cmd {
+// How long to give hil-vpn-privop to exit, once asked to; see privOpCmd.
+const privOpKillDelay = 5 * time.Second
+
+func privOpCmd(ctx context.Context, args ...string) *exec.Cmd {
 	sudoArgs := append(
 		[]string{staticconfig.Libexecdir + "/hil-vpn-privop"},
 		args...,
 	)
-	cmd := exec.Command("sudo", sudoArgs...)
+	cmd := exec.CommandContext(ctx, "sudo", sudoArgs...)
 
 	// Pass through stderr; useful for debugging.
 	cmd.Stderr = os.Stderr
 
+	// When ctx is done, exec would normally kill sudo, but that would
+	// leave hil-vpn-privop running, and since it runs as root, we can't
+	// kill it ourselves. Instead, we send SIGTERM, which sudo relays to
+	// hil-vpn-privop, and which makes it exit. sudo doesn't relay signals
+	// from its own process group (it assumes they came from the terminal,
+	// and reached the command directly), so it needs a group of its own.
+	// If they are still around after privOpKillDelay, we give up and kill
+	// sudo after all.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = privOpKillDelay
+
 	return cmd
 }
 
-func (PrivOpsCmd) CreateVPN(name string, vlanNo uint16, portNo uint16) (string, error) {
-	out, err := privOpCmd(
-		"create",
-		name,
-		strconv.Itoa(int(vlanNo)),
-		strconv.Itoa(int(portNo)),
-	).Output()
-	return string(out), err
+// Carry out the request by running hil-vpn-privop in --json mode.
+func (PrivOpsCmd) run(ctx context.Context, req privproto.Request) (privproto.Response, error) {
+	var resp privproto.Response
+	args, err := req.Args()
+	if err != nil {
+		return resp, err
+	}
+	input, err := req.Input()
+	if err != nil {
+		return resp, err
+	}
+	cmd := privOpCmd(ctx, append([]string{"--json"}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	out, runErr := cmd.Output()
+	if err = json.Unmarshal(out, &resp); err != nil {
+		if ctx.Err() != nil {
+			// The command was stopped before it could report a
+			// result; report why, rather than the resulting
+			// "signal: terminated".
+			return resp, ctx.Err()
+		}
+		// hil-vpn-privop didn't get far enough to report a result; most
+		// likely sudo failed.
+		if runErr != nil {
+			return resp, runErr
+		}
+		return resp, fmt.Errorf("Decoding output of hil-vpn-privop: %v", err)
+	}
+	if resp.Error != nil {
+		return resp, resp.Error
+	}
+	return resp, nil
+}
+
+// Return the request to create a vpn carrying `vlans`, tagged if `tagged`
+// is set, or, if `vni` is non-zero, on that vxlan network. A vpn carrying
+// a single vlan untagged is requested with Vlan, which any version of
+// hil-vpn-privop understands; only trunks need privproto.FeatureVlans.
+func createRequest(name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) privproto.Request {
+	req := privproto.Request{Op: privproto.OpCreate, Name: name, Port: portNo}
+	if vni != 0 {
+		req.Vni = vni
+	} else if !tagged {
+		req.Vlan = vlans[0]
+	} else {
+		req.Vlans = vlans
+	}
+	return req
+}
+
+// Return the request to create a routed vpn with the point-to-point link
+// `link`.
+func createRoutedRequest(name string, link *P2PLink, portNo uint16) privproto.Request {
+	return privproto.Request{
+		Op:         privproto.OpCreate,
+		Name:       name,
+		Port:       portNo,
+		ServerAddr: link.ServerAddr,
+		ClientAddr: link.ClientAddr,
+	}
+}
+
+func (ops PrivOpsCmd) CreateVPN(ctx context.Context, name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) (string, error) {
+	resp, err := ops.run(ctx, createRequest(name, vlans, tagged, vni, portNo))
+	return resp.Key, err
 }
 
-func (PrivOpsCmd) StartVPN(name string) error {
-	return privOpCmd("start", name).Run()
+func (ops PrivOpsCmd) CreateRoutedVPN(ctx context.Context, name string, link *P2PLink, portNo uint16) (string, error) {
+	resp, err := ops.run(ctx, createRoutedRequest(name, link, portNo))
+	return resp.Key, err
 }
 
-func (PrivOpsCmd) StopVPN(name string) error {
-	return privOpCmd("stop", name).Run()
+func (ops PrivOpsCmd) StartVPN(ctx context.Context, name string) error {
+	_, err := ops.run(ctx, privproto.Request{Op: privproto.OpStart, Name: name})
+	return err
 }
 
-func (PrivOpsCmd) DeleteVPN(name string) error {
-	return privOpCmd("delete", name).Run()
+func (ops PrivOpsCmd) StopVPN(ctx context.Context, name string) error {
+	_, err := ops.run(ctx, privproto.Request{Op: privproto.OpStop, Name: name})
+	return err
 }
 
-func (PrivOpsCmd) ListVPNs() ([]string, error) {
-	out, err := privOpCmd("list").Output()
+func (ops PrivOpsCmd) DeleteVPN(ctx context.Context, name string) error {
+	_, err := ops.run(ctx, privproto.Request{Op: privproto.OpDelete, Name: name})
+	return err
+}
+
+func (ops PrivOpsCmd) ListVPNs(ctx context.Context) ([]string, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpList})
+	return resp.Vpns, err
+}
+
+func (ops PrivOpsCmd) RegenVPNs(ctx context.Context, dryRun bool) (string, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpRegen, DryRun: dryRun})
+	return regenOutput(resp, dryRun), err
+}
+
+func (ops PrivOpsCmd) VerifyVPNs(ctx context.Context) ([]privproto.Problem, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpVerify})
+	return resp.Problems, err
+}
+
+func (ops PrivOpsCmd) Version(ctx context.Context) (privproto.Version, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpVersion})
+	if err == nil && resp.Version == nil {
+		err = fmt.Errorf("hil-vpn-privop did not report its version")
+	}
 	if err != nil {
-		return nil, err
+		return privproto.Version{}, err
 	}
-	lines := strings.Split(string(out), "\n")
+	return *resp.Version, nil
+}
+
+func (ops PrivOpsCmd) Preflight(ctx context.Context) ([]privproto.Check, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpPreflight})
+	return resp.Checks, err
+}
 
-	// Chop off the trailing empty line, if any:
-	if len(lines) > 0 && lines[len(lines)-1] == "" {
-		lines = lines[:len(lines)-1]
+func (ops PrivOpsCmd) Batch(ctx context.Context, reqs []privproto.Request, atomic bool) ([]privproto.Response, error) {
+	resp, err := ops.run(ctx, privproto.Request{
+		Op:     privproto.OpBatch,
+		Batch:  reqs,
+		Atomic: atomic,
+	})
+	return resp.Results, err
+}
+
+func (ops PrivOpsCmd) Watch(ctx context.Context, events chan<- privproto.Event) error {
+	// Once we stop reading events, hil-vpn-privop has to go, and cancelling
+	// watchCtx makes it do so; see privOpCmd.
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := privOpCmd(watchCtx, "--json", privproto.OpWatch)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
 	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	err = readEvents(ctx, stdout, events)
+	cancel()
+	cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
 
-	return lines, nil
+// Read the stream of responses to a watch request from `r`, sending the
+// events to `events`, until the stream ends or ctx is done.
+func readEvents(ctx context.Context, r io.Reader, events chan<- privproto.Event) error {
+	dec := json.NewDecoder(r)
+	for {
+		var resp privproto.Response
+		if err := dec.Decode(&resp); err == io.EOF {
+			return fmt.Errorf("hil-vpn-privop stopped sending events")
+		} else if err != nil {
+			return err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if resp.Event == nil {
+			continue
+		}
+		select {
+		case events <- *resp.Event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Format the result of a regen request as described by PrivOps.RegenVPNs.
+func regenOutput(resp privproto.Response, dryRun bool) string {
+	if dryRun {
+		return resp.Diff
+	}
+	out := ""
+	for _, name := range resp.Vpns {
+		out += name + "\n"
+	}
+	return out
 }
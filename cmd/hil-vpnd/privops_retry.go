@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// The retry policy for privileged operations: how many times to retry each
+// operation after a transient failure, and how long to wait in between.
+//
+// Operations which aren't idempotent (create, delete and batches) are not
+// retried by default, since after a timeout or a lost connection we can't
+// tell whether they took effect; even when retries are enabled, they are
+// only retried if hil-vpn-privop reports that it didn't get as far as
+// doing anything (see isSafeToRetry). Regen is not retried by default
+// either. Watch is not retried here; healthMonitor re-establishes it as
+// needed.
+type privOpRetries struct {
+	// The delay before the first retry. Each subsequent retry waits
+	// twice as long as the last, up to MaxBackoff, with random jitter.
+	InitialBackoff time.Duration `env:"PRIVOP_RETRY_INITIAL_BACKOFF" envDefault:"200ms"`
+	MaxBackoff     time.Duration `env:"PRIVOP_RETRY_MAX_BACKOFF" envDefault:"5s"`
+
+	Create    int `env:"PRIVOP_RETRIES_CREATE" envDefault:"0"`
+	Start     int `env:"PRIVOP_RETRIES_START" envDefault:"3"`
+	Stop      int `env:"PRIVOP_RETRIES_STOP" envDefault:"3"`
+	Delete    int `env:"PRIVOP_RETRIES_DELETE" envDefault:"0"`
+	List      int `env:"PRIVOP_RETRIES_LIST" envDefault:"3"`
+	Regen     int `env:"PRIVOP_RETRIES_REGEN" envDefault:"0"`
+	Verify    int `env:"PRIVOP_RETRIES_VERIFY" envDefault:"2"`
+	Batch     int `env:"PRIVOP_RETRIES_BATCH" envDefault:"0"`
+	Version   int `env:"PRIVOP_RETRIES_VERSION" envDefault:"3"`
+	Preflight int `env:"PRIVOP_RETRIES_PREFLIGHT" envDefault:"0"`
+}
+
+// A PrivOps which wraps another, retrying operations which fail with a
+// transient error, according to `retries`.
+type retryPrivOps struct {
+	ops     PrivOps
+	retries privOpRetries
+}
+
+// Report whether an operation which failed with `err` is worth retrying.
+//
+// Errors from hil-vpn-privop which reflect the state of the vpns (e.g.
+// not_found), or a bad request, will just happen again. Timeouts waiting
+// for locks, internal errors (e.g. a systemd job failing), and failures to
+// reach hil-vpn-privop at all may well be transient.
+func isRetryable(err error) bool {
+	e, ok := err.(*privproto.Error)
+	if !ok {
+		return true
+	}
+	switch e.Code {
+	case privproto.ErrLockTimeout, privproto.ErrInternal:
+		return true
+	default:
+		return false
+	}
+}
+
+// Report whether an operation which isn't idempotent, and failed with
+// `err`, is worth retrying. Unlike isRetryable, this only allows errors
+// which mean the operation did nothing: if hil-vpn-privop failed part way
+// through, timed out, or couldn't be reached (in which case it may have
+// carried out the operation anyway), running it again could e.g. create a
+// second vpn, or report a successful delete as not_found.
+func isSafeToRetry(err error) bool {
+	e, ok := err.(*privproto.Error)
+	return ok && e.Code == privproto.ErrLockTimeout
+}
+
+// Return how long to wait before retry number `attempt` (counting from
+// zero): exponential backoff, with jitter so that concurrent retries don't
+// all hit hil-vpn-privop at once.
+func (r privOpRetries) backoff(attempt int) time.Duration {
+	d := r.InitialBackoff
+	for i := 0; i < attempt && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Call `op` until it succeeds, fails with an error which isn't worth
+// retrying, or has been retried `retries` times. `name` is used in log
+// messages.
+func (r retryPrivOps) do(ctx context.Context, name string, retries int, op func() error) error {
+	return r.retry(ctx, name, retries, isRetryable, op)
+}
+
+// Like do, but for operations which aren't idempotent; see isSafeToRetry.
+func (r retryPrivOps) doOnce(ctx context.Context, name string, retries int, op func() error) error {
+	return r.retry(ctx, name, retries, isSafeToRetry, op)
+}
+
+// Helper for do and doOnce, which retries errors for which `retryable`
+// returns true.
+func (r retryPrivOps) retry(ctx context.Context, name string, retries int, retryable func(error) bool, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= retries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		wait := r.retries.backoff(attempt)
+		log.Printf("%s failed (%v); retrying in %v.", name, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (r retryPrivOps) CreateVPN(ctx context.Context, name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) (key string, err error) {
+	err = r.doOnce(ctx, "Creating vpn "+name, r.retries.Create, func() error {
+		key, err = r.ops.CreateVPN(ctx, name, vlans, tagged, vni, portNo)
+		return err
+	})
+	return key, err
+}
+
+func (r retryPrivOps) CreateRoutedVPN(ctx context.Context, name string, link *P2PLink, portNo uint16) (key string, err error) {
+	err = r.doOnce(ctx, "Creating vpn "+name, r.retries.Create, func() error {
+		key, err = r.ops.CreateRoutedVPN(ctx, name, link, portNo)
+		return err
+	})
+	return key, err
+}
+
+func (r retryPrivOps) StartVPN(ctx context.Context, name string) error {
+	return r.do(ctx, "Starting vpn "+name, r.retries.Start, func() error {
+		return r.ops.StartVPN(ctx, name)
+	})
+}
+
+func (r retryPrivOps) StopVPN(ctx context.Context, name string) error {
+	return r.do(ctx, "Stopping vpn "+name, r.retries.Stop, func() error {
+		return r.ops.StopVPN(ctx, name)
+	})
+}
+
+func (r retryPrivOps) DeleteVPN(ctx context.Context, name string) error {
+	return r.doOnce(ctx, "Deleting vpn "+name, r.retries.Delete, func() error {
+		return r.ops.DeleteVPN(ctx, name)
+	})
+}
+
+func (r retryPrivOps) ListVPNs(ctx context.Context) (names []string, err error) {
+	err = r.do(ctx, "Listing vpns", r.retries.List, func() error {
+		names, err = r.ops.ListVPNs(ctx)
+		return err
+	})
+	return names, err
+}
+
+func (r retryPrivOps) RegenVPNs(ctx context.Context, dryRun bool) (out string, err error) {
+	err = r.do(ctx, "Regenerating vpn configs", r.retries.Regen, func() error {
+		out, err = r.ops.RegenVPNs(ctx, dryRun)
+		return err
+	})
+	return out, err
+}
+
+func (r retryPrivOps) VerifyVPNs(ctx context.Context) (problems []privproto.Problem, err error) {
+	err = r.do(ctx, "Verifying vpns", r.retries.Verify, func() error {
+		problems, err = r.ops.VerifyVPNs(ctx)
+		return err
+	})
+	return problems, err
+}
+
+func (r retryPrivOps) Batch(ctx context.Context, reqs []privproto.Request, atomic bool) (results []privproto.Response, err error) {
+	err = r.doOnce(ctx, "Running batch", r.retries.Batch, func() error {
+		results, err = r.ops.Batch(ctx, reqs, atomic)
+		return err
+	})
+	return results, err
+}
+
+func (r retryPrivOps) Version(ctx context.Context) (version privproto.Version, err error) {
+	err = r.do(ctx, "Checking hil-vpn-privop version", r.retries.Version, func() error {
+		version, err = r.ops.Version(ctx)
+		return err
+	})
+	return version, err
+}
+
+func (r retryPrivOps) Preflight(ctx context.Context) (checks []privproto.Check, err error) {
+	err = r.do(ctx, "Running preflight checks", r.retries.Preflight, func() error {
+		checks, err = r.ops.Preflight(ctx)
+		return err
+	})
+	return checks, err
+}
+
+func (r retryPrivOps) Watch(ctx context.Context, events chan<- privproto.Event) error {
+	return r.ops.Watch(ctx, events)
+}
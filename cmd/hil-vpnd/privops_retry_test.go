@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Start a test server whose daemon retries StartVPN up to 3 times.
+func initRetryTestServer(t *testing.T, ops *MockPrivOps) *httptest.Server {
+	daemon, err := newDaemon(config{
+		AdminToken:    adminToken,
+		MinPort:       5000,
+		MaxPort:       5009,
+		PrivOpRetries: privOpRetries{Start: 3},
+	}, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(daemon.handler)
+}
+
+// Test that transient failures are retried, so the request succeeds.
+func TestRetryTransient(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initRetryTestServer(t, ops)
+	defer server.Close()
+
+	ops.setErrCount("StartVPN", &privproto.Error{Code: privproto.ErrInternal, Message: "systemctl failed"}, 3)
+	successfullyCreateVpn(t, 232, ops, server)
+	if ops.errsLeft("StartVPN") != 0 {
+		t.Fatalf("StartVPN was not retried; %d injected errors remain.",
+			ops.errsLeft("StartVPN"))
+	}
+}
+
+// Test that we give up once the retry budget is used up, and that errors
+// which aren't transient are not retried at all.
+func TestRetryGiveUp(t *testing.T) {
+	ops := NewMockPrivOps()
+	server := initRetryTestServer(t, ops)
+	defer server.Close()
+	client := server.Client()
+
+	for _, c := range []struct {
+		err       *privproto.Error
+		count     int
+		remaining int
+		status    int
+	}{
+		// 1 attempt + 3 retries, all failing:
+		{&privproto.Error{Code: privproto.ErrLockTimeout}, 5, 1, http.StatusServiceUnavailable},
+		// Not retried:
+		{&privproto.Error{Code: privproto.ErrNotFound}, 5, 4, http.StatusNotFound},
+	} {
+		ops.setErrCount("StartVPN", c.err, c.count)
+		resp, err := postReq(client, server.URL+"/vpns/new", "application/json",
+			bytes.NewBufferString(`{"vlan": 232}`))
+		if err != nil {
+			t.Fatal("Making request:", err)
+		}
+		if resp.StatusCode != c.status {
+			t.Fatalf("Unexpected status code for %s: %d (expected %d)",
+				c.err.Code, resp.StatusCode, c.status)
+		}
+		if ops.errsLeft("StartVPN") != c.remaining {
+			t.Fatalf("StartVPN failed with %s %d times; expected %d.",
+				c.err.Code, c.count-ops.errsLeft("StartVPN"), c.count-c.remaining)
+		}
+		if len(ops.snapshot()) != 0 {
+			t.Fatalf("A VPN was left behind; vpns: %v", ops.snapshot())
+		}
+	}
+}
+
+// Test that backoff grows exponentially, up to the maximum.
+func TestBackoff(t *testing.T) {
+	r := privOpRetries{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+	for attempt, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		d := r.backoff(attempt)
+		if d < max/2 || d > max {
+			t.Errorf("Backoff for attempt %d is %v; expected between %v and %v.",
+				attempt, d, max/2, max)
+		}
+	}
+	if d := (privOpRetries{}).backoff(3); d != 0 {
+		t.Errorf("Backoff with no initial backoff is %v; expected 0.", d)
+	}
+}
+
+// Test that creates and deletes are only retried if they certainly didn't
+// take effect, however many retries are allowed.
+func TestRetryNonIdempotent(t *testing.T) {
+	ops := NewMockPrivOps()
+	daemon, err := newDaemon(config{
+		AdminToken:    adminToken,
+		MinPort:       5000,
+		MaxPort:       5009,
+		PrivOpRetries: privOpRetries{Create: 3, Delete: 3},
+	}, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		err     error
+		retried bool
+	}{
+		{&privproto.Error{Code: privproto.ErrLockTimeout}, true},
+		{&privproto.Error{Code: privproto.ErrInternal}, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("connection reset by peer"), false},
+	} {
+		ops.setErrCount("CreateVPN", c.err, 1)
+		_, err = daemon.privops.CreateVPN(ctx, "vpn", []uint16{100}, false, 0, 5000)
+		if retried := err == nil; retried != c.retried {
+			t.Fatalf("CreateVPN failing with %v: retried = %v, expected %v",
+				c.err, retried, c.retried)
+		}
+		if err != nil {
+			// Carry on with a vpn to delete.
+			if _, err = daemon.privops.CreateVPN(ctx, "vpn", []uint16{100}, false, 0, 5000); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ops.setErrCount("DeleteVPN", c.err, 1)
+		err = daemon.privops.DeleteVPN(ctx, "vpn")
+		if retried := err == nil; retried != c.retried {
+			t.Fatalf("DeleteVPN failing with %v: retried = %v, expected %v",
+				c.err, retried, c.retried)
+		}
+		if err != nil {
+			if err = daemon.privops.DeleteVPN(ctx, "vpn"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
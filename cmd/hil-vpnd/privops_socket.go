@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// An implementation of PrivOps that talks to hil-vpn-privop running as a
+// service (`hil-vpn-privop serve`) on a unix socket. This avoids the
+// overhead of sudo, at the cost of having to run the service.
+type PrivOpsSocket struct {
+	// The path to the service's socket.
+	Path string
+}
+
+// Send the request to the service.
+func (ops PrivOpsSocket) run(ctx context.Context, req privproto.Request) (privproto.Response, error) {
+	var resp privproto.Response
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", ops.Path)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+
+	// Unblock the reads & writes below if ctx is done:
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err = json.NewEncoder(conn).Encode(req); err == nil {
+		err = json.NewDecoder(conn).Decode(&resp)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Report why we gave up, rather than the resulting i/o
+		// timeout. If we got a result anyway, it stands.
+		return resp, ctx.Err()
+	}
+	if err != nil {
+		return resp, err
+	}
+	if resp.Error != nil {
+		return resp, resp.Error
+	}
+	return resp, nil
+}
+
+func (ops PrivOpsSocket) CreateVPN(ctx context.Context, name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) (string, error) {
+	resp, err := ops.run(ctx, createRequest(name, vlans, tagged, vni, portNo))
+	return resp.Key, err
+}
+
+func (ops PrivOpsSocket) CreateRoutedVPN(ctx context.Context, name string, link *P2PLink, portNo uint16) (string, error) {
+	resp, err := ops.run(ctx, createRoutedRequest(name, link, portNo))
+	return resp.Key, err
+}
+
+func (ops PrivOpsSocket) StartVPN(ctx context.Context, name string) error {
+	_, err := ops.run(ctx, privproto.Request{Op: privproto.OpStart, Name: name})
+	return err
+}
+
+func (ops PrivOpsSocket) StopVPN(ctx context.Context, name string) error {
+	_, err := ops.run(ctx, privproto.Request{Op: privproto.OpStop, Name: name})
+	return err
+}
+
+func (ops PrivOpsSocket) DeleteVPN(ctx context.Context, name string) error {
+	_, err := ops.run(ctx, privproto.Request{Op: privproto.OpDelete, Name: name})
+	return err
+}
+
+func (ops PrivOpsSocket) ListVPNs(ctx context.Context) ([]string, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpList})
+	return resp.Vpns, err
+}
+
+func (ops PrivOpsSocket) RegenVPNs(ctx context.Context, dryRun bool) (string, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpRegen, DryRun: dryRun})
+	return regenOutput(resp, dryRun), err
+}
+
+func (ops PrivOpsSocket) VerifyVPNs(ctx context.Context) ([]privproto.Problem, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpVerify})
+	return resp.Problems, err
+}
+
+func (ops PrivOpsSocket) Version(ctx context.Context) (privproto.Version, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpVersion})
+	if err == nil && resp.Version == nil {
+		err = fmt.Errorf("hil-vpn-privop did not report its version")
+	}
+	if err != nil {
+		return privproto.Version{}, err
+	}
+	return *resp.Version, nil
+}
+
+func (ops PrivOpsSocket) Preflight(ctx context.Context) ([]privproto.Check, error) {
+	resp, err := ops.run(ctx, privproto.Request{Op: privproto.OpPreflight})
+	return resp.Checks, err
+}
+
+func (ops PrivOpsSocket) Batch(ctx context.Context, reqs []privproto.Request, atomic bool) ([]privproto.Response, error) {
+	resp, err := ops.run(ctx, privproto.Request{
+		Op:     privproto.OpBatch,
+		Batch:  reqs,
+		Atomic: atomic,
+	})
+	return resp.Results, err
+}
+
+func (ops PrivOpsSocket) Watch(ctx context.Context, events chan<- privproto.Event) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", ops.Path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// As in run; here, this is how we normally stop.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err = json.NewEncoder(conn).Encode(privproto.Request{Op: privproto.OpWatch}); err == nil {
+		err = readEvents(ctx, conn, events)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Start a fake privop service on a unix socket, which answers each request
+// by calling `handle`. Returns a PrivOpsSocket connected to it, and a
+// function to shut it down.
+func startFakePrivOpService(t *testing.T, handle func(privproto.Request) privproto.Response) (PrivOpsSocket, func()) {
+	dir, err := ioutil.TempDir("", "hil-vpnd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/privop.sock"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var req privproto.Request
+			if err := json.NewDecoder(conn).Decode(&req); err == nil {
+				json.NewEncoder(conn).Encode(handle(req))
+			}
+			conn.Close()
+		}
+	}()
+	return PrivOpsSocket{Path: path}, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Test that PrivOpsSocket sends the right requests and interprets the
+// responses correctly.
+func TestPrivOpsSocket(t *testing.T) {
+	var got []privproto.Request
+	ops, stop := startFakePrivOpService(t, func(req privproto.Request) privproto.Response {
+		got = append(got, req)
+		switch req.Op {
+		case privproto.OpCreate:
+			return privproto.Response{Key: "secret key"}
+		case privproto.OpList:
+			return privproto.Response{Vpns: []string{"vpn-a", "vpn-b"}}
+		default:
+			return privproto.Response{Error: &privproto.Error{
+				Code:    privproto.ErrStillRunning,
+				Message: "it broke",
+			}}
+		}
+	})
+	defer stop()
+	ctx := context.Background()
+
+	key, err := ops.CreateVPN(ctx, "vpn-a", []uint16{100}, false, 0, 5000)
+	if err != nil {
+		t.Fatal("CreateVPN:", err)
+	}
+	if key != "secret key" {
+		t.Fatalf("Unexpected key: %q", key)
+	}
+	names, err := ops.ListVPNs(ctx)
+	if err != nil {
+		t.Fatal("ListVPNs:", err)
+	}
+	if !reflect.DeepEqual(names, []string{"vpn-a", "vpn-b"}) {
+		t.Fatalf("Unexpected list of vpns: %v", names)
+	}
+	err = ops.StartVPN(ctx, "vpn-a")
+	if !privproto.IsCode(err, privproto.ErrStillRunning) {
+		t.Fatalf("Expected a %s error from StartVPN, but got %v",
+			privproto.ErrStillRunning, err)
+	}
+
+	expected := []privproto.Request{
+		{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 100, Port: 5000},
+		{Op: privproto.OpList},
+		{Op: privproto.OpStart, Name: "vpn-a"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Unexpected requests; got %v, wanted %v", got, expected)
+	}
+}
+
+// Test that PrivOpsSocket sends batches in a single request, and returns
+// the per-request results.
+func TestPrivOpsSocketBatch(t *testing.T) {
+	var got privproto.Request
+	ops, stop := startFakePrivOpService(t, func(req privproto.Request) privproto.Response {
+		got = req
+		return privproto.Response{
+			Error: &privproto.Error{
+				Code:    privproto.ErrNotFound,
+				Message: "request 1 of batch: no such vpn",
+			},
+			Results: []privproto.Response{
+				{Key: "secret key"},
+				{Error: &privproto.Error{Code: privproto.ErrNotFound, Message: "no such vpn"}},
+			},
+			RolledBack: true,
+		}
+	})
+	defer stop()
+	ctx := context.Background()
+
+	reqs := []privproto.Request{
+		{Op: privproto.OpCreate, Name: "vpn-a", Vlan: 100, Port: 5000},
+		{Op: privproto.OpStart, Name: "vpn-b"},
+	}
+	results, err := ops.Batch(ctx, reqs, true)
+	if !privproto.IsCode(err, privproto.ErrNotFound) {
+		t.Fatalf("Expected a %s error from Batch, but got %v",
+			privproto.ErrNotFound, err)
+	}
+	if len(results) != 2 || results[0].Key != "secret key" || results[1].Error == nil {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+	expected := privproto.Request{Op: privproto.OpBatch, Batch: reqs, Atomic: true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Unexpected request; got %v, wanted %v", got, expected)
+	}
+}
+
+// Test that PrivOpsSocket gives up when its context is done, rather than
+// waiting forever for an unresponsive service.
+func TestPrivOpsSocketTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	ops, stop := startFakePrivOpService(t, func(req privproto.Request) privproto.Response {
+		<-unblock
+		return privproto.Response{}
+	})
+	defer stop()
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ops.StartVPN(ctx, "vpn-a"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v from StartVPN, but got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/staticconfig"
+)
+
+// Set things up so that PrivOpsCmd runs a fake sudo, which runs its command
+// as a child process, as the real one does, and a fake hil-vpn-privop, which
+// is a shell script with the body `script`.
+func fakePrivOpCmd(t *testing.T, script string) {
+	dir, err := ioutil.TempDir("", "hil-vpnd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"sudo":           "#!/bin/sh\n\"$@\"\n",
+		"hil-vpn-privop": "#!/bin/sh\n" + script + "\n",
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(dir+"/"+name, []byte(data), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldPath, oldLibexecdir := os.Getenv("PATH"), staticconfig.Libexecdir
+	os.Setenv("PATH", dir+":"+oldPath)
+	staticconfig.Libexecdir = dir
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+		staticconfig.Libexecdir = oldLibexecdir
+		os.RemoveAll(dir)
+	})
+}
+
+// Test that when an operation times out, hil-vpn-privop itself is stopped,
+// not just sudo.
+func TestPrivOpsCmdTimeout(t *testing.T) {
+	fakePrivOpCmd(t, "sleep 30")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := PrivOpsCmd{}.ListVPNs(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal("Expected context.DeadlineExceeded, but got", err)
+	}
+	// If hil-vpn-privop (here, sleep) were left running, it would hold
+	// stdout open until exec gave up on it:
+	if elapsed := time.Since(start); elapsed >= privOpKillDelay {
+		t.Fatalf("Took %v to give up on hil-vpn-privop.", elapsed)
+	}
+}
+
+// Test that a result reported by hil-vpn-privop stands, even if the
+// operation times out before it exits.
+func TestPrivOpsCmdLateExit(t *testing.T) {
+	fakePrivOpCmd(t, `echo '{"vpns": ["a", "b"]}'; exec sleep 30`)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	vpns, err := PrivOpsCmd{}.ListVPNs(ctx)
+	if err != nil {
+		t.Fatal("Discarded the result:", err)
+	}
+	if !reflect.DeepEqual(vpns, []string{"a", "b"}) {
+		t.Fatal("Unexpected result:", vpns)
+	}
+}
+
+// Test that when a watch is cancelled, hil-vpn-privop itself is stopped,
+// not just sudo.
+func TestPrivOpsCmdWatchCancel(t *testing.T) {
+	fakePrivOpCmd(t, `echo '{"event": {"vpn": "a", "state": "active"}}'; sleep 30`)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan privproto.Event)
+	done := make(chan error)
+	go func() {
+		done <- PrivOpsCmd{}.Watch(ctx, events)
+	}()
+	if ev := <-events; ev.Vpn != "a" || ev.State != "active" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("Expected context.Canceled, but got", err)
+		}
+	case <-time.After(privOpKillDelay / 2):
+		t.Fatal("Watch did not return once cancelled.")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// Timeouts for each privileged operation. A zero timeout means no limit,
+// other than that imposed by the caller's context. Watch, which runs
+// indefinitely, has no timeout.
+type privOpTimeouts struct {
+	Create    time.Duration `env:"PRIVOP_TIMEOUT_CREATE" envDefault:"60s"`
+	Start     time.Duration `env:"PRIVOP_TIMEOUT_START" envDefault:"60s"`
+	Stop      time.Duration `env:"PRIVOP_TIMEOUT_STOP" envDefault:"60s"`
+	Delete    time.Duration `env:"PRIVOP_TIMEOUT_DELETE" envDefault:"60s"`
+	List      time.Duration `env:"PRIVOP_TIMEOUT_LIST" envDefault:"30s"`
+	Regen     time.Duration `env:"PRIVOP_TIMEOUT_REGEN" envDefault:"5m"`
+	Verify    time.Duration `env:"PRIVOP_TIMEOUT_VERIFY" envDefault:"60s"`
+	Batch     time.Duration `env:"PRIVOP_TIMEOUT_BATCH" envDefault:"10m"`
+	Version   time.Duration `env:"PRIVOP_TIMEOUT_VERSION" envDefault:"30s"`
+	Preflight time.Duration `env:"PRIVOP_TIMEOUT_PREFLIGHT" envDefault:"60s"`
+}
+
+// A PrivOps which wraps another, applying the given timeouts to each
+// operation.
+type timeoutPrivOps struct {
+	ops      PrivOps
+	timeouts privOpTimeouts
+}
+
+// Return a context derived from `ctx`, which is cancelled after `timeout`
+// (if non-zero).
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (t timeoutPrivOps) CreateVPN(ctx context.Context, name string, vlans []uint16, tagged bool, vni uint32, portNo uint16) (string, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Create)
+	defer cancel()
+	return t.ops.CreateVPN(ctx, name, vlans, tagged, vni, portNo)
+}
+
+func (t timeoutPrivOps) CreateRoutedVPN(ctx context.Context, name string, link *P2PLink, portNo uint16) (string, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Create)
+	defer cancel()
+	return t.ops.CreateRoutedVPN(ctx, name, link, portNo)
+}
+
+func (t timeoutPrivOps) StartVPN(ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Start)
+	defer cancel()
+	return t.ops.StartVPN(ctx, name)
+}
+
+func (t timeoutPrivOps) StopVPN(ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Stop)
+	defer cancel()
+	return t.ops.StopVPN(ctx, name)
+}
+
+func (t timeoutPrivOps) DeleteVPN(ctx context.Context, name string) error {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Delete)
+	defer cancel()
+	return t.ops.DeleteVPN(ctx, name)
+}
+
+func (t timeoutPrivOps) ListVPNs(ctx context.Context) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.List)
+	defer cancel()
+	return t.ops.ListVPNs(ctx)
+}
+
+func (t timeoutPrivOps) RegenVPNs(ctx context.Context, dryRun bool) (string, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Regen)
+	defer cancel()
+	return t.ops.RegenVPNs(ctx, dryRun)
+}
+
+func (t timeoutPrivOps) VerifyVPNs(ctx context.Context) ([]privproto.Problem, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Verify)
+	defer cancel()
+	return t.ops.VerifyVPNs(ctx)
+}
+
+func (t timeoutPrivOps) Batch(ctx context.Context, reqs []privproto.Request, atomic bool) ([]privproto.Response, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Batch)
+	defer cancel()
+	return t.ops.Batch(ctx, reqs, atomic)
+}
+
+func (t timeoutPrivOps) Version(ctx context.Context) (privproto.Version, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Version)
+	defer cancel()
+	return t.ops.Version(ctx)
+}
+
+func (t timeoutPrivOps) Preflight(ctx context.Context) ([]privproto.Check, error) {
+	ctx, cancel := withTimeout(ctx, t.timeouts.Preflight)
+	defer cancel()
+	return t.ops.Preflight(ctx)
+}
+
+func (t timeoutPrivOps) Watch(ctx context.Context, events chan<- privproto.Event) error {
+	return t.ops.Watch(ctx, events)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that a privileged operation which takes longer than its timeout
+// fails the request with 504, and that the partially created vpn is
+// cleaned up.
+func TestPrivOpTimeout(t *testing.T) {
+	ops := NewMockPrivOps()
+	daemon, err := newDaemon(config{
+		AdminToken: adminToken,
+		MinPort:    5000,
+		MaxPort:    5009,
+		PrivOpTimeouts: privOpTimeouts{
+			Start: 50 * time.Millisecond,
+		},
+	}, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(daemon.handler)
+	defer server.Close()
+
+	ops.setDelay("StartVPN", 10*time.Second)
+	start := time.Now()
+	resp, err := postReq(server.Client(), server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"vlan": 232}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Unexpected status code: %d (expected %d)",
+			resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Request took %v; the timeout was not applied.", elapsed)
+	}
+	if len(ops.snapshot()) != 0 {
+		t.Fatalf("A VPN was left behind; vpns: %v", ops.snapshot())
+	}
+
+	// Other operations aren't affected by the delay:
+	ops.setDelay("StartVPN", 0)
+	successfullyCreateVpn(t, 232, ops, server)
+}
+
+// A create or delete which times out may have been carried out anyway, so
+// the vpns' ids and ports must stay reserved, rather than being handed out
+// again.
+func TestPrivOpTimeoutKeepsReservations(t *testing.T) {
+	ops := NewMockPrivOps()
+	daemon, err := newDaemon(config{
+		AdminToken: adminToken,
+		MinPort:    5000,
+		MaxPort:    5009,
+		PrivOpTimeouts: privOpTimeouts{
+			Create: 50 * time.Millisecond,
+			Batch:  50 * time.Millisecond,
+		},
+	}, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(daemon.handler)
+	defer server.Close()
+	states := daemon.vpnStates
+	checkReserved := func(what string, used, free int) {
+		states.Lock()
+		defer states.Unlock()
+		if len(states.UsedPorts) != used || len(states.FreePorts) != free {
+			t.Fatalf("After %s: expected %d vpns and %d free ports, but "+
+				"got %d and %d", what, used, free,
+				len(states.UsedPorts), len(states.FreePorts))
+		}
+	}
+
+	ops.setDelay("CreateVPN", 10*time.Second)
+	resp, err := postReq(server.Client(), server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"vlan": 232}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Unexpected status code: %d (expected %d)",
+			resp.StatusCode, http.StatusGatewayTimeout)
+	}
+	checkReserved("a create timed out", 1, 9)
+	ops.setDelay("CreateVPN", 0)
+
+	ops.setDelay("Batch", 10*time.Second)
+	bulkReq(t, server, "POST", `{"vpns": [{"vlan": 100}, {"vlan": 200}]}`,
+		http.StatusGatewayTimeout)
+	checkReserved("a bulk create timed out", 3, 7)
+
+	ops.setDelay("Batch", 0)
+	created := bulkReq(t, server, "POST", `{"vpns": [{"vlan": 300}]}`, http.StatusOK)
+	checkReserved("a bulk create", 4, 6)
+	ops.setDelay("Batch", 10*time.Second)
+	bulkReq(t, server, "DELETE", `{"ids": ["`+created.Results[0].Id+`"]}`,
+		http.StatusGatewayTimeout)
+	// The vpn may be gone, so it mustn't be restored, but its port
+	// mustn't be re-used either:
+	checkReserved("a bulk delete timed out", 3, 6)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+)
+
+// hil-vpnd and hil-vpn-privop are installed separately, so at startup we
+// ask hil-vpn-privop which version of the protocol it speaks, and what it
+// supports, before relying on it.
+
+// The set of optional features (see privproto.Features) which we may use.
+type featureSet map[string]bool
+
+// Error indicating that hil-vpn-privop predates the version operation, so
+// we can't tell what it supports.
+var ErrPrivOpTooOld = errors.New("hil-vpn-privop is too old: it has no " +
+	"version operation. Install the hil-vpn-privop from the same release " +
+	"as hil-vpnd.")
+
+// Ask hil-vpn-privop for its version. Releases which predate the version
+// operation either reject it as an invalid argument, or, before --json
+// existed, just fail; we can't work with either.
+func getVersion(ctx context.Context, privops PrivOps) (privproto.Version, error) {
+	version, err := privops.Version(ctx)
+	switch e := err.(type) {
+	case nil:
+		return version, nil
+	case *privproto.Error:
+		if e.Code == privproto.ErrInvalidArgument {
+			return version, ErrPrivOpTooOld
+		}
+		return version, fmt.Errorf("Checking hil-vpn-privop version: %v", err)
+	default:
+		return version, fmt.Errorf("%v If it does run, it may be too old "+
+			"to report its version, which is not supported either.",
+			privOpUnavailable(err))
+	}
+}
+
+// Check that a hil-vpn-privop reporting version `v` is compatible with us,
+// returning the optional features which may be used. An error means that
+// hil-vpnd can't work with it at all.
+func checkVersion(v privproto.Version) (featureSet, error) {
+	if v.Protocol != privproto.ProtocolVersion {
+		return nil, fmt.Errorf("hil-vpn-privop speaks protocol version %d, "+
+			"but hil-vpnd requires version %d; make sure both are "+
+			"from the same release.", v.Protocol, privproto.ProtocolVersion)
+	}
+
+	nameRe, err := regexp.Compile(v.NamePattern)
+	if err != nil {
+		return nil, fmt.Errorf("hil-vpn-privop reported an invalid vpn "+
+			"name pattern %q: %v", v.NamePattern, err)
+	}
+	var id UniqueId
+	if name := makeVpnName(id, 65535); !nameRe.MatchString(name) {
+		return nil, fmt.Errorf("hil-vpn-privop does not accept vpn names "+
+			"like %q (names must match %q)", name, v.NamePattern)
+	}
+
+	features := featureSet{}
+	for _, f := range privproto.Features {
+		features[f] = v.HasFeature(f)
+		if !features[f] {
+			log.Printf("hil-vpn-privop does not support %q; disabling it.", f)
+		}
+	}
+	return features, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/privproto"
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
+)
+
+// Test that we refuse to work with incompatible versions of
+// hil-vpn-privop.
+func TestCheckVersion(t *testing.T) {
+	good := privproto.Version{
+		Protocol:    privproto.ProtocolVersion,
+		Features:    privproto.Features,
+		NamePattern: validate.VpnNamePattern,
+	}
+	if _, err := checkVersion(good); err != nil {
+		t.Fatal("Rejected the current version:", err)
+	}
+
+	bad := []privproto.Version{
+		{Protocol: privproto.ProtocolVersion + 1, NamePattern: validate.VpnNamePattern},
+		{Protocol: 0, NamePattern: validate.VpnNamePattern},
+		{Protocol: privproto.ProtocolVersion, NamePattern: "^[a-z]+$"},
+		{Protocol: privproto.ProtocolVersion, NamePattern: "("},
+	}
+	for _, v := range bad {
+		if _, err := checkVersion(v); err == nil {
+			t.Errorf("Accepted incompatible version %+v", v)
+		}
+	}
+}
+
+// Test that endpoints which need features hil-vpn-privop lacks are
+// disabled, while the rest keep working.
+func TestMissingFeatures(t *testing.T) {
+	ops := NewMockPrivOps()
+	ops.version = &privproto.Version{
+		Protocol:    privproto.ProtocolVersion,
+		Features:    []string{},
+		NamePattern: validate.VpnNamePattern,
+	}
+	server := initTestServer(ops)
+	defer server.Close()
+	client := server.Client()
+
+	resp, err := postReq(client, server.URL+"/maintenance/regen", "text/plain", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Unexpected status code: %d (expected %d)",
+			resp.StatusCode, http.StatusNotImplemented)
+	}
+	bulkReq(t, server, "POST", `{"vpns": [{"vlan": 100}]}`, http.StatusNotImplemented)
+	// A trunk needs FeatureVlans, even if it carries just one vlan:
+	for _, body := range []string{`{"vlans": [100, 200]}`, `{"vlans": [100]}`} {
+		resp, err = postReq(client, server.URL+"/vpns/new", "application/json",
+			bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal("Making request:", err)
+		}
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("Unexpected status code for %s: %d (expected %d)",
+				body, resp.StatusCode, http.StatusNotImplemented)
+		}
+	}
+	resp, err = postReq(client, server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"network": "vxlan", "vni": 5000}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Unexpected status code for a vxlan vpn: %d (expected %d)",
+			resp.StatusCode, http.StatusNotImplemented)
+	}
+	resp, err = postReq(client, server.URL+"/vpns/new", "application/json",
+		bytes.NewBufferString(`{"mode": "routed"}`))
+	if err != nil {
+		t.Fatal("Making request:", err)
+	}
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("Unexpected status code for a routed vpn: %d (expected %d)",
+			resp.StatusCode, http.StatusNotImplemented)
+	}
+	if len(ops.getRegenCalls()) != 0 || len(ops.snapshot()) != 0 {
+		t.Fatal("Disabled endpoints called PrivOps anyway.")
+	}
+
+	successfullyCreateVpn(t, 232, ops, server)
+}
+
+// A hil-vpn-privop too old to report its version is refused, rather than
+// guessing what it supports.
+func TestOldPrivOp(t *testing.T) {
+	ops := NewMockPrivOps()
+	ops.setErr("Version", &privproto.Error{
+		Code:    privproto.ErrInvalidArgument,
+		Message: `Unknown subcommand: "version"`,
+	})
+	_, err := newDaemon(config{MinPort: 5000, MaxPort: 5009}, ops)
+	if err != ErrPrivOpTooOld {
+		t.Fatalf("Expected ErrPrivOpTooOld, but got %v", err)
+	}
+}
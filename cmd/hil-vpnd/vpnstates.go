@@ -81,6 +81,31 @@ func (s *VpnStates) NewVpn() (UniqueId, uint16, error) {
 	return id, portNo, err
 }
 
+// Allocate `n` new vpns at once. Either all of them are allocated, or (if
+// there are fewer than `n` free ports) none are, and ErrNoFreePorts is
+// returned.
+func (s *VpnStates) NewVpns(n int) ([]UniqueId, []uint16, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.FreePorts) < n {
+		return nil, nil, ErrNoFreePorts
+	}
+	ids := make([]UniqueId, n)
+	ports := make([]uint16, n)
+	for i := range ids {
+		if _, err := rand.Read(ids[i][:]); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := range ports {
+		// Can't fail; we checked above that there are enough ports.
+		ports[i], _ = s.allocPort()
+		s.UsedPorts[ids[i]] = ports[i]
+	}
+	return ids, ports, nil
+}
+
 // Delete a vpn. This returns the port number and an error which
 // will either be nil or ErrNoSuchVpn.
 //
@@ -98,6 +123,40 @@ func (s *VpnStates) DeleteVpn(id UniqueId) (uint16, error) {
 	return portNo, nil
 }
 
+// Delete several vpns at once, returning their port numbers. If `atomic`
+// is true and any of the vpns does not exist, nothing is deleted and
+// ErrNoSuchVpn is returned. Otherwise, the port number for each vpn which
+// does not exist is zero.
+//
+// As with DeleteVpn, the ports are not returned to the free pool.
+func (s *VpnStates) DeleteVpns(ids []UniqueId, atomic bool) ([]uint16, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if atomic {
+		for _, id := range ids {
+			if _, ok := s.UsedPorts[id]; !ok {
+				return nil, ErrNoSuchVpn
+			}
+		}
+	}
+	ports := make([]uint16, len(ids))
+	for i, id := range ids {
+		ports[i] = s.UsedPorts[id]
+		delete(s.UsedPorts, id)
+	}
+	return ports, nil
+}
+
+// Undo a call to DeleteVpn (or DeleteVpns), for a vpn which turned out not
+// to be deleted after all. `port` must not have been released in between.
+func (s *VpnStates) RestoreVpn(id UniqueId, port uint16) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.UsedPorts[id] = port
+}
+
 // Allocate a new port for a vpn.
 func (s *VpnStates) allocPort() (uint16, error) {
 	if len(s.FreePorts) == 0 {
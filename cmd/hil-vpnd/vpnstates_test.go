@@ -57,3 +57,40 @@ func TestVpnStates(t *testing.T) {
 		t.Fatalf("Unexpected port number; wanted 4001 but got %d.", port)
 	}
 }
+
+// Test that bulk allocation and deletion are all-or-nothing.
+func TestVpnStatesBulk(t *testing.T) {
+	states := newStates(config{
+		MinPort: 4000,
+		MaxPort: 4003,
+	}, []string{})
+
+	if _, _, err := states.NewVpns(5); err != ErrNoFreePorts {
+		t.Fatal("Should have gotten ErrNoFreePorts, but err was ", err)
+	}
+	if len(states.FreePorts) != 4 {
+		t.Fatalf("Failed allocation used up ports; %d left.", len(states.FreePorts))
+	}
+	ids, ports, err := states.NewVpns(3)
+	if err != nil {
+		t.Fatal("Error allocating vpns:", err)
+	}
+	if len(ids) != 3 || len(ports) != 3 || len(states.UsedPorts) != 3 {
+		t.Fatalf("Unexpected allocation: %v, %v", ids, ports)
+	}
+
+	var missing UniqueId
+	if _, err = states.DeleteVpns([]UniqueId{ids[0], missing}, true); err != ErrNoSuchVpn {
+		t.Fatal("Should have gotten ErrNoSuchVpn, but err was ", err)
+	}
+	if len(states.UsedPorts) != 3 {
+		t.Fatal("Failed atomic delete deleted some vpns.")
+	}
+	deleted, err := states.DeleteVpns([]UniqueId{ids[0], missing}, false)
+	if err != nil {
+		t.Fatal("Error deleting vpns:", err)
+	}
+	if deleted[0] != ports[0] || deleted[1] != 0 || len(states.UsedPorts) != 2 {
+		t.Fatalf("Unexpected result from DeleteVpns: %v", deleted)
+	}
+}
@@ -3,15 +3,23 @@
 # Set up a range of bridges and corresponding vlan nics. This is more-or less
 # the same thing as the create_bridges script in HIL.
 #
-# Usage: $0 first-vlan last-vlan trunk-nic
+# This isn't needed if hil-vpn-privop is configured with a trunk_nic, in
+# which case it creates the bridges as they are needed.
+#
+# The bridges are named per bridge-name-template, in which {vlan} stands for
+# the vlan number; this defaults to br-vlan{vlan}, and must match the
+# bridge_name setting in hil-vpn-privop's config file.
+#
+# Usage: $0 first-vlan last-vlan trunk-nic [bridge-name-template]
 set -e
 
 start=${1?}
 stop=${2?}
 trunk_nic=${3?}
+bridge_name=${4:-br-vlan\{vlan\}}
 
 for i in `seq $start $stop`; do
-	bridge=br-vlan${i}
+	bridge=`echo "$bridge_name" | sed "s/{vlan}/$i/g"`
 	vlan_nic=${trunk_nic}.${i}
 	brctl addbr $bridge
 	vconfig add $trunk_nic $i
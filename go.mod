@@ -3,6 +3,9 @@ module github.com/CCI-MOC/hil-vpn
 require (
 	github.com/CCI-MOC/obmd v0.0.0-20181215225251-2c8b84b9943a
 	github.com/caarlos0/env v3.5.0+incompatible
+	github.com/godbus/dbus/v5 v5.0.6
 	github.com/gorilla/mux v1.6.2
+	github.com/vishvananda/netlink v1.0.0
+	github.com/vishvananda/netns v0.0.0-20180720170159-13995c7128cc // indirect
 	golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba
 )
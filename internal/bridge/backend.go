@@ -0,0 +1,172 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// A Backend connects the vpns' tap devices to their vlans. hil-vpn-hook
+// uses one to attach and detach each vpn's device, and hil-vpn-privop uses
+// the same one to prepare the host for each vlan, and clean up after it.
+type Backend interface {
+	// Prepare the host to carry vlan number `vlan`, e.g. by creating its
+	// bridge. This does nothing if the host is already prepared.
+	Ensure(vlan uint16) error
+
+	// Check that the host can carry vlan number `vlan`: that its bridge
+	// exists, or that Ensure has what it needs to create it. This is meant
+	// for catching problems early, e.g. before creating a vpn.
+	CheckVlan(vlan uint16) error
+
+	// Undo Ensure, once no vpn uses vlan number `vlan` any more.
+	Release(vlan uint16) error
+
+	// Attach the device `dev` to the vlans in `vlans`, and bring it up.
+	// If `tagged` is set, the device is a trunk, carrying them all tagged,
+	// even if there is just one; otherwise, `vlans` must be a single vlan,
+	// whose traffic the device carries untagged. This prepares the host for
+	// the vlans first, as Ensure does, since openvpn may be started without
+	// hil-vpn-privop, e.g. at boot.
+	Attach(dev string, vlans []uint16, tagged bool) error
+
+	// Detach the device `dev` from the vlans in `vlans`, as attached by
+	// Attach with the same `tagged`. It is not an error if the device no
+	// longer exists, or isn't attached.
+	Detach(dev string, vlans []uint16, tagged bool) error
+}
+
+// A Backend with a Linux bridge for each vlan, named per NameTemplate (see
+// NameFrom), or DefaultNameTemplate if that is empty.
+//
+// If Trunk is set, the bridges are created on demand, connected to their
+// vlans via subinterfaces of the nic named by Trunk; see Ensure. Otherwise,
+// they must be created ahead of time.
+type PerVlan struct {
+	Trunk        string
+	NameTemplate string
+}
+
+// Return the name of the bridge for vlan number `vlan`.
+func (b PerVlan) name(vlan uint16) string {
+	if b.NameTemplate == "" {
+		return Name(vlan)
+	}
+	return NameFrom(b.NameTemplate, vlan)
+}
+
+func (b PerVlan) Ensure(vlan uint16) error {
+	if b.Trunk == "" {
+		return nil
+	}
+	return Ensure(b.name(vlan), b.Trunk, vlan)
+}
+
+func (b PerVlan) CheckVlan(vlan uint16) error {
+	if b.Trunk != "" {
+		return checkTrunk(b.Trunk)
+	}
+	_, err := lookupBridge(b.name(vlan))
+	return err
+}
+
+func (b PerVlan) Release(vlan uint16) error {
+	if b.Trunk == "" {
+		return nil
+	}
+	removed, err := Remove(b.name(vlan), b.Trunk, vlan)
+	if err == nil && !removed {
+		err = fmt.Errorf("Not removing bridge %s; other devices are still "+
+			"attached to it", b.name(vlan))
+	}
+	return err
+}
+
+// A trunk is attached to each of its vlans' bridges via vlan
+// subinterfaces; see AttachTagged.
+func (b PerVlan) Attach(dev string, vlans []uint16, tagged bool) error {
+	for _, vlan := range vlans {
+		if err := b.Ensure(vlan); err != nil {
+			return err
+		}
+	}
+	if !tagged {
+		return Attach(dev, b.name(vlans[0]))
+	}
+	for _, vlan := range vlans {
+		if err := AttachTagged(dev, b.name(vlan), vlan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b PerVlan) Detach(dev string, vlans []uint16, tagged bool) error {
+	if !tagged {
+		return Detach(dev, b.name(vlans[0]))
+	}
+	for _, vlan := range vlans {
+		if err := DetachTagged(dev, vlan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Backend with a single vlan-filtering Linux bridge, named by Bridge, on
+// which each device is an untagged port for its vlan, or, if it is a trunk,
+// a tagged port for its vlans.
+//
+// If Trunk is set, the bridge is created on demand, and the nic named by
+// Trunk is attached to it as a tagged port for the vlans in use; see
+// EnsureFiltering. Otherwise, the bridge must be set up ahead of time.
+type VlanFiltering struct {
+	Bridge string
+	Trunk  string
+}
+
+func (b VlanFiltering) Ensure(vlan uint16) error {
+	if b.Trunk == "" {
+		return nil
+	}
+	return EnsureFiltering(b.Bridge, b.Trunk, vlan)
+}
+
+func (b VlanFiltering) CheckVlan(vlan uint16) error {
+	if b.Trunk != "" {
+		return checkTrunk(b.Trunk)
+	}
+	_, err := lookupFilteringBridge(b.Bridge)
+	return err
+}
+
+func (b VlanFiltering) Release(vlan uint16) error {
+	if b.Trunk == "" {
+		return nil
+	}
+	return RemoveTrunkVlan(b.Bridge, b.Trunk, vlan)
+}
+
+func (b VlanFiltering) Attach(dev string, vlans []uint16, tagged bool) error {
+	for _, vlan := range vlans {
+		if err := b.Ensure(vlan); err != nil {
+			return err
+		}
+	}
+	if !tagged {
+		return AttachAccess(dev, b.Bridge, vlans[0])
+	}
+	return AttachTrunk(dev, b.Bridge, vlans)
+}
+
+func (b VlanFiltering) Detach(dev string, vlans []uint16, tagged bool) error {
+	return Detach(dev, b.Bridge)
+}
+
+// Check that the trunk nic `trunk` exists.
+func checkTrunk(trunk string) error {
+	if _, err := netlink.LinkByName(trunk); err != nil {
+		return fmt.Errorf("Looking up trunk nic %s: %v", trunk, err)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// Package bridge attaches the vpns' tap devices to the bridges for their
+// vlans, and detaches them again, talking to the kernel over netlink. It is
+// used by the hil-vpn-hook program, which openvpn runs when it brings a
+// vpn's tap device up or down.
+//
+// The bridges may be created ahead of time by the admin (e.g. with
+// create-bridges.sh), or on demand: Ensure creates the bridge for a vlan,
+// along with a vlan subinterface of a trunk nic connecting it to the
+// network, and Remove tears them down again.
+//
+// Which of these are used depends on the Backend; see backend.go. There is
+// also a Backend for Open vSwitch, which is configured via ovsdb-server
+// rather than netlink; see OVS. Vpns on vxlan overlay networks, rather than
+// vlans, are attached to bridges of their own; see Vxlan.
+package bridge
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The maximum length of a network interface's name (IFNAMSIZ, less the
+// terminating NUL).
+const maxNameLen = 15
+
+// The placeholder for the vlan number in bridge name templates; see NameFrom.
+const VlanPlaceholder = "{vlan}"
+
+// The default template for the names of the vlans' bridges; it matches the
+// names HIL's switch drivers use.
+const DefaultNameTemplate = "br-vlan" + VlanPlaceholder
+
+// What a bridge name template may contain, besides the placeholder. We are
+// stricter than the kernel, since the names end up in openvpn configs.
+var nameTemplateRe = regexp.MustCompile(`^[-_a-zA-Z0-9]*\{vlan\}[-_a-zA-Z0-9]*$`)
+
+// Return the name of the bridge for vlan number `vlan`, per
+// DefaultNameTemplate.
+func Name(vlan uint16) string {
+	return NameFrom(DefaultNameTemplate, vlan)
+}
+
+// Return the name of the bridge for vlan number `vlan`, per the template
+// `tpl`, in which VlanPlaceholder stands for the vlan number, e.g.
+// "br-vlan{vlan}".
+func NameFrom(tpl string, vlan uint16) string {
+	return strings.Replace(tpl, VlanPlaceholder, strconv.Itoa(int(vlan)), -1)
+}
+
+// Verify that `tpl` is a valid bridge name template: it must contain
+// VlanPlaceholder exactly once, otherwise only letters, digits, dashes and
+// underscores, and be short enough that the names it yields for any vlan
+// are valid device names.
+func CheckNameTemplate(tpl string) error {
+	if !nameTemplateRe.MatchString(tpl) {
+		return fmt.Errorf("invalid bridge name template %q; it must contain %s "+
+			"exactly once, and otherwise only letters, digits, dashes and "+
+			"underscores", tpl, VlanPlaceholder)
+	}
+	// Vlan numbers have at most 4 digits:
+	if len(tpl)-len(VlanPlaceholder)+4 > maxNameLen {
+		return fmt.Errorf("bridge name template %q is too long; bridge "+
+			"names are limited to %d characters", tpl, maxNameLen)
+	}
+	return nil
+}
+
+// Return the name of the subinterface of the nic `trunk` which carries vlan
+// number `vlan`.
+func VlanNicName(trunk string, vlan uint16) string {
+	return fmt.Sprintf("%s.%d", trunk, vlan)
+}
+
+// Look up the bridge named `name`, failing if it doesn't exist or is some
+// other kind of device.
+func lookupBridge(name string) (*netlink.Bridge, error) {
+	link, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil, fmt.Errorf("Bridge %s does not exist", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("Looking up bridge %s: %v", name, err)
+	}
+	br, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s device, not a bridge", name, link.Type())
+	}
+	return br, nil
+}
+
+// Attach the device `dev` to the bridge `bridge`, and bring it up.
+func Attach(dev, bridge string) error {
+	br, err := lookupBridge(bridge)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	if err = netlink.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("Attaching %s to bridge %s: %v", dev, bridge, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("Bringing up %s: %v", dev, err)
+	}
+	return nil
+}
+
+// Detach the device `dev` from the bridge `bridge`. If the device no longer
+// exists, or isn't attached to the bridge, there is nothing to do; the
+// kernel detaches devices from their bridges when they are destroyed, so
+// this is the usual case once openvpn has closed its tap device.
+func Detach(dev, bridge string) error {
+	link, err := netlink.LinkByName(dev)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	br, err := netlink.LinkByName(bridge)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Looking up bridge %s: %v", bridge, err)
+	}
+	if link.Attrs().MasterIndex != br.Attrs().Index {
+		return nil
+	}
+	if err = netlink.LinkSetNoMaster(link); err != nil {
+		return fmt.Errorf("Detaching %s from bridge %s: %v", dev, bridge, err)
+	}
+	return nil
+}
+
+// Return the name of the vlan subinterface of `link` carrying vlan number
+// `vlan`, as created by AttachTagged. The names of the vpns' tap devices
+// leave no room for a suffix, so we go by the device's index instead.
+func taggedName(link netlink.Link, vlan uint16) string {
+	return fmt.Sprintf("t%d.%d", link.Attrs().Index, vlan)
+}
+
+// Attach vlan number `vlan` on the device `dev` to the bridge `bridge`, via
+// a vlan subinterface of `dev`, and bring both up. This is how a device
+// carrying several vlans, tagged, is attached to their bridges.
+//
+// The subinterface goes away with the device, so there is usually no need
+// to call DetachTagged.
+func AttachTagged(dev, bridge string, vlan uint16) error {
+	br, err := lookupBridge(bridge)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	sub, err := addLink(&netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        taggedName(link, vlan),
+			ParentIndex: link.Attrs().Index,
+		},
+		VlanId: int(vlan),
+	})
+	if err != nil {
+		return err
+	}
+	if sub.Attrs().ParentIndex != link.Attrs().Index {
+		return fmt.Errorf("%s is not a subinterface of %s", sub.Attrs().Name, dev)
+	}
+	if err = netlink.LinkSetMaster(sub, br); err != nil {
+		return fmt.Errorf("Attaching %s to bridge %s: %v", sub.Attrs().Name, bridge, err)
+	}
+	for _, l := range []netlink.Link{sub, link} {
+		if err = netlink.LinkSetUp(l); err != nil {
+			return fmt.Errorf("Bringing up %s: %v", l.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Undo AttachTagged, removing the subinterface of `dev` for vlan number
+// `vlan`. It is not an error if the device or the subinterface no longer
+// exists.
+func DetachTagged(dev string, vlan uint16) error {
+	link, err := netlink.LinkByName(dev)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	name := taggedName(link, vlan)
+	sub, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Looking up %s: %v", name, err)
+	}
+	if sub.Attrs().ParentIndex != link.Attrs().Index {
+		return nil
+	}
+	if err = netlink.LinkDel(sub); err != nil {
+		return fmt.Errorf("Removing %s: %v", name, err)
+	}
+	return nil
+}
+
+// Create the device `link`, unless a device by that name already exists,
+// and return it as the kernel reports it.
+func addLink(link netlink.Link) (netlink.Link, error) {
+	name := link.Attrs().Name
+	if len(name) > maxNameLen {
+		return nil, fmt.Errorf("Device name %s is too long; the limit is %d characters",
+			name, maxNameLen)
+	}
+	err := netlink.LinkAdd(link)
+	if err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("Creating %s: %v", name, err)
+	}
+	// Someone else (e.g. another instance of the hook) may have beaten
+	// us to it, so we don't assume the device is the one we asked for:
+	ret, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("Looking up %s: %v", name, err)
+	}
+	if ret.Type() != link.Type() {
+		return nil, fmt.Errorf("%s is a %s device, not a %s", name, ret.Type(), link.Type())
+	}
+	return ret, nil
+}
+
+// Make sure the bridge `bridge` exists, connected to vlan number `vlan` on
+// the nic `trunk` via a vlan subinterface (see VlanNicName), creating
+// whichever of these are missing, and that they are up.
+func Ensure(bridge, trunk string, vlan uint16) error {
+	trunkLink, err := netlink.LinkByName(trunk)
+	if err != nil {
+		return fmt.Errorf("Looking up trunk nic %s: %v", trunk, err)
+	}
+	br, err := addLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge}})
+	if err != nil {
+		return err
+	}
+	vlanNic, err := addLink(&netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        VlanNicName(trunk, vlan),
+			ParentIndex: trunkLink.Attrs().Index,
+		},
+		VlanId: int(vlan),
+	})
+	if err != nil {
+		return err
+	}
+	if vlanNic.Attrs().MasterIndex != br.Attrs().Index {
+		if err = netlink.LinkSetMaster(vlanNic, br.(*netlink.Bridge)); err != nil {
+			return fmt.Errorf("Attaching %s to bridge %s: %v",
+				vlanNic.Attrs().Name, bridge, err)
+		}
+	}
+	// Like create-bridges.sh, we put the devices in promiscuous mode, so
+	// that they pass along traffic for the vpns' clients:
+	for _, link := range []netlink.Link{br, vlanNic} {
+		if err = netlink.SetPromiscOn(link); err != nil {
+			return fmt.Errorf("Setting %s to promiscuous mode: %v", link.Attrs().Name, err)
+		}
+		if err = netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("Bringing up %s: %v", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Undo Ensure, removing the bridge `bridge` and the subinterface of `trunk`
+// for vlan number `vlan`. If anything other than that subinterface is still
+// attached to the bridge, it is left alone, and Remove returns false;
+// otherwise it returns true. It is not an error if the devices don't exist.
+func Remove(bridge, trunk string, vlan uint16) (bool, error) {
+	return removeBridge(bridge, VlanNicName(trunk, vlan))
+}
+
+// Remove the bridge `bridge`, along with the device `uplinkName` which connects
+// it to the network, as Remove does. This is also used for the bridges of
+// vxlan networks; see Vxlan.Release.
+func removeBridge(bridge, uplinkName string) (bool, error) {
+	br, err := netlink.LinkByName(bridge)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Looking up bridge %s: %v", bridge, err)
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return false, fmt.Errorf("%s is a %s device, not a bridge", bridge, br.Type())
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return false, fmt.Errorf("Listing network devices: %v", err)
+	}
+	var uplink netlink.Link
+	for _, link := range links {
+		if link.Attrs().MasterIndex != br.Attrs().Index {
+			continue
+		}
+		if link.Attrs().Name != uplinkName {
+			return false, nil
+		}
+		uplink = link
+	}
+	if uplink == nil {
+		// It may exist without being attached to the bridge, e.g. if
+		// Ensure was interrupted.
+		uplink, err = netlink.LinkByName(uplinkName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			uplink = nil
+		} else if err != nil {
+			return false, fmt.Errorf("Looking up %s: %v", uplinkName, err)
+		}
+	}
+	if uplink != nil {
+		if err = netlink.LinkDel(uplink); err != nil {
+			return false, fmt.Errorf("Deleting %s: %v", uplinkName, err)
+		}
+	}
+	if err = netlink.LinkDel(br); err != nil {
+		return false, fmt.Errorf("Deleting bridge %s: %v", bridge, err)
+	}
+	return true, nil
+}
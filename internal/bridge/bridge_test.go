@@ -0,0 +1,316 @@
+package bridge
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The tests manipulate network devices, so they run in a network namespace
+// of their own, in which they may do so without disturbing the host, or
+// needing to be root. TestMain re-runs the test binary in a new user and
+// network namespace; if that isn't possible, the tests are skipped.
+const netnsEnv = "HIL_VPN_BRIDGE_TEST_NETNS"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(netnsEnv) == "" {
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), netnsEnv+"=1")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+			},
+		}
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		} else if err == nil {
+			os.Exit(0)
+		}
+		// We couldn't create the namespace; run the tests here, so they
+		// can report that they are being skipped.
+		os.Setenv(netnsEnv, "unavailable: "+err.Error())
+	}
+	os.Exit(m.Run())
+}
+
+// Skip the test unless we are in a network namespace of our own.
+func requireNetns(t *testing.T) {
+	if env := os.Getenv(netnsEnv); strings.HasPrefix(env, "unavailable: ") {
+		t.Skip("Could not create a network namespace:",
+			strings.TrimPrefix(env, "unavailable: "))
+	}
+}
+
+// Create a device of type `link`, failing the test if we can't, and
+// return it as the kernel reports it.
+func createLink(t *testing.T, link netlink.Link) netlink.Link {
+	if err := netlink.LinkAdd(link); err != nil {
+		t.Fatalf("Creating %s: %v", link.Attrs().Name, err)
+	}
+	return getLink(t, link.Attrs().Name)
+}
+
+// Create a tap device named `name`, like the one openvpn creates for a vpn.
+func addTap(t *testing.T, name string) netlink.Link {
+	return createLink(t, &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+	})
+}
+
+// Look up the device named `name`, failing the test if we can't.
+func getLink(t *testing.T, name string) netlink.Link {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("Looking up %s: %v", name, err)
+	}
+	return link
+}
+
+func TestAttachDetach(t *testing.T) {
+	requireNetns(t)
+	br := createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: Name(232)}})
+	defer netlink.LinkDel(br)
+	tap := addTap(t, "tapAttach")
+	defer netlink.LinkDel(tap)
+
+	if err := Attach("tapAttach", "br-vlan232"); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	tap = getLink(t, "tapAttach")
+	if tap.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Device was not attached to the bridge.")
+	}
+	if tap.Attrs().Flags&net.FlagUp == 0 {
+		t.Fatal("Device was not brought up.")
+	}
+
+	if err := Detach("tapAttach", "br-vlan232"); err != nil {
+		t.Fatal("Detaching:", err)
+	}
+	if getLink(t, "tapAttach").Attrs().MasterIndex != 0 {
+		t.Fatal("Device was not detached from the bridge.")
+	}
+
+	// Detaching again, or detaching a device which is gone, does nothing:
+	if err := Detach("tapAttach", "br-vlan232"); err != nil {
+		t.Fatal("Detaching a detached device:", err)
+	}
+	if err := Detach("tapMissing", "br-vlan232"); err != nil {
+		t.Fatal("Detaching a missing device:", err)
+	}
+}
+
+// Attaching to a bridge which is missing, or isn't a bridge, should fail
+// with an error saying so.
+func TestAttachBadBridge(t *testing.T) {
+	requireNetns(t)
+	tap := addTap(t, "tapBad")
+	defer netlink.LinkDel(tap)
+	notBridge := addTap(t, "br-vlan7")
+	defer netlink.LinkDel(notBridge)
+
+	cases := []struct{ bridge, expected string }{
+		{"br-vlan6", "does not exist"},
+		{"br-vlan7", "not a bridge"},
+	}
+	for _, c := range cases {
+		err := Attach("tapBad", c.bridge)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Attaching to %s: expected an error containing %q, got %v",
+				c.bridge, c.expected, err)
+		}
+	}
+	if getLink(t, "tapBad").Attrs().MasterIndex != 0 {
+		t.Fatal("Device was attached despite the error.")
+	}
+}
+
+// Skip the test if the kernel can't create vlan subinterfaces (i.e. the
+// 8021q module isn't available).
+func requireVlans(t *testing.T, trunk netlink.Link) {
+	probe := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: "vlanprobe", ParentIndex: trunk.Attrs().Index},
+		VlanId:    4094,
+	}
+	err := netlink.LinkAdd(probe)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("The kernel does not support vlan devices.")
+	} else if err != nil {
+		t.Fatal("Creating a vlan device:", err)
+	}
+	netlink.LinkDel(getLink(t, "vlanprobe"))
+}
+
+func TestEnsureRemove(t *testing.T) {
+	requireNetns(t)
+	// One end of a veth pair stands in for the trunk nic:
+	trunk := createLink(t, &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "trunk0"},
+		PeerName:  "trunk0peer",
+	})
+	defer netlink.LinkDel(trunk)
+	requireVlans(t, trunk)
+
+	// Ensure should be idempotent:
+	for i := 0; i < 2; i++ {
+		if err := Ensure("br-vlan232", "trunk0", 232); err != nil {
+			t.Fatal("Creating bridge:", err)
+		}
+	}
+	br := getLink(t, "br-vlan232")
+	vlanNic := getLink(t, "trunk0.232")
+	if vlanNic.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Vlan subinterface was not attached to the bridge.")
+	}
+	if vlanNic.(*netlink.Vlan).VlanId != 232 {
+		t.Fatalf("Vlan subinterface has the wrong vlan id: %d",
+			vlanNic.(*netlink.Vlan).VlanId)
+	}
+
+	removed, err := Remove("br-vlan232", "trunk0", 232)
+	if err != nil || !removed {
+		t.Fatalf("Removing bridge: removed = %v, err = %v", removed, err)
+	}
+	for _, name := range []string{"br-vlan232", "trunk0.232"} {
+		if _, err = netlink.LinkByName(name); err == nil {
+			t.Errorf("%s still exists after Remove.", name)
+		}
+	}
+}
+
+// Remove must leave bridges with other devices attached alone.
+func TestRemoveInUse(t *testing.T) {
+	requireNetns(t)
+	br := createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-vlan9"}})
+	defer netlink.LinkDel(br)
+	tap := addTap(t, "tapInUse")
+	defer netlink.LinkDel(tap)
+	if err := Attach("tapInUse", "br-vlan9"); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+
+	removed, err := Remove("br-vlan9", "trunk0", 9)
+	if err != nil || removed {
+		t.Fatalf("Removing bridge in use: removed = %v, err = %v", removed, err)
+	}
+	getLink(t, "br-vlan9")
+
+	// A bridge which is already gone counts as removed:
+	removed, err = Remove("br-vlan10", "trunk0", 10)
+	if err != nil || !removed {
+		t.Fatalf("Removing missing bridge: removed = %v, err = %v", removed, err)
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	if name := NameFrom("vl{vlan}-br", 232); name != "vl232-br" {
+		t.Fatalf("Expected vl232-br, but got %s", name)
+	}
+	if name := Name(232); name != "br-vlan232" {
+		t.Fatalf("Expected br-vlan232, but got %s", name)
+	}
+	cases := []struct {
+		tpl string
+		ok  bool
+	}{
+		{DefaultNameTemplate, true},
+		{"{vlan}", true},
+		{"brvlan-abcd{vlan}", true},
+		{"brvlan-abcde{vlan}", false},
+		{"br-vlan", false},
+		{"br{vlan}-{vlan}", false},
+		{"br {vlan}", false},
+		{"br/{vlan}", false},
+		{"br-vlan{VLAN}", false},
+	}
+	for _, c := range cases {
+		err := CheckNameTemplate(c.tpl)
+		if c.ok && err != nil {
+			t.Errorf("%q: unexpected error: %v", c.tpl, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%q: template was accepted, but should not have been", c.tpl)
+		}
+	}
+}
+
+// A PerVlan backend attaches devices to the bridges named by its template,
+// and CheckVlan reports whether they exist.
+func TestPerVlanNameTemplate(t *testing.T) {
+	requireNetns(t)
+	b := PerVlan{NameTemplate: "vl{vlan}-br"}
+	br := createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "vl232-br"}})
+	defer netlink.LinkDel(br)
+	tap := addTap(t, "tapTemplate")
+	defer netlink.LinkDel(tap)
+
+	if err := b.CheckVlan(232); err != nil {
+		t.Fatal("Checking vlan 232:", err)
+	}
+	if err := b.CheckVlan(233); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("Checking vlan 233: expected an error saying the bridge "+
+			"does not exist, got %v", err)
+	}
+	if err := b.Attach("tapTemplate", []uint16{232}, false); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	if getLink(t, "tapTemplate").Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Device was not attached to the bridge.")
+	}
+	if err := b.Detach("tapTemplate", []uint16{232}, false); err != nil {
+		t.Fatal("Detaching:", err)
+	}
+	if getLink(t, "tapTemplate").Attrs().MasterIndex != 0 {
+		t.Fatal("Device was not detached from the bridge.")
+	}
+}
+
+// A device carrying several vlans is attached to each vlan's bridge via a
+// subinterface, which Detach removes.
+func TestPerVlanTrunk(t *testing.T) {
+	requireNetns(t)
+	tap := addTap(t, "tapTagged")
+	defer netlink.LinkDel(tap)
+	requireVlans(t, tap)
+	brs := map[uint16]netlink.Link{}
+	for _, vlan := range []uint16{232, 233} {
+		brs[vlan] = createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: Name(vlan)}})
+		defer netlink.LinkDel(brs[vlan])
+	}
+
+	b := PerVlan{}
+	if err := b.Attach("tapTagged", []uint16{232, 233}, true); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	for vlan, br := range brs {
+		sub, ok := getLink(t, taggedName(tap, vlan)).(*netlink.Vlan)
+		if !ok || sub.VlanId != int(vlan) || sub.Attrs().ParentIndex != tap.Attrs().Index {
+			t.Fatalf("Expected %s to be a subinterface of the device for vlan %d; got %v",
+				taggedName(tap, vlan), vlan, sub)
+		}
+		if sub.Attrs().MasterIndex != br.Attrs().Index {
+			t.Fatalf("Subinterface for vlan %d was not attached to its bridge.", vlan)
+		}
+	}
+
+	if err := b.Detach("tapTagged", []uint16{232, 233}, true); err != nil {
+		t.Fatal("Detaching:", err)
+	}
+	for vlan := range brs {
+		if _, err := netlink.LinkByName(taggedName(tap, vlan)); err == nil {
+			t.Fatalf("Subinterface for vlan %d was not removed.", vlan)
+		}
+	}
+}
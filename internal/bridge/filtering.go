@@ -0,0 +1,225 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements the alternative to having a bridge for each vlan: a
+// single vlan-filtering bridge, on which each vpn's tap device is an
+// untagged "access" port for the vpn's vlan (or, for a vpn carrying several
+// vlans, a tagged port for them), and the trunk nic (if we
+// manage it) is a tagged port carrying the vlans which are in use. This
+// scales to large vlan ranges without creating thousands of devices.
+
+// The vlan which the kernel assigns to new bridge ports by default; we take
+// tap devices out of it, so they only see their own vlan.
+const defaultPvid = 1
+
+// Report whether vlan filtering is enabled on the bridge `br`.
+func vlanFiltering(br netlink.Link) (bool, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return false, err
+	}
+	if len(msgs) != 1 {
+		return false, fmt.Errorf("expected one reply from the kernel, but got %d", len(msgs))
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][nl.DeserializeIfInfomsg(msgs[0]).Len():])
+	if err != nil {
+		return false, err
+	}
+	// The setting is nested as IFLA_LINKINFO > IFLA_INFO_DATA >
+	// IFLA_BR_VLAN_FILTERING:
+	for _, attr := range attrs {
+		if attr.Attr.Type != unix.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return false, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type != nl.IFLA_INFO_DATA {
+				continue
+			}
+			data, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return false, err
+			}
+			for _, d := range data {
+				if d.Attr.Type == nl.IFLA_BR_VLAN_FILTERING && len(d.Value) > 0 {
+					return d.Value[0] == 1, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// Enable vlan filtering on the bridge `br`.
+func enableVlanFiltering(br netlink.Link) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, nl.IFLA_BR_VLAN_FILTERING, nl.Uint8Attr(1))
+	req.AddData(linkInfo)
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// Look up the bridge named `name`, failing if it doesn't exist, is some
+// other kind of device, or doesn't have vlan filtering enabled. Without
+// filtering, the bridge would forward traffic between all of its ports
+// regardless of vlan, so attaching a vpn to it would give the vpn's user
+// access to every vlan.
+func lookupFilteringBridge(name string) (*netlink.Bridge, error) {
+	br, err := lookupBridge(name)
+	if err != nil {
+		return nil, err
+	}
+	filtering, err := vlanFiltering(br)
+	if err != nil {
+		return nil, fmt.Errorf("Checking whether %s filters vlans: %v", name, err)
+	}
+	if !filtering {
+		return nil, fmt.Errorf("Bridge %s does not have vlan filtering enabled", name)
+	}
+	return br, nil
+}
+
+// Attach the device `dev` to the vlan-filtering bridge `bridge` as an
+// untagged port for vlan number `vlan`, and bring it up.
+func AttachAccess(dev, bridge string, vlan uint16) error {
+	br, err := lookupFilteringBridge(bridge)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	if err = netlink.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("Attaching %s to bridge %s: %v", dev, bridge, err)
+	}
+	// Set up the port's vlans before bringing it up, so that it never
+	// carries traffic for the wrong one:
+	if vlan != defaultPvid {
+		err = netlink.BridgeVlanDel(link, defaultPvid, true, true, false, true)
+		if err != nil {
+			return fmt.Errorf("Removing %s from vlan %d: %v", dev, defaultPvid, err)
+		}
+	}
+	if err = netlink.BridgeVlanAdd(link, vlan, true, true, false, true); err != nil {
+		return fmt.Errorf("Adding %s to vlan %d: %v", dev, vlan, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("Bringing up %s: %v", dev, err)
+	}
+	return nil
+}
+
+// Attach the device `dev` to the vlan-filtering bridge `bridge` as a tagged
+// port carrying the vlans in `vlans`, and bring it up. Untagged traffic on
+// the port is dropped.
+func AttachTrunk(dev, bridge string, vlans []uint16) error {
+	br, err := lookupFilteringBridge(bridge)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	if err = netlink.LinkSetMaster(link, br); err != nil {
+		return fmt.Errorf("Attaching %s to bridge %s: %v", dev, bridge, err)
+	}
+	// As with AttachAccess, the port's vlans must be right before it
+	// comes up:
+	err = netlink.BridgeVlanDel(link, defaultPvid, true, true, false, true)
+	if err != nil {
+		return fmt.Errorf("Removing %s from vlan %d: %v", dev, defaultPvid, err)
+	}
+	for _, vlan := range vlans {
+		if err = netlink.BridgeVlanAdd(link, vlan, false, false, false, true); err != nil {
+			return fmt.Errorf("Adding vlan %d to %s: %v", vlan, dev, err)
+		}
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("Bringing up %s: %v", dev, err)
+	}
+	return nil
+}
+
+// Make sure the vlan-filtering bridge `bridge` exists, with the nic `trunk`
+// attached to it as a tagged port carrying vlan number `vlan`, creating the
+// bridge and enabling filtering if need be, and that both are up.
+//
+// Note that this makes the trunk nic a port of the bridge, so it should not
+// have any addresses of its own.
+func EnsureFiltering(bridge, trunk string, vlan uint16) error {
+	trunkLink, err := netlink.LinkByName(trunk)
+	if err != nil {
+		return fmt.Errorf("Looking up trunk nic %s: %v", trunk, err)
+	}
+	br, err := addLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge}})
+	if err != nil {
+		return err
+	}
+	filtering, err := vlanFiltering(br)
+	if err == nil && !filtering {
+		err = enableVlanFiltering(br)
+	}
+	if err != nil {
+		return fmt.Errorf("Enabling vlan filtering on %s: %v", bridge, err)
+	}
+	if trunkLink.Attrs().MasterIndex != br.Attrs().Index {
+		if err = netlink.LinkSetMaster(trunkLink, br.(*netlink.Bridge)); err != nil {
+			return fmt.Errorf("Attaching %s to bridge %s: %v", trunk, bridge, err)
+		}
+	}
+	if err = netlink.BridgeVlanAdd(trunkLink, vlan, false, false, false, true); err != nil {
+		return fmt.Errorf("Adding vlan %d to %s: %v", vlan, trunk, err)
+	}
+	for _, link := range []netlink.Link{br, trunkLink} {
+		if err = netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("Bringing up %s: %v", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Undo EnsureFiltering for vlan number `vlan`, so that the trunk nic no
+// longer carries it. The bridge itself is left alone, since other vlans
+// share it. It is not an error if the bridge or the vlan is already gone.
+func RemoveTrunkVlan(bridge, trunk string, vlan uint16) error {
+	trunkLink, err := netlink.LinkByName(trunk)
+	if err != nil {
+		return fmt.Errorf("Looking up trunk nic %s: %v", trunk, err)
+	}
+	br, err := netlink.LinkByName(bridge)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Looking up bridge %s: %v", bridge, err)
+	}
+	if trunkLink.Attrs().MasterIndex != br.Attrs().Index {
+		return nil
+	}
+	err = netlink.BridgeVlanDel(trunkLink, vlan, false, false, false, true)
+	if err != nil && err != unix.ENOENT {
+		return fmt.Errorf("Removing vlan %d from %s: %v", vlan, trunk, err)
+	}
+	return nil
+}
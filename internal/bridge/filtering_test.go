@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Create a vlan-filtering bridge named `name`, skipping the test if the
+// kernel doesn't support vlan filtering.
+func createFilteringBridge(t *testing.T, name string) netlink.Link {
+	br := createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	err := enableVlanFiltering(br)
+	if err == unix.EOPNOTSUPP {
+		netlink.LinkDel(br)
+		t.Skip("The kernel does not support vlan filtering.")
+	} else if err != nil {
+		t.Fatal("Enabling vlan filtering:", err)
+	}
+	return br
+}
+
+// Return the vlans of the bridge port `link`, by vlan id.
+func portVlans(t *testing.T, link netlink.Link) map[uint16]*struct{ pvid, untagged bool } {
+	all, err := netlink.BridgeVlanList()
+	if err != nil {
+		t.Fatal("Listing bridge vlans:", err)
+	}
+	ret := map[uint16]*struct{ pvid, untagged bool }{}
+	for _, info := range all[int32(link.Attrs().Index)] {
+		ret[info.Vid] = &struct{ pvid, untagged bool }{info.PortVID(), info.EngressUntag()}
+	}
+	return ret
+}
+
+// Attaching a vpn to a bridge which doesn't filter vlans would give it
+// access to all of them, so it must fail.
+func TestAttachAccessUnfiltered(t *testing.T) {
+	requireNetns(t)
+	br := createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-unfiltered"}})
+	defer netlink.LinkDel(br)
+	tap := addTap(t, "tapUnfiltered")
+	defer netlink.LinkDel(tap)
+
+	err := AttachAccess("tapUnfiltered", "br-unfiltered", 232)
+	if err == nil || !strings.Contains(err.Error(), "vlan filtering") {
+		t.Fatalf("Expected an error about vlan filtering, but got %v", err)
+	}
+	if getLink(t, "tapUnfiltered").Attrs().MasterIndex != 0 {
+		t.Fatal("Device was attached despite the error.")
+	}
+}
+
+func TestAttachAccess(t *testing.T) {
+	requireNetns(t)
+	br := createFilteringBridge(t, "br-hil")
+	defer netlink.LinkDel(br)
+	tap := addTap(t, "tapAccess")
+	defer netlink.LinkDel(tap)
+
+	if err := AttachAccess("tapAccess", "br-hil", 232); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	tap = getLink(t, "tapAccess")
+	if tap.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Device was not attached to the bridge.")
+	}
+	vlans := portVlans(t, tap)
+	if len(vlans) != 1 || vlans[232] == nil || !vlans[232].pvid || !vlans[232].untagged {
+		t.Fatalf("Expected the port to be an untagged member of vlan 232 only; "+
+			"got %v", vlans)
+	}
+}
+
+func TestEnsureFiltering(t *testing.T) {
+	requireNetns(t)
+	createFilteringBridge(t, "br-probe")
+	netlink.LinkDel(getLink(t, "br-probe"))
+	trunk := createLink(t, &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "trunk1"},
+		PeerName:  "trunk1peer",
+	})
+	defer netlink.LinkDel(trunk)
+
+	for _, vlan := range []uint16{232, 233, 232} {
+		if err := EnsureFiltering("br-hil", "trunk1", vlan); err != nil {
+			t.Fatal("Setting up bridge:", err)
+		}
+	}
+	br := getLink(t, "br-hil")
+	defer netlink.LinkDel(br)
+	trunk = getLink(t, "trunk1")
+	if trunk.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Trunk nic was not attached to the bridge.")
+	}
+	vlans := portVlans(t, trunk)
+	for _, vlan := range []uint16{232, 233} {
+		if vlans[vlan] == nil || vlans[vlan].untagged {
+			t.Fatalf("Expected the trunk to carry vlan %d tagged; got %v", vlan, vlans)
+		}
+	}
+
+	if err := RemoveTrunkVlan("br-hil", "trunk1", 232); err != nil {
+		t.Fatal("Removing vlan:", err)
+	}
+	vlans = portVlans(t, trunk)
+	if vlans[232] != nil || vlans[233] == nil {
+		t.Fatalf("Expected the trunk to carry only vlan 233 (and the default); got %v", vlans)
+	}
+	// Removing it again does nothing:
+	if err := RemoveTrunkVlan("br-hil", "trunk1", 232); err != nil {
+		t.Fatal("Removing vlan again:", err)
+	}
+}
+
+func TestAttachTrunk(t *testing.T) {
+	requireNetns(t)
+	br := createFilteringBridge(t, "br-hil")
+	defer netlink.LinkDel(br)
+	tap := addTap(t, "tapTrunk")
+	defer netlink.LinkDel(tap)
+
+	if err := AttachTrunk("tapTrunk", "br-hil", []uint16{232, 233}); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	tap = getLink(t, "tapTrunk")
+	if tap.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Device was not attached to the bridge.")
+	}
+	vlans := portVlans(t, tap)
+	if len(vlans) != 2 {
+		t.Fatalf("Expected the port to carry vlans 232 and 233 only; got %v", vlans)
+	}
+	for _, vid := range []uint16{232, 233} {
+		if vlans[vid] == nil || vlans[vid].pvid || vlans[vid].untagged {
+			t.Fatalf("Expected the port to be a tagged member of vlan %d; got %v",
+				vid, vlans)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb"
+)
+
+// A Backend with a single Open vSwitch bridge, named by Bridge, on which
+// each device is an access port for its vlan (i.e. the port's "tag" is the
+// vlan number), or, if it is a trunk, a trunk port for its vlans (the port's
+// "trunks"). We configure Open vSwitch via ovsdb-server's socket, at Socket
+// (ovsdb.DefaultSocket if empty).
+//
+// The bridge, and its connection to the network, must be set up ahead of
+// time, so Ensure just checks that it exists.
+//
+// Unlike Linux bridges, Open vSwitch keeps a device's port after the device
+// is destroyed, so Detach must be called when the vpn is stopped; Attach
+// replaces any port left over from before in any case.
+type OVS struct {
+	Bridge string
+	Socket string
+}
+
+// Connect to ovsdb-server.
+func (b OVS) dial() (*ovsdb.Client, error) {
+	socket := b.Socket
+	if socket == "" {
+		socket = ovsdb.DefaultSocket
+	}
+	return ovsdb.Dial(socket)
+}
+
+func (b OVS) Ensure(vlan uint16) error {
+	return b.Check()
+}
+
+func (b OVS) CheckVlan(vlan uint16) error {
+	return b.Check()
+}
+
+// Check that we can reach ovsdb-server, and that the bridge exists.
+func (b OVS) Check() error {
+	c, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	results, err := c.Transact(ovsdb.OpenVSwitch, ovsdb.Op{
+		"op":      "select",
+		"table":   "Bridge",
+		"where":   []interface{}{ovsdb.Cond("name", "==", b.Bridge)},
+		"columns": []string{"name"},
+	})
+	if err != nil {
+		return fmt.Errorf("Looking up bridge %s: %v", b.Bridge, err)
+	}
+	if len(results[0].Rows) == 0 {
+		return fmt.Errorf("Open vSwitch bridge %s does not exist", b.Bridge)
+	}
+	return nil
+}
+
+func (b OVS) Release(vlan uint16) error {
+	return nil
+}
+
+func (b OVS) Attach(dev string, vlans []uint16, tagged bool) error {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return fmt.Errorf("Looking up device %s: %v", dev, err)
+	}
+	c, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// Any port left over from before is replaced in the same transaction,
+	// so the device is never left without a port if we fail part way:
+	removeOps, err := removePortOps(c, dev)
+	if err != nil {
+		return err
+	}
+	port := ovsdb.Row{"name": dev, "interfaces": ovsdb.NamedUUID("iface")}
+	if !tagged {
+		port["tag"] = vlans[0]
+	} else {
+		trunks := []interface{}{}
+		for _, vlan := range vlans {
+			trunks = append(trunks, vlan)
+		}
+		port["trunks"] = ovsdb.Set(trunks...)
+	}
+	ops := []ovsdb.Op{{
+		// Fail (rather than wait) if the bridge doesn't exist:
+		"op":      "wait",
+		"table":   "Bridge",
+		"timeout": 0,
+		"where":   []interface{}{ovsdb.Cond("name", "==", b.Bridge)},
+		"columns": []string{"name"},
+		"until":   "==",
+		"rows":    []interface{}{ovsdb.Row{"name": b.Bridge}},
+	}}
+	ops = append(ops, removeOps...)
+	ops = append(ops,
+		ovsdb.Op{
+			"op":        "insert",
+			"table":     "Interface",
+			"row":       ovsdb.Row{"name": dev},
+			"uuid-name": "iface",
+		},
+		ovsdb.Op{
+			"op":        "insert",
+			"table":     "Port",
+			"row":       port,
+			"uuid-name": "port",
+		},
+		ovsdb.Op{
+			"op":    "mutate",
+			"table": "Bridge",
+			"where": []interface{}{ovsdb.Cond("name", "==", b.Bridge)},
+			"mutations": []interface{}{
+				ovsdb.Mutation("ports", "insert", ovsdb.Set(ovsdb.NamedUUID("port"))),
+			},
+		},
+	)
+	_, err = c.Transact(ovsdb.OpenVSwitch, ops...)
+	if e, ok := err.(*ovsdb.Error); ok && e.Op == 0 {
+		return fmt.Errorf("Open vSwitch bridge %s does not exist", b.Bridge)
+	} else if err != nil {
+		return fmt.Errorf("Attaching %s to bridge %s: %v", dev, b.Bridge, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("Bringing up %s: %v", dev, err)
+	}
+	return nil
+}
+
+func (b OVS) Detach(dev string, vlans []uint16, tagged bool) error {
+	c, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ops, err := removePortOps(c, dev)
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	if _, err = c.Transact(ovsdb.OpenVSwitch, ops...); err != nil {
+		return fmt.Errorf("Removing port %s: %v", dev, err)
+	}
+	return nil
+}
+
+// Return the operations which remove the port named `dev` from whichever
+// bridge it is on, if any. If the port goes away before they are run, they
+// do nothing.
+func removePortOps(c *ovsdb.Client, dev string) ([]ovsdb.Op, error) {
+	results, err := c.Transact(ovsdb.OpenVSwitch, ovsdb.Op{
+		"op":      "select",
+		"table":   "Port",
+		"where":   []interface{}{ovsdb.Cond("name", "==", dev)},
+		"columns": []string{"_uuid"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Looking up port %s: %v", dev, err)
+	}
+	ops := []ovsdb.Op{}
+	for _, row := range results[0].Rows {
+		uuid, ok := ovsdb.RowUUID(row["_uuid"])
+		if !ok {
+			return nil, fmt.Errorf("Looking up port %s: bad uuid %v", dev, row["_uuid"])
+		}
+		// The port's interface goes with it; ovsdb-server deletes rows
+		// which are no longer referenced.
+		ops = append(ops,
+			ovsdb.Op{
+				"op":    "mutate",
+				"table": "Bridge",
+				"where": []interface{}{ovsdb.Cond("ports", "includes", ovsdb.UUID(uuid))},
+				"mutations": []interface{}{
+					ovsdb.Mutation("ports", "delete", ovsdb.Set(ovsdb.UUID(uuid))),
+				},
+			},
+			ovsdb.Op{
+				"op":    "delete",
+				"table": "Port",
+				"where": []interface{}{ovsdb.Cond("_uuid", "==", ovsdb.UUID(uuid))},
+			},
+		)
+	}
+	return ops, nil
+}
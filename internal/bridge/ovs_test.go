@@ -0,0 +1,183 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb"
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb/ovsdbtest"
+)
+
+// Start a fake ovsdb server with a bridge named "br-ovs", and return it
+// along with an OVS backend for that bridge.
+func startOvsdb(t *testing.T) (*ovsdbtest.Server, OVS) {
+	dir, err := ioutil.TempDir("", "hil-vpn-ovs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "db.sock")
+	srv, err := ovsdbtest.NewServer(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	srv.Insert("Bridge", ovsdb.Row{"name": "br-ovs"})
+	return srv, OVS{Bridge: "br-ovs", Socket: socket}
+}
+
+// Return the ports on the bridge "br-ovs", by name.
+func ovsPorts(t *testing.T, srv *ovsdbtest.Server) map[string]ovsdb.Row {
+	bridges := srv.Find("Bridge", "name", "br-ovs")
+	if len(bridges) != 1 {
+		t.Fatalf("Expected one bridge named br-ovs, but found %d", len(bridges))
+	}
+	ports := map[string]ovsdb.Row{}
+	for _, br := range bridges {
+		for _, ref := range ovsdbtest.Atoms(br["ports"]) {
+			uuid, _ := ovsdb.RowUUID(ref)
+			row, ok := srv.Rows("Port")[uuid]
+			if !ok {
+				t.Fatalf("Bridge refers to missing port %v", ref)
+			}
+			ports[row["name"].(string)] = row
+		}
+	}
+	return ports
+}
+
+func TestOVSAttachDetach(t *testing.T) {
+	requireNetns(t)
+	srv, b := startOvsdb(t)
+	tap := addTap(t, "tapOvs")
+	defer netlink.LinkDel(tap)
+
+	if err := b.Ensure(232); err != nil {
+		t.Fatal("Ensure:", err)
+	}
+	// Attaching twice leaves a single port, as when openvpn restarts
+	// without the vpn having been stopped cleanly:
+	for i := 0; i < 2; i++ {
+		if err := b.Attach("tapOvs", []uint16{232}, false); err != nil {
+			t.Fatal("Attaching:", err)
+		}
+	}
+	ports := ovsPorts(t, srv)
+	if len(ports) != 1 || ports["tapOvs"] == nil {
+		t.Fatalf("Expected just the port tapOvs, but got %v", ports)
+	}
+	if tag := ports["tapOvs"]["tag"]; tag != float64(232) {
+		t.Fatalf("Port has tag %v, wanted 232", tag)
+	}
+	if getLink(t, "tapOvs").Attrs().Flags&net.FlagUp == 0 {
+		t.Fatal("Device was not brought up.")
+	}
+
+	if err := b.Detach("tapOvs", []uint16{232}, false); err != nil {
+		t.Fatal("Detaching:", err)
+	}
+	if ports = ovsPorts(t, srv); len(ports) != 0 {
+		t.Fatalf("Port was not removed; ports are %v", ports)
+	}
+	// Detaching again does nothing:
+	if err := b.Detach("tapOvs", []uint16{232}, false); err != nil {
+		t.Fatal("Detaching a detached device:", err)
+	}
+}
+
+// A device carrying several vlans gets a trunk port.
+func TestOVSTrunk(t *testing.T) {
+	requireNetns(t)
+	srv, b := startOvsdb(t)
+	tap := addTap(t, "tapOvsTrunk")
+	defer netlink.LinkDel(tap)
+
+	if err := b.Attach("tapOvsTrunk", []uint16{232, 233}, true); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	port := ovsPorts(t, srv)["tapOvsTrunk"]
+	if port == nil {
+		t.Fatal("No port was created.")
+	}
+	if tag, ok := port["tag"]; ok {
+		t.Fatalf("Trunk port has tag %v; wanted none", tag)
+	}
+	trunks := ovsdbtest.Atoms(port["trunks"])
+	if len(trunks) != 2 || trunks[0] != float64(232) || trunks[1] != float64(233) {
+		t.Fatalf("Port has trunks %v, wanted 232 and 233", trunks)
+	}
+}
+
+// A trunk of a single vlan still gets a trunk port, carrying it tagged.
+func TestOVSTrunkOfOne(t *testing.T) {
+	requireNetns(t)
+	srv, b := startOvsdb(t)
+	tap := addTap(t, "tapOvsTrunk1")
+	defer netlink.LinkDel(tap)
+
+	if err := b.Attach("tapOvsTrunk1", []uint16{232}, true); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	port := ovsPorts(t, srv)["tapOvsTrunk1"]
+	if port == nil {
+		t.Fatal("No port was created.")
+	}
+	if tag, ok := port["tag"]; ok {
+		t.Fatalf("Trunk port has tag %v; wanted none", tag)
+	}
+	if trunks := ovsdbtest.Atoms(port["trunks"]); len(trunks) != 1 || trunks[0] != float64(232) {
+		t.Fatalf("Port has trunks %v, wanted 232", trunks)
+	}
+}
+
+// Attaching to a bridge which doesn't exist should fail, and leave nothing
+// behind.
+func TestOVSMissingBridge(t *testing.T) {
+	requireNetns(t)
+	srv, b := startOvsdb(t)
+	tap := addTap(t, "tapOvsBad")
+	defer netlink.LinkDel(tap)
+
+	b.Bridge = "br-missing"
+	if err := b.Ensure(232); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Ensure: expected an error saying the bridge does not exist, got %v", err)
+	}
+	err := b.Attach("tapOvsBad", []uint16{232}, false)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Attach: expected an error saying the bridge does not exist, got %v", err)
+	}
+	if rows := srv.Rows("Port"); len(rows) != 0 {
+		t.Fatalf("Ports were created despite the error: %v", rows)
+	}
+}
+
+// A failed Attach should leave any port from before in place, rather than
+// removing it and then failing to add the new one.
+func TestOVSReattachFails(t *testing.T) {
+	requireNetns(t)
+	srv, b := startOvsdb(t)
+	tap := addTap(t, "tapOvsRe")
+	defer netlink.LinkDel(tap)
+
+	if err := b.Attach("tapOvsRe", []uint16{232}, false); err != nil {
+		t.Fatal("Attaching:", err)
+	}
+	missing := b
+	missing.Bridge = "br-missing"
+	if err := missing.Attach("tapOvsRe", []uint16{233}, false); err == nil {
+		t.Fatal("Attaching to a missing bridge succeeded.")
+	}
+	port := ovsPorts(t, srv)["tapOvsRe"]
+	if port == nil {
+		t.Fatal("The failed Attach removed the existing port.")
+	}
+	if tag := port["tag"]; tag != float64(232) {
+		t.Fatalf("Port has tag %v, wanted 232", tag)
+	}
+}
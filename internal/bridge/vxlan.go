@@ -0,0 +1,143 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The IANA-assigned port for vxlan, which the kernel doesn't default to for
+// historical reasons.
+const DefaultVxlanPort = 4789
+
+// Return the name of the bridge for the vxlan network `vni`.
+func VxlanBridgeName(vni uint32) string {
+	return fmt.Sprintf("br-vx%d", vni)
+}
+
+// Return the name of the vxlan device which connects the bridge for the
+// vxlan network `vni` to the network.
+func VxlanDevName(vni uint32) string {
+	return fmt.Sprintf("vxlan%d", vni)
+}
+
+// Vxlan attaches devices to vxlan overlay networks, rather than vlans. Each
+// network gets a Linux bridge of its own (see VxlanBridgeName), which is
+// created on demand, connected to the network via a vxlan device whose
+// local tunnel endpoint (VTEP) is the address Local.
+//
+// If Group is set, the networks' broadcast traffic is sent to that
+// multicast group, over the nic named by Dev. Otherwise, the vxlan devices
+// only learn where remote hosts are from the traffic they receive, and
+// something else (e.g. an EVPN daemon) is expected to fill in the
+// forwarding database. Port is the UDP port to use, or DefaultVxlanPort if
+// zero.
+type Vxlan struct {
+	Local net.IP
+	Group net.IP
+	Dev   string
+	Port  uint16
+}
+
+// Check that the host can carry vxlan networks: that Local is one of its
+// addresses, and that Dev exists, if set.
+func (v Vxlan) Check() error {
+	if v.Local == nil {
+		return fmt.Errorf("No local vxlan tunnel endpoint is configured")
+	}
+	if v.Dev != "" {
+		if _, err := netlink.LinkByName(v.Dev); err != nil {
+			return fmt.Errorf("Looking up vxlan nic %s: %v", v.Dev, err)
+		}
+	}
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("Listing addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(v.Local) {
+			return nil
+		}
+	}
+	return fmt.Errorf("The local vxlan tunnel endpoint %s is not an address "+
+		"of this host", v.Local)
+}
+
+// Make sure the bridge for the vxlan network `vni` exists, connected to
+// the network via a vxlan device (see VxlanDevName), creating whichever of
+// these are missing, and that they are up.
+func (v Vxlan) Ensure(vni uint32) error {
+	if v.Local == nil {
+		return fmt.Errorf("No local vxlan tunnel endpoint is configured")
+	}
+	vx := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: VxlanDevName(vni)},
+		VxlanId:   int(vni),
+		SrcAddr:   v.Local,
+		Group:     v.Group,
+		Learning:  true,
+		Port:      int(v.Port),
+	}
+	if vx.Port == 0 {
+		vx.Port = DefaultVxlanPort
+	}
+	if v.Dev != "" {
+		dev, err := netlink.LinkByName(v.Dev)
+		if err != nil {
+			return fmt.Errorf("Looking up vxlan nic %s: %v", v.Dev, err)
+		}
+		vx.VtepDevIndex = dev.Attrs().Index
+	}
+	bridge := VxlanBridgeName(vni)
+	br, err := addLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridge}})
+	if err != nil {
+		return err
+	}
+	vxLink, err := addLink(vx)
+	if err != nil {
+		return err
+	}
+	if id := vxLink.(*netlink.Vxlan).VxlanId; id != int(vni) {
+		return fmt.Errorf("%s is the vxlan device for VNI %d, not %d",
+			vx.Name, id, vni)
+	}
+	if vxLink.Attrs().MasterIndex != br.Attrs().Index {
+		if err = netlink.LinkSetMaster(vxLink, br.(*netlink.Bridge)); err != nil {
+			return fmt.Errorf("Attaching %s to bridge %s: %v", vx.Name, bridge, err)
+		}
+	}
+	for _, link := range []netlink.Link{br, vxLink} {
+		if err = netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("Bringing up %s: %v", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// Undo Ensure, once no vpn uses the vxlan network `vni` any more. If
+// anything other than the vxlan device is still attached to the bridge, it
+// is left alone, and this returns an error saying so.
+func (v Vxlan) Release(vni uint32) error {
+	bridge := VxlanBridgeName(vni)
+	removed, err := removeBridge(bridge, VxlanDevName(vni))
+	if err == nil && !removed {
+		err = fmt.Errorf("Not removing bridge %s; other devices are still "+
+			"attached to it", bridge)
+	}
+	return err
+}
+
+// Attach the device `dev` to the vxlan network `vni`, and bring it up. This
+// prepares the host for the network first, as Ensure does.
+func (v Vxlan) Attach(dev string, vni uint32) error {
+	if err := v.Ensure(vni); err != nil {
+		return err
+	}
+	return Attach(dev, VxlanBridgeName(vni))
+}
+
+// Detach the device `dev` from the vxlan network `vni`; see Detach.
+func (v Vxlan) Detach(dev string, vni uint32) error {
+	return Detach(dev, VxlanBridgeName(vni))
+}
@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Create a device with the address `ip`, to stand in for the nic carrying
+// the host's vxlan tunnel endpoint, and return it.
+func addVtep(t *testing.T, ip string) netlink.Link {
+	// A bridge, since we can count on the kernel supporting those:
+	link := createLink(t, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "vtep0"}})
+	addr, err := netlink.ParseAddr(ip + "/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		t.Fatal("Adding address:", err)
+	}
+	return link
+}
+
+// Skip the test if the kernel can't create vxlan devices.
+func requireVxlan(t *testing.T, v Vxlan) {
+	probe := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: "vxlanprobe"},
+		VxlanId:   1,
+		SrcAddr:   v.Local,
+		Port:      DefaultVxlanPort,
+	}
+	err := netlink.LinkAdd(probe)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("The kernel does not support vxlan devices.")
+	} else if err != nil {
+		t.Fatal("Creating a vxlan device:", err)
+	}
+	netlink.LinkDel(getLink(t, "vxlanprobe"))
+}
+
+func TestVxlan(t *testing.T) {
+	requireNetns(t)
+	vtep := addVtep(t, "192.0.2.1")
+	defer netlink.LinkDel(vtep)
+	v := Vxlan{Local: net.ParseIP("192.0.2.1"), Dev: "vtep0"}
+	requireVxlan(t, v)
+	tap := addTap(t, "tapVxlan")
+	defer netlink.LinkDel(tap)
+
+	if err := v.Check(); err != nil {
+		t.Fatal("Check:", err)
+	}
+	// Attaching twice is fine, as when openvpn restarts:
+	for i := 0; i < 2; i++ {
+		if err := v.Attach("tapVxlan", 5000); err != nil {
+			t.Fatal("Attaching:", err)
+		}
+	}
+	br := getLink(t, "br-vx5000")
+	vx := getLink(t, "vxlan5000")
+	if vx.Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Vxlan device was not attached to the bridge.")
+	}
+	if id := vx.(*netlink.Vxlan).VxlanId; id != 5000 {
+		t.Fatalf("Vxlan device has the wrong VNI: %d", id)
+	}
+	if getLink(t, "tapVxlan").Attrs().MasterIndex != br.Attrs().Index {
+		t.Fatal("Device was not attached to the bridge.")
+	}
+
+	if err := v.Release(5000); err == nil {
+		t.Fatal("Released the bridge while a device was still attached.")
+	}
+	if err := v.Detach("tapVxlan", 5000); err != nil {
+		t.Fatal("Detaching:", err)
+	}
+	if err := v.Release(5000); err != nil {
+		t.Fatal("Releasing:", err)
+	}
+	for _, name := range []string{"br-vx5000", "vxlan5000"} {
+		if _, err := netlink.LinkByName(name); err == nil {
+			t.Errorf("%s still exists after Release.", name)
+		}
+	}
+}
+
+// Check should fail if the local tunnel endpoint isn't one of the host's
+// addresses.
+func TestVxlanCheckLocal(t *testing.T) {
+	requireNetns(t)
+	vtep := addVtep(t, "192.0.2.1")
+	defer netlink.LinkDel(vtep)
+	v := Vxlan{Local: net.ParseIP("192.0.2.2")}
+	err := v.Check()
+	if err == nil || !strings.Contains(err.Error(), "not an address") {
+		t.Fatalf("Expected an error saying 192.0.2.2 is not an address, got %v", err)
+	}
+}
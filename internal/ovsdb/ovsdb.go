@@ -0,0 +1,245 @@
+// Package ovsdb is a minimal client for the Open vSwitch database
+// management protocol (RFC 7047), which is how we configure Open vSwitch
+// bridges; it implements just enough to run transactions against the
+// database, which is all ovs-vsctl does too.
+//
+// The protocol is JSON-RPC 1.0 over (usually) a unix socket. Values in the
+// database are represented as in the RFC; see UUID, NamedUUID and Set.
+package ovsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The database Open vSwitch keeps its configuration in.
+const OpenVSwitch = "Open_vSwitch"
+
+// The usual path to ovsdb-server's socket.
+const DefaultSocket = "/var/run/openvswitch/db.sock"
+
+// How long to wait for the server to answer, before giving up.
+var Timeout = 30 * time.Second
+
+// An operation in a transaction, e.g. {"op": "insert", ...}.
+type Op map[string]interface{}
+
+// A row of a table, mapping column names to values.
+type Row map[string]interface{}
+
+// A condition on a row, for use in "where" clauses, e.g.
+// Cond("name", "==", "br0").
+func Cond(column, function string, value interface{}) []interface{} {
+	return []interface{}{column, function, value}
+}
+
+// A mutation of a row, for use in "mutate" operations, e.g.
+// Mutation("ports", "insert", Set(port)).
+func Mutation(column, mutator string, value interface{}) []interface{} {
+	return []interface{}{column, mutator, value}
+}
+
+// Return the representation of the row with the given uuid.
+func UUID(uuid string) []interface{} {
+	return []interface{}{"uuid", uuid}
+}
+
+// Return the representation of the row inserted earlier in the same
+// transaction with the given "uuid-name".
+func NamedUUID(name string) []interface{} {
+	return []interface{}{"named-uuid", name}
+}
+
+// Return the representation of a set containing `values`.
+func Set(values ...interface{}) []interface{} {
+	return []interface{}{"set", values}
+}
+
+// The result of an operation in a transaction. Which fields are set
+// depends on the operation.
+type Result struct {
+	// For "insert": the new row's uuid, as ["uuid", <uuid>].
+	UUID []string `json:"uuid,omitempty"`
+
+	// For "update", "mutate" and "delete": the number of rows affected.
+	Count int `json:"count,omitempty"`
+
+	// For "select": the selected rows.
+	Rows []Row `json:"rows,omitempty"`
+
+	// If the operation failed.
+	Error   string `json:"error,omitempty"`
+	Details string `json:"details,omitempty"`
+}
+
+// An error reported by the server for a transaction.
+type Error struct {
+	// The index of the operation which failed, or -1 if the error
+	// applies to the transaction as a whole.
+	Op int
+
+	Kind    string
+	Details string
+}
+
+func (e *Error) Error() string {
+	msg := "ovsdb: " + e.Kind
+	if e.Details != "" {
+		msg += ": " + e.Details
+	}
+	if e.Op >= 0 {
+		msg = fmt.Sprintf("%s (operation %d)", msg, e.Op)
+	}
+	return msg
+}
+
+// A JSON-RPC request (or, with a null ID, notification).
+type request struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     interface{}   `json:"id"`
+}
+
+// A JSON-RPC response. Error is null unless the request failed.
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+	ID     interface{}     `json:"id"`
+}
+
+// A message received from the server, which may be either of the above.
+type message struct {
+	request
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+}
+
+// A connection to an ovsdb server.
+type Client struct {
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	nextID int
+}
+
+// Connect to the ovsdb server listening on the unix socket at `path`.
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to ovsdb: %v", err)
+	}
+	return &Client{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Run a transaction made up of `ops` against the database `db`, returning
+// the results of the operations. If the server reports an error (in which
+// case the transaction has no effect), it is returned as an *Error.
+func (c *Client) Transact(db string, ops ...Op) ([]Result, error) {
+	params := []interface{}{db}
+	for _, op := range ops {
+		params = append(params, op)
+	}
+	var results []Result
+	if err := c.call("transact", params, &results); err != nil {
+		return nil, err
+	}
+	for i, r := range results {
+		if r.Error != "" {
+			// Per the RFC, there may be an extra result beyond those
+			// for the operations, if committing failed:
+			if i >= len(ops) {
+				i = -1
+			}
+			return nil, &Error{Op: i, Kind: r.Error, Details: r.Details}
+		}
+	}
+	if len(results) < len(ops) {
+		return nil, fmt.Errorf("ovsdb: expected %d results, but got %d",
+			len(ops), len(results))
+	}
+	return results, nil
+}
+
+// Call the method `method` with the given parameters, decoding its result
+// into `result`.
+func (c *Client) call(method string, params []interface{}, result interface{}) error {
+	c.nextID++
+	id := c.nextID
+	c.conn.SetDeadline(time.Now().Add(Timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	err := c.enc.Encode(request{Method: method, Params: params, ID: id})
+	if err != nil {
+		return fmt.Errorf("Sending request to ovsdb: %v", err)
+	}
+	for {
+		var msg message
+		if err = c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("Reading response from ovsdb: %v", err)
+		}
+		if msg.Method == "echo" {
+			// The server's keepalive; we must echo its params back.
+			if msg.Params == nil {
+				msg.Params = []interface{}{}
+			}
+			err = c.enc.Encode(response{Result: mustMarshal(msg.Params), ID: msg.ID})
+			if err != nil {
+				return fmt.Errorf("Replying to ovsdb echo: %v", err)
+			}
+			continue
+		}
+		if msg.Method != "" || !sameID(msg.ID, id) {
+			// Some other notification, or a stale response; not ours.
+			continue
+		}
+		if msg.Error != nil {
+			return &Error{Op: -1, Kind: fmt.Sprint(msg.Error)}
+		}
+		if err = json.Unmarshal(msg.Result, result); err != nil {
+			return fmt.Errorf("Decoding response from ovsdb: %v", err)
+		}
+		return nil
+	}
+}
+
+// Report whether the id of a response, as decoded from JSON, is `id`.
+func sameID(decoded interface{}, id int) bool {
+	n, ok := decoded.(float64)
+	return ok && n == float64(id)
+}
+
+// Return the JSON encoding of `v`, which must be encodable.
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Return the uuid of a row, from the "_uuid" column of a selected row or
+// the "uuid" field of an insert's result, both of which have the form
+// ["uuid", <uuid>].
+func RowUUID(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case []string:
+		if len(v) == 2 && v[0] == "uuid" {
+			return v[1], true
+		}
+	case []interface{}:
+		if len(v) == 2 && v[0] == "uuid" {
+			s, ok := v[1].(string)
+			return s, ok
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,110 @@
+package ovsdb_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb"
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb/ovsdbtest"
+)
+
+// Start a fake server, and connect to it.
+func dialTestServer(t *testing.T) (*ovsdbtest.Server, *ovsdb.Client) {
+	dir, err := ioutil.TempDir("", "ovsdb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	srv, err := ovsdbtest.NewServer(filepath.Join(dir, "db.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	client, err := ovsdb.Dial(filepath.Join(dir, "db.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return srv, client
+}
+
+// A transaction's results are returned in order, and named uuids refer to
+// rows inserted earlier in the same transaction; we also answer the
+// server's echo requests along the way.
+func TestTransact(t *testing.T) {
+	srv, client := dialTestServer(t)
+	srv.SendEcho = true
+	brUUID := srv.Insert("Bridge", ovsdb.Row{"name": "br0"})
+	results, err := client.Transact(ovsdb.OpenVSwitch,
+		ovsdb.Op{
+			"op":        "insert",
+			"table":     "Port",
+			"row":       ovsdb.Row{"name": "tap0"},
+			"uuid-name": "port",
+		},
+		ovsdb.Op{
+			"op":        "mutate",
+			"table":     "Bridge",
+			"where":     []interface{}{ovsdb.Cond("name", "==", "br0")},
+			"mutations": []interface{}{ovsdb.Mutation("ports", "insert", ovsdb.Set(ovsdb.NamedUUID("port")))},
+		},
+		ovsdb.Op{
+			"op":    "select",
+			"table": "Bridge",
+			"where": []interface{}{ovsdb.Cond("name", "==", "br0")},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portUUID, ok := ovsdb.RowUUID(results[0].UUID)
+	if !ok {
+		t.Fatalf("Insert returned bad uuid %v", results[0].UUID)
+	}
+	if results[1].Count != 1 {
+		t.Fatalf("Mutated %d rows, wanted 1", results[1].Count)
+	}
+	if len(results[2].Rows) != 1 {
+		t.Fatalf("Selected %d rows, wanted 1", len(results[2].Rows))
+	}
+	if uuid, _ := ovsdb.RowUUID(results[2].Rows[0]["_uuid"]); uuid != brUUID {
+		t.Fatalf("Selected bridge %s, wanted %s", uuid, brUUID)
+	}
+	ports := ovsdbtest.Atoms(srv.Rows("Bridge")[brUUID]["ports"])
+	if len(ports) != 1 {
+		t.Fatalf("Bridge has ports %v, wanted just %s", ports, portUUID)
+	}
+	if uuid, _ := ovsdb.RowUUID(ports[0]); uuid != portUUID {
+		t.Fatalf("Bridge has port %s, wanted %s", uuid, portUUID)
+	}
+}
+
+// If an operation fails, we get an *Error identifying it, and the
+// transaction has no effect.
+func TestTransactError(t *testing.T) {
+	srv, client := dialTestServer(t)
+	_, err := client.Transact(ovsdb.OpenVSwitch,
+		ovsdb.Op{"op": "insert", "table": "Port", "row": ovsdb.Row{"name": "tap0"}},
+		ovsdb.Op{
+			"op":      "wait",
+			"table":   "Bridge",
+			"timeout": 0,
+			"where":   []interface{}{ovsdb.Cond("name", "==", "br0")},
+			"columns": []string{"name"},
+			"until":   "==",
+			"rows":    []interface{}{ovsdb.Row{"name": "br0"}},
+		},
+	)
+	ovsErr, ok := err.(*ovsdb.Error)
+	if !ok {
+		t.Fatalf("Expected an *ovsdb.Error, but got %v", err)
+	}
+	if ovsErr.Op != 1 {
+		t.Fatalf("Error is for operation %d, wanted 1", ovsErr.Op)
+	}
+	if rows := srv.Rows("Port"); len(rows) != 0 {
+		t.Fatalf("Failed transaction inserted %v", rows)
+	}
+}
@@ -0,0 +1,422 @@
+// Package ovsdbtest provides a fake ovsdb server, for testing code which
+// uses the ovsdb package without a real Open vSwitch.
+//
+// The server keeps its tables in memory, and implements the parts of the
+// protocol we use: the "transact" method, with the insert, select, mutate,
+// delete and wait operations. Transactions are atomic, as with the real
+// thing, but the server knows nothing of the schema: tables spring into
+// existence when first used, any column may hold any value, and there is
+// no garbage collection of unreferenced rows.
+package ovsdbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/CCI-MOC/hil-vpn/internal/ovsdb"
+)
+
+// A fake ovsdb server, listening on a unix socket.
+type Server struct {
+	// If set, the server sends an echo request ahead of each response, as
+	// the real server does periodically, to make sure clients handle it.
+	SendEcho bool
+
+	mu       sync.Mutex
+	listener net.Listener
+	tables   map[string]map[string]ovsdb.Row
+	lastUUID int
+}
+
+// Start a server listening on a unix socket at `path`.
+func NewServer(path string) (*Server, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: l,
+		tables:   map[string]map[string]ovsdb.Row{},
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Stop the server.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Add a row to `table`, returning its uuid.
+func (s *Server) Insert(table string, row ovsdb.Row) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uuid := s.newUUID()
+	s.table(table)[uuid] = normalize(row).(map[string]interface{})
+	return uuid
+}
+
+// Return a copy of the rows of `table`, by uuid.
+func (s *Server) Rows(table string) map[string]ovsdb.Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := map[string]ovsdb.Row{}
+	for uuid, row := range s.tables[table] {
+		ret[uuid] = normalize(row).(map[string]interface{})
+	}
+	return ret
+}
+
+// Return the rows of `table` whose column `column` is `value`.
+func (s *Server) Find(table, column string, value interface{}) map[string]ovsdb.Row {
+	ret := map[string]ovsdb.Row{}
+	for uuid, row := range s.Rows(table) {
+		if sameSet(row[column], normalize(value)) {
+			ret[uuid] = row
+		}
+	}
+	return ret
+}
+
+// Return the atoms in the set `v`, which is either a set (["set", [...]])
+// or a single atom, as the protocol permits for sets of one.
+func Atoms(v interface{}) []interface{} {
+	if a, ok := v.([]interface{}); ok && len(a) == 2 && a[0] == "set" {
+		atoms, _ := a[1].([]interface{})
+		return atoms
+	}
+	if v == nil {
+		return nil
+	}
+	return []interface{}{v}
+}
+
+// Convert `v` to the form it would have if decoded from JSON, so that
+// values can be compared with reflect.DeepEqual.
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var ret interface{}
+	if err = json.Unmarshal(data, &ret); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// Report whether the sets `a` and `b` have the same atoms.
+func sameSet(a, b interface{}) bool {
+	return includes(a, b) && includes(b, a)
+}
+
+// Report whether the set `a` includes all of the atoms of the set `b`.
+func includes(a, b interface{}) bool {
+	for _, atomB := range Atoms(b) {
+		found := false
+		for _, atomA := range Atoms(a) {
+			if reflect.DeepEqual(atomA, atomB) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the table named `name`, creating it if need be. The caller must
+// hold s.mu.
+func (s *Server) table(name string) map[string]ovsdb.Row {
+	t, ok := s.tables[name]
+	if !ok {
+		t = map[string]ovsdb.Row{}
+		s.tables[name] = t
+	}
+	return t
+}
+
+// Return a fresh uuid. The caller must hold s.mu.
+func (s *Server) newUUID() string {
+	s.lastUUID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", s.lastUUID)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// A message from a client; either a request, or a response to our echo.
+type message struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     interface{}     `json:"id"`
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Method == "" {
+			// A reply to our echo.
+			continue
+		}
+		if s.SendEcho {
+			enc.Encode(map[string]interface{}{
+				"method": "echo", "params": []interface{}{}, "id": "echo",
+			})
+		}
+		var result, rpcErr interface{}
+		switch msg.Method {
+		case "transact":
+			var params []interface{}
+			if err := json.Unmarshal(msg.Params, &params); err != nil {
+				rpcErr = err.Error()
+				break
+			}
+			result = s.transact(params)
+		case "echo":
+			result = msg.Params
+		case "list_dbs":
+			result = []string{ovsdb.OpenVSwitch}
+		default:
+			rpcErr = "unknown method"
+		}
+		err := enc.Encode(map[string]interface{}{
+			"result": result, "error": rpcErr, "id": msg.ID,
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// An error in an operation, which aborts the transaction.
+type opError struct {
+	kind, details string
+}
+
+// Run a transaction, returning its results.
+func (s *Server) transact(params []interface{}) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(params) == 0 || params[0] != ovsdb.OpenVSwitch {
+		return []interface{}{map[string]interface{}{"error": "unknown database"}}
+	}
+	// Keep a copy of the tables, to restore if the transaction fails:
+	saved := s.copyTables()
+	named := map[string]string{}
+	results := []interface{}{}
+	for _, p := range params[1:] {
+		op, _ := p.(map[string]interface{})
+		result, err := s.runOp(op, named)
+		if err != nil {
+			s.tables = saved
+			return append(results, map[string]interface{}{
+				"error": err.kind, "details": err.details,
+			})
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Return a deep copy of the tables. The caller must hold s.mu.
+func (s *Server) copyTables() map[string]map[string]ovsdb.Row {
+	ret := map[string]map[string]ovsdb.Row{}
+	for name, t := range s.tables {
+		ret[name] = map[string]ovsdb.Row{}
+		for uuid, row := range t {
+			ret[name][uuid] = normalize(row).(map[string]interface{})
+		}
+	}
+	return ret
+}
+
+// Run a single operation, where `named` maps the uuid-names of rows
+// inserted earlier in the transaction to their uuids.
+func (s *Server) runOp(op map[string]interface{}, named map[string]string) (interface{}, *opError) {
+	tableName, _ := op["table"].(string)
+	table := s.table(tableName)
+	where, _ := resolve(op["where"], named).([]interface{})
+	switch op["op"] {
+	case "insert":
+		row, _ := resolve(op["row"], named).(map[string]interface{})
+		if row == nil {
+			row = map[string]interface{}{}
+		}
+		uuid := s.newUUID()
+		if name, ok := op["uuid-name"].(string); ok {
+			named[name] = uuid
+		}
+		table[uuid] = row
+		return map[string]interface{}{"uuid": ovsdb.UUID(uuid)}, nil
+	case "select":
+		rows := []interface{}{}
+		for uuid, row := range table {
+			if matches(uuid, row, where) {
+				r := normalize(row).(map[string]interface{})
+				r["_uuid"] = ovsdb.UUID(uuid)
+				rows = append(rows, r)
+			}
+		}
+		return map[string]interface{}{"rows": rows}, nil
+	case "mutate":
+		mutations, _ := resolve(op["mutations"], named).([]interface{})
+		count := 0
+		for uuid, row := range table {
+			if !matches(uuid, row, where) {
+				continue
+			}
+			count++
+			for _, m := range mutations {
+				if err := mutate(row, m); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return map[string]interface{}{"count": count}, nil
+	case "delete":
+		count := 0
+		for uuid, row := range table {
+			if matches(uuid, row, where) {
+				delete(table, uuid)
+				count++
+			}
+		}
+		return map[string]interface{}{"count": count}, nil
+	case "wait":
+		columns, _ := op["columns"].([]interface{})
+		expected, _ := op["rows"].([]interface{})
+		actual := []interface{}{}
+		for uuid, row := range table {
+			if !matches(uuid, row, where) {
+				continue
+			}
+			projected := map[string]interface{}{}
+			for _, c := range columns {
+				name, _ := c.(string)
+				projected[name] = row[name]
+			}
+			actual = append(actual, projected)
+		}
+		equal := len(actual) == len(expected) && includes(
+			[]interface{}{"set", actual}, []interface{}{"set", expected})
+		if equal != (op["until"] == "==") {
+			return nil, &opError{"timed out", "wait condition not met"}
+		}
+		return map[string]interface{}{}, nil
+	default:
+		return nil, &opError{"unknown operation", fmt.Sprint(op["op"])}
+	}
+}
+
+// Replace named-uuids in `v` with the uuids they refer to.
+func resolve(v interface{}, named map[string]string) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		if len(v) == 2 && v[0] == "named-uuid" {
+			if name, ok := v[1].(string); ok && named[name] != "" {
+				return ovsdb.UUID(named[name])
+			}
+		}
+		ret := make([]interface{}, len(v))
+		for i := range v {
+			ret[i] = resolve(v[i], named)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for k, elt := range v {
+			ret[k] = resolve(elt, named)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// Report whether the row `row`, with uuid `uuid`, satisfies all of the
+// conditions in `where`.
+func matches(uuid string, row map[string]interface{}, where []interface{}) bool {
+	for _, c := range where {
+		cond, _ := c.([]interface{})
+		if len(cond) != 3 {
+			return false
+		}
+		column, _ := cond[0].(string)
+		value := row[column]
+		if column == "_uuid" {
+			value = normalize(ovsdb.UUID(uuid))
+		}
+		switch cond[1] {
+		case "==":
+			if !sameSet(value, cond[2]) {
+				return false
+			}
+		case "!=":
+			if sameSet(value, cond[2]) {
+				return false
+			}
+		case "includes":
+			if !includes(value, cond[2]) {
+				return false
+			}
+		case "excludes":
+			for _, atom := range Atoms(cond[2]) {
+				if includes(value, atom) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Apply the mutation `m` (["column", "mutator", value]) to `row`.
+func mutate(row map[string]interface{}, m interface{}) *opError {
+	mutation, _ := m.([]interface{})
+	if len(mutation) != 3 {
+		return &opError{"syntax error", fmt.Sprint(m)}
+	}
+	column, _ := mutation[0].(string)
+	atoms := Atoms(row[column])
+	switch mutation[1] {
+	case "insert":
+		for _, atom := range Atoms(mutation[2]) {
+			if !includes(row[column], atom) {
+				atoms = append(atoms, atom)
+			}
+		}
+	case "delete":
+		kept := []interface{}{}
+		for _, atom := range atoms {
+			if !includes(mutation[2], atom) {
+				kept = append(kept, atom)
+			}
+		}
+		atoms = kept
+	default:
+		return &opError{"not supported", fmt.Sprint(mutation[1])}
+	}
+	row[column] = []interface{}{"set", atoms}
+	return nil
+}
@@ -0,0 +1,356 @@
+// Package privproto defines the protocol spoken between hil-vpnd and
+// hil-vpn-privop.
+//
+// When hil-vpn-privop is invoked with the --json flag, each subcommand
+// writes its result to stdout as a single Response, encoded as JSON. When
+// it is run as a long-lived service (see `hil-vpn-privop serve`), the
+// client connects to the service's unix socket, writes a single Request as
+// JSON, and reads back a single Response, after which the connection is
+// closed.
+//
+// The batch operation additionally reads its list of requests from stdin
+// as JSON (see Request.Input). Over the socket, they are simply included
+// in the Request.
+//
+// The watch operation is the exception to the one-response rule: it writes
+// a stream of Responses, one per line, each carrying an Event, until the
+// client goes away (or, if something goes wrong, a final Response with
+// Error set).
+package privproto
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/CCI-MOC/hil-vpn/internal/validate"
+)
+
+// Operations which may appear in Request.Op. Each corresponds to the
+// hil-vpn-privop subcommand of the same name.
+const (
+	OpCreate    = "create"
+	OpStart     = "start"
+	OpStop      = "stop"
+	OpDelete    = "delete"
+	OpList      = "list"
+	OpRegen     = "regen"
+	OpVerify    = "verify"
+	OpBatch     = "batch"
+	OpVersion   = "version"
+	OpPreflight = "preflight"
+	OpWatch     = "watch"
+)
+
+// The version of the protocol. This is incremented whenever a change is
+// made which an older hil-vpnd or hil-vpn-privop would not cope with;
+// purely additive changes are instead advertised via Features.
+const ProtocolVersion = 1
+
+// Optional features, which may appear in Version.Features.
+const (
+	// The regen operation.
+	FeatureRegen = "regen"
+
+	// The verify operation.
+	FeatureVerify = "verify"
+
+	// The batch operation.
+	FeatureBatch = "batch"
+
+	// The preflight operation.
+	FeaturePreflight = "preflight"
+
+	// The watch operation.
+	FeatureWatch = "watch"
+
+	// Creating trunks: vpns which carry their vlans tagged, however many
+	// there are; see Request.Vlans.
+	FeatureVlans = "vlans"
+
+	// Creating vpns on vxlan networks; see Request.Vni.
+	FeatureVxlan = "vxlan"
+
+	// Creating routed vpns; see Request.ServerAddr.
+	FeatureRouted = "routed"
+)
+
+// The features supported by this version of the protocol.
+var Features = []string{
+	FeatureRegen,
+	FeatureVerify,
+	FeatureBatch,
+	FeaturePreflight,
+	FeatureWatch,
+	FeatureVlans,
+	FeatureVxlan,
+	FeatureRouted,
+}
+
+// A request to perform a privileged operation.
+type Request struct {
+	// The operation to perform; one of the Op* constants.
+	Op string `json:"op"`
+
+	// The name of the vpn to operate on. Required by create, start,
+	// stop and delete. For regen, an empty name means all vpns.
+	Name string `json:"name,omitempty"`
+
+	// Parameters for create. A vpn carrying its vlans tagged, as a trunk,
+	// lists them in Vlans, even if there is just one, in which case Vlan is
+	// ignored; see VlanSet. A vpn on a vxlan
+	// network sets Vni instead of either. A routed vpn, which is on no
+	// network, instead sets ServerAddr and ClientAddr, the addresses of the
+	// ends of its point-to-point link (see validate.CheckP2PAddrs).
+	Vlan       uint16   `json:"vlan,omitempty"`
+	Vlans      []uint16 `json:"vlans,omitempty"`
+	Vni        uint32   `json:"vni,omitempty"`
+	ServerAddr net.IP   `json:"server_addr,omitempty"`
+	ClientAddr net.IP   `json:"client_addr,omitempty"`
+	Port       uint16   `json:"port,omitempty"`
+
+	// Parameters for regen:
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Parameters for batch. Batch holds the requests to perform, which
+	// must be create, start, stop or delete requests. If Atomic is true,
+	// either all of them succeed, or the ones already performed are
+	// rolled back.
+	Batch  []Request `json:"batch,omitempty"`
+	Atomic bool      `json:"atomic,omitempty"`
+}
+
+// Error codes, which may appear in Error.Code.
+const (
+	// The vpn to be created already exists.
+	ErrAlreadyExists = "already_exists"
+
+	// The vpn to be deleted is still running.
+	ErrStillRunning = "still_running"
+
+	// The vpn to operate on does not exist.
+	ErrNotFound = "not_found"
+
+	// The request was malformed, e.g. an invalid vpn name.
+	ErrInvalidArgument = "invalid_argument"
+
+	// The caller is not permitted to use the service.
+	ErrPermissionDenied = "permission_denied"
+
+	// Timed out waiting for another operation to finish.
+	ErrLockTimeout = "lock_timeout"
+
+	// Anything else.
+	ErrInternal = "internal"
+)
+
+// An error reported by hil-vpn-privop.
+type Error struct {
+	// One of the Err* constants.
+	Code string `json:"code"`
+
+	// A human-readable description of the problem.
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Report whether `err` is an *Error with the given code.
+func IsCode(err error, code string) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
+
+// The result of a request. Which fields are set depends on the operation.
+type Response struct {
+	// If the operation failed, the reason. Nil on success, in which case
+	// the remaining fields hold the results.
+	Error *Error `json:"error,omitempty"`
+
+	// The new vpn's static key (create).
+	Key string `json:"key,omitempty"`
+
+	// The names of all vpns (list), or of the vpns whose configs were
+	// changed (regen).
+	Vpns []string `json:"vpns,omitempty"`
+
+	// A diff of the changes that would be made (regen, with DryRun set).
+	Diff string `json:"diff,omitempty"`
+
+	// Problems found with the vpns' files (verify).
+	Problems []Problem `json:"problems,omitempty"`
+
+	// The results of each request in the batch, in order (batch). If an
+	// atomic batch fails, Error is set, and Results stops at the request
+	// which failed.
+	Results []Response `json:"results,omitempty"`
+
+	// Whether the requests in Results were rolled back, following the
+	// failure of an atomic batch (batch).
+	RolledBack bool `json:"rolled_back,omitempty"`
+
+	// Information about hil-vpn-privop (version).
+	Version *Version `json:"version,omitempty"`
+
+	// The results of checking the environment (preflight).
+	Checks []Check `json:"checks,omitempty"`
+
+	// A change in the state of a vpn (watch).
+	Event *Event `json:"event,omitempty"`
+}
+
+// A change in the state of a vpn's openvpn instance, as reported by watch.
+// When the watch starts, an event is sent with the current state of each
+// vpn.
+type Event struct {
+	// The name of the vpn.
+	Vpn string `json:"vpn"`
+
+	// The vpn's new state. With systemd, this is the ActiveState of the
+	// vpn's unit, e.g. "active", "activating" or "failed". Other service
+	// managers use the same names, though perhaps only some of them.
+	State string `json:"state"`
+
+	// For the "failed" state, a short description of how openvpn failed,
+	// e.g. "exit-code", if known.
+	Result string `json:"result,omitempty"`
+}
+
+// The result of one of the checks made by preflight.
+type Check struct {
+	// A short name for what was checked, e.g. "openvpn".
+	Name string `json:"name"`
+
+	// Whether the check passed.
+	OK bool `json:"ok"`
+
+	// A human-readable description of what was found.
+	Detail string `json:"detail"`
+
+	// If the check failed, a suggestion for how to fix the problem.
+	Fix string `json:"fix,omitempty"`
+}
+
+// Information about a hil-vpn-privop, which hil-vpnd uses to check that it
+// is compatible.
+type Version struct {
+	// The protocol version; see ProtocolVersion.
+	Protocol int `json:"protocol"`
+
+	// The optional features supported; see the Feature* constants.
+	Features []string `json:"features"`
+
+	// A regular expression matching the vpn names which will be
+	// accepted.
+	NamePattern string `json:"name_pattern"`
+}
+
+// Report whether `feature` is one of v's features.
+func (v Version) HasFeature(feature string) bool {
+	for _, f := range v.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// A problem with a vpn's files, as reported by verify.
+type Problem struct {
+	// The name of the vpn.
+	Vpn string `json:"vpn"`
+
+	// A short machine-readable description of the problem, e.g.
+	// "conf_modified".
+	Kind string `json:"kind"`
+
+	// A human-readable description of the problem.
+	Detail string `json:"detail"`
+}
+
+// Return the vlans a create request is for: Vlans if set, otherwise just
+// Vlan. A request for a vxlan network (see Vni) or a routed vpn is for
+// none.
+func (r Request) VlanSet() []uint16 {
+	if r.Vni != 0 || r.ServerAddr != nil {
+		return nil
+	}
+	if len(r.Vlans) > 0 {
+		return r.Vlans
+	}
+	return []uint16{r.Vlan}
+}
+
+// Report whether a create request is for a trunk, carrying its vlans
+// tagged: whether it lists them in Vlans.
+func (r Request) Tagged() bool {
+	return r.Vni == 0 && r.ServerAddr == nil && len(r.Vlans) > 0
+}
+
+// Return the network a create request is for, as it is passed on
+// hil-vpn-privop's command line; see validate.ParseNetwork. For a routed
+// vpn, this is its addresses instead; see validate.ParseRouted.
+func (r Request) Network() string {
+	if r.ServerAddr != nil {
+		return validate.FormatRouted(r.ServerAddr, r.ClientAddr)
+	}
+	if r.Vni != 0 {
+		return validate.FormatVni(r.Vni)
+	}
+	if r.Tagged() {
+		return validate.FormatTrunk(r.Vlans)
+	}
+	return validate.FormatVlans(r.VlanSet())
+}
+
+// Return the hil-vpn-privop command line arguments (not including the
+// program name or --json) which perform the request.
+func (r Request) Args() ([]string, error) {
+	switch r.Op {
+	case OpCreate:
+		return []string{
+			r.Op,
+			r.Name,
+			r.Network(),
+			strconv.Itoa(int(r.Port)),
+		}, nil
+	case OpStart, OpStop, OpDelete:
+		return []string{r.Op, r.Name}, nil
+	case OpList, OpVerify, OpVersion, OpPreflight, OpWatch:
+		return []string{r.Op}, nil
+	case OpRegen:
+		args := []string{r.Op}
+		if r.DryRun {
+			args = append(args, "--dry-run")
+		}
+		if r.Name == "" {
+			return append(args, "--all"), nil
+		}
+		return append(args, r.Name), nil
+	case OpBatch:
+		if r.Atomic {
+			return []string{r.Op, "--atomic"}, nil
+		}
+		return []string{r.Op}, nil
+	default:
+		return nil, &Error{
+			Code:    ErrInvalidArgument,
+			Message: fmt.Sprintf("Unknown operation %q", r.Op),
+		}
+	}
+}
+
+// Return the data which must be supplied on stdin to hil-vpn-privop when
+// running the command line returned by Args, or nil if none is needed.
+func (r Request) Input() ([]byte, error) {
+	if r.Op != OpBatch {
+		return nil, nil
+	}
+	if r.Batch == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(r.Batch)
+}
@@ -32,4 +32,31 @@ var (
 	Libdir         string
 	Localedir      string
 	Mandir         string
+
+	// Paths specific to hil-vpn. These are also set by the Makefile, which
+	// refuses to set them to empty paths.
+
+	// The directory in which we store openvpn configs and keys. This must
+	// be the directory from which the openvpn-server@.service systemd
+	// unit loads its configs. Since that doesn't depend on where hil-vpn
+	// is installed, this isn't derived from the directories above, and
+	// has the same default here as in the Makefile.
+	Openvpnconfdir = "/etc/openvpn/server"
+
+	// A directory, private to root, in which hil-vpn-privop keeps its
+	// lock files. If not set at link-time, this is derived from
+	// Runstatedir; see init.
+	Lockdir string
 )
+
+// A plain `go build` sets none of the above, so fill in those we can't do
+// without. Runstatedir defaults to /run, which is where it is on any
+// system running systemd; Lockdir is derived from it, as in the Makefile.
+func init() {
+	if Runstatedir == "" {
+		Runstatedir = "/run"
+	}
+	if Lockdir == "" {
+		Lockdir = Runstatedir + "/hil-vpn"
+	}
+}
@@ -2,11 +2,16 @@ package validate
 
 import (
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // A regular expression matching legal vpn names.
-var vpnNameRegexp = regexp.MustCompile("^[-_a-zA-Z0-9]+$")
+const VpnNamePattern = "^[-_a-zA-Z0-9]+$"
+
+var vpnNameRegexp = regexp.MustCompile(VpnNamePattern)
 
 // Check whether `name` is a legal name for a vpn. If so, return nil,
 // otherwise return an error
@@ -29,3 +34,190 @@ func CheckVlanNo(vlanNo uint16) error {
 		"Invalid Vlan ID #%d; Vlan IDs must be in the range [1,4094] (inclusive)",
 		vlanNo)
 }
+
+// The most vlans a single vpn may carry. Each vpn's vlans are listed on the
+// lines of its openvpn config which run hil-vpn-hook, and openvpn limits
+// those to 256 characters.
+const MaxVlans = 16
+
+// Check whether `vlans` is a valid set of vlans for a vpn: there must be at
+// least one, no more than MaxVlans, each must be a valid vlan id, and none
+// may be repeated. If so, return nil, otherwise return an error.
+func CheckVlans(vlans []uint16) error {
+	if len(vlans) == 0 {
+		return fmt.Errorf("No vlans given; a vpn must carry at least one vlan")
+	}
+	if len(vlans) > MaxVlans {
+		return fmt.Errorf("Too many vlans (%d); a vpn may carry at most %d",
+			len(vlans), MaxVlans)
+	}
+	seen := map[uint16]bool{}
+	for _, vlanNo := range vlans {
+		if err := CheckVlanNo(vlanNo); err != nil {
+			return err
+		}
+		if seen[vlanNo] {
+			return fmt.Errorf("Vlan ID #%d is listed more than once", vlanNo)
+		}
+		seen[vlanNo] = true
+	}
+	return nil
+}
+
+// Return `vlans` as a comma-separated list, e.g. "232,233", which is how
+// sets of vlans are passed on command lines; see ParseVlans.
+func FormatVlans(vlans []uint16) string {
+	strs := make([]string, len(vlans))
+	for i, vlanNo := range vlans {
+		strs[i] = strconv.Itoa(int(vlanNo))
+	}
+	return strings.Join(strs, ",")
+}
+
+// The prefix which marks a single vlan carried tagged, as a trunk of one,
+// on command lines, e.g. "trunk:232"; see FormatTrunk. A list of several
+// vlans is always a trunk, so needs no prefix.
+const trunkPrefix = "trunk:"
+
+// Return the vlans in `vlans`, carried tagged, as they are passed on
+// command lines; see ParseNetwork.
+func FormatTrunk(vlans []uint16) string {
+	if len(vlans) == 1 {
+		return trunkPrefix + FormatVlans(vlans)
+	}
+	return FormatVlans(vlans)
+}
+
+// Parse a comma-separated list of vlans, as returned by FormatVlans, and
+// check it with CheckVlans. A single vlan id is a list of one.
+func ParseVlans(s string) ([]uint16, error) {
+	vlans := []uint16{}
+	for _, str := range strings.Split(s, ",") {
+		vlanNo, err := strconv.ParseUint(str, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vlan list %q: %v", s, err)
+		}
+		vlans = append(vlans, uint16(vlanNo))
+	}
+	if err := CheckVlans(vlans); err != nil {
+		return nil, err
+	}
+	return vlans, nil
+}
+
+// The largest vxlan network identifier (VNI); they are 24 bits.
+const MaxVni = 1<<24 - 1
+
+// Check whether `vni` is a valid vxlan network identifier. If so, return
+// nil, otherwise return an error.
+func CheckVni(vni uint32) error {
+	if 0 < vni && vni <= MaxVni {
+		return nil
+	}
+	return fmt.Errorf(
+		"Invalid VNI #%d; VNIs must be in the range [1,%d] (inclusive)",
+		vni, MaxVni)
+}
+
+// The types of network a vpn may be attached to.
+const (
+	// One or more 802.1Q vlans.
+	NetworkVlan = "vlan"
+	// A vxlan overlay network, identified by its VNI.
+	NetworkVxlan = "vxlan"
+)
+
+// The prefix which marks a vxlan network on command lines, e.g.
+// "vxlan:5000"; see FormatVni.
+const vxlanPrefix = NetworkVxlan + ":"
+
+// Return the vxlan network `vni` as it is passed on command lines, e.g.
+// "vxlan:5000"; see ParseNetwork.
+func FormatVni(vni uint32) string {
+	return vxlanPrefix + strconv.FormatUint(uint64(vni), 10)
+}
+
+// Parse a network as passed on command lines: either a vxlan network, as
+// returned by FormatVni, a trunk, as returned by FormatTrunk, or a single
+// vlan, carried untagged. Exactly one of `vlans` and `vni` is set in the
+// result, and `tagged` is set for a trunk.
+func ParseNetwork(s string) (vlans []uint16, tagged bool, vni uint32, err error) {
+	switch {
+	case strings.HasPrefix(s, vxlanPrefix):
+		n, err := strconv.ParseUint(strings.TrimPrefix(s, vxlanPrefix), 10, 32)
+		if err != nil {
+			return nil, false, 0, fmt.Errorf("Invalid vxlan network %q: %v", s, err)
+		}
+		if err = CheckVni(uint32(n)); err != nil {
+			return nil, false, 0, err
+		}
+		return nil, false, uint32(n), nil
+	case strings.HasPrefix(s, trunkPrefix):
+		vlans, err = ParseVlans(strings.TrimPrefix(s, trunkPrefix))
+		return vlans, true, 0, err
+	default:
+		vlans, err = ParseVlans(s)
+		return vlans, len(vlans) > 1, 0, err
+	}
+}
+
+// The prefix which marks a routed vpn's addresses on command lines, in
+// place of its network, e.g. "routed:10.0.0.1,10.0.0.2"; see FormatRouted.
+const RoutedPrefix = "routed:"
+
+// Check whether `server` and `client` are valid addresses for the ends of a
+// routed vpn's point-to-point link: they must be distinct addresses in the
+// same /30 (for IPv4, in which case neither may be the subnet's network or
+// broadcast address) or /127 (for IPv6). If so, return nil, otherwise
+// return an error.
+func CheckP2PAddrs(server, client net.IP) error {
+	if server == nil || client == nil {
+		return fmt.Errorf("Both a server and a client address are required")
+	}
+	bits := 127
+	if s4, c4 := server.To4(), client.To4(); (s4 == nil) != (c4 == nil) {
+		return fmt.Errorf("Addresses %s and %s are of different families",
+			server, client)
+	} else if s4 != nil {
+		bits, server, client = 30, s4, c4
+	}
+	mask := net.CIDRMask(bits, 8*len(server))
+	subnet := &net.IPNet{IP: server.Mask(mask), Mask: mask}
+	if server.Equal(client) || !subnet.Contains(client) {
+		return fmt.Errorf("Addresses %s and %s are not the two ends of a "+
+			"/%d subnet", server, client, bits)
+	}
+	if bits == 30 {
+		for _, ip := range []net.IP{server, client} {
+			if host := ip[3] & 3; host == 0 || host == 3 {
+				return fmt.Errorf("Address %s is the network or broadcast "+
+					"address of its /30", ip)
+			}
+		}
+	}
+	return nil
+}
+
+// Return the addresses of a routed vpn as they are passed on command lines,
+// e.g. "routed:10.0.0.1,10.0.0.2"; see ParseRouted.
+func FormatRouted(server, client net.IP) string {
+	return RoutedPrefix + server.String() + "," + client.String()
+}
+
+// Parse the addresses of a routed vpn, as returned by FormatRouted, and
+// check them with CheckP2PAddrs.
+func ParseRouted(s string) (server, client net.IP, err error) {
+	addrs := strings.Split(strings.TrimPrefix(s, RoutedPrefix), ",")
+	if !strings.HasPrefix(s, RoutedPrefix) || len(addrs) != 2 {
+		return nil, nil, fmt.Errorf("Invalid routed vpn addresses %q; expected "+
+			"%s<server>,<client>", s, RoutedPrefix)
+	}
+	server, client = net.ParseIP(addrs[0]), net.ParseIP(addrs[1])
+	if server == nil || client == nil {
+		return nil, nil, fmt.Errorf("Invalid routed vpn addresses %q", s)
+	}
+	if err = CheckP2PAddrs(server, client); err != nil {
+		return nil, nil, err
+	}
+	return server, client, nil
+}